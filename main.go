@@ -59,6 +59,10 @@ var (
 	BuildTime = "none"
 )
 
+// registryEnvPrefix is the prefix of the environment variables with the registry credentials
+// injected by CI, e.g. REGISTRY_USER, see compose.AuthFromEnv
+const registryEnvPrefix = "REGISTRY"
+
 func init() {
 	log.SetLevel(log.InfoLevel)
 	debugtrap.SetupDumpStackTrap()
@@ -94,7 +98,37 @@ func main() {
 		},
 	}
 
-	composeFlags := appendFlags(fileArg, varsFlags, []cli.Flag{
+	resolveFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  "include-prerelease",
+			Usage: "let image version ranges resolve to pre-release tags, e.g. 1.4.0-rc1",
+		},
+		cli.BoolFlag{
+			Name:  "ignore-latest",
+			Usage: "never resolve image version ranges or images without a tag to the 'latest' tag",
+		},
+		cli.StringFlag{
+			Name:  "resolve-strategy",
+			Value: string(compose.ResolveSemver),
+			Usage: "how to compare image tags when resolving wildcards: 'semver' or 'date' for timestamp tags like 20240115-1430",
+		},
+		cli.StringFlag{
+			Name:  "wildcard",
+			Value: string(compose.WildcardNewest),
+			Usage: "what the '*' tag, e.g. app:*, pulls: 'newest' matching tag like a version range, or 'all' of them",
+		},
+		cli.BoolFlag{
+			Name:  "include-artifacts",
+			Usage: "let image version ranges resolve to tags of OCI artifacts, e.g. Helm charts, kept in the same repository",
+		},
+		cli.StringSliceFlag{
+			Name:  "ignore-tag",
+			Value: &cli.StringSlice{},
+			Usage: "tag or glob pattern, e.g. 'nightly' or 'canary-*', never chosen by image version ranges; can pass multiple",
+		},
+	}
+
+	composeFlags := appendFlags(fileArg, varsFlags, resolveFlags, []cli.Flag{
 		cli.BoolFlag{
 			Name:  "dry, d",
 			Usage: "Don't execute any run/stop operations on target docker",
@@ -111,12 +145,26 @@ func main() {
 			Name:  "tar",
 			Usage: "the input compose file is a release tar archive (see 'tar' command)",
 		},
+		cli.BoolFlag{
+			Name:   "strict-pinning",
+			Usage:  "fail if any image resolves to a mutable tag such as 'latest', 'stable' or a version range",
+			EnvVar: "ROCKER_COMPOSE_STRICT_PINNING",
+		},
+		cli.BoolFlag{
+			Name:  "verify-floating-tags",
+			Usage: "pull images of floating tags such as 'latest' again if the tag was moved in the registry, even without --pull",
+		},
 	})
 
 	app.Flags = append([]cli.Flag{
 		cli.BoolFlag{
 			Name: "verbose, vv, D",
 		},
+		cli.BoolFlag{
+			Name:   "trace",
+			Usage:  "Log every registry request and docker daemon call of image pulls with their results",
+			EnvVar: "ROCKER_COMPOSE_TRACE",
+		},
 		cli.StringFlag{
 			Name: "log, l",
 		},
@@ -136,6 +184,87 @@ func main() {
 			Value: 2 * time.Second,
 			Usage: "Timeout for docker to send a response to ping during initialization",
 		},
+		cli.DurationFlag{
+			Name:   "docker-dial-timeout",
+			Usage:  "Timeout of establishing a connection to docker, e.g. 10s; the library default if not set",
+			EnvVar: "ROCKER_COMPOSE_DOCKER_DIAL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "docker-response-timeout",
+			Usage:  "Timeout of waiting for docker response headers, e.g. 1m; no limit by default",
+			EnvVar: "ROCKER_COMPOSE_DOCKER_RESPONSE_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "registry-timeout",
+			Value:  compose.DefaultRegistryTimeout,
+			Usage:  "Timeout of a single request to the docker registry when listing image tags",
+			EnvVar: "ROCKER_COMPOSE_REGISTRY_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:  "registry-max-tags",
+			Value: compose.DefaultRegistryMaxTags,
+			Usage: "Maximum number of image tags to list from the docker registry when resolving versions",
+		},
+		cli.StringSliceFlag{
+			Name:  "insecure-registry",
+			Value: &cli.StringSlice{},
+			Usage: "Registry host[:port] or CIDR subnet to list image tags from over plain http, can pass multiple of this",
+		},
+		cli.DurationFlag{
+			Name:   "pull-timeout",
+			Usage:  "Abort an image pull if it takes longer than this, e.g. 10m, it is not retried then; no limit by default",
+			EnvVar: "ROCKER_COMPOSE_PULL_TIMEOUT",
+		},
+		cli.DurationFlag{
+			Name:   "pull-summary-interval",
+			Usage:  "Log a summary line of image pulls at most once per this interval, e.g. 10s, instead of every progress message when the output is not a terminal",
+			EnvVar: "ROCKER_COMPOSE_PULL_SUMMARY_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "pull-jitter",
+			Usage:  "Sleep a random time up to this before every image pull, e.g. 30s, to spread the registry load of parallel deploys",
+			EnvVar: "ROCKER_COMPOSE_PULL_JITTER",
+		},
+		cli.StringSliceFlag{
+			Name:  "fallback-registry",
+			Value: &cli.StringSlice{},
+			Usage: "Registry host to pull images from if the image's own registry fails, can pass multiple of this",
+		},
+		cli.StringFlag{
+			Name:   "platform",
+			Usage:  "Platform os/arch[/variant] that pulled images must be built for, e.g. linux/arm64",
+			EnvVar: "DOCKER_DEFAULT_PLATFORM",
+		},
+		cli.StringFlag{
+			Name:   "hub-mirror",
+			Usage:  "Host[:port] of a pull-through Docker Hub mirror to pull and list Docker Hub images from",
+			EnvVar: "ROCKER_COMPOSE_HUB_MIRROR",
+		},
+		cli.StringFlag{
+			Name:   "pull-policy",
+			Usage:  "When to pull images: Always, IfNotPresent or Never; overrides --pull if set",
+			EnvVar: "ROCKER_COMPOSE_PULL_POLICY",
+		},
+		cli.BoolFlag{
+			Name:   "reuse-local-digests",
+			Usage:  "Tag a local image of the same digest, e.g. pulled from another registry, instead of pulling the image",
+			EnvVar: "ROCKER_COMPOSE_REUSE_LOCAL_DIGESTS",
+		},
+		cli.BoolFlag{
+			Name:   "no-bridge-image-pull",
+			Usage:  "Never pull the image of the dummy container used to obtain the bridge ip, fail if it is not present",
+			EnvVar: "ROCKER_COMPOSE_NO_BRIDGE_IMAGE_PULL",
+		},
+		cli.StringFlag{
+			Name:   "bridge-gateway-cmd",
+			Usage:  "Shell command that prints the bridge ip instead of asking docker, e.g. for custom CNI; $ROCKER_COMPOSE_NETWORK is the network",
+			EnvVar: "ROCKER_COMPOSE_BRIDGE_GATEWAY_CMD",
+		},
+		cli.IntFlag{
+			Name:  "pull-concurrency",
+			Value: 1,
+			Usage: "Number of images to pull in parallel",
+		},
 		cli.IntFlag{
 			Name:  "docker-ping-retries",
 			Value: 5,
@@ -170,6 +299,10 @@ func main() {
 					Name:  "ansible",
 					Usage: "output json in ansible format for easy parsing",
 				},
+				cli.BoolFlag{
+					Name:  "prune-dangling",
+					Usage: "Remove untagged images that are not used by any container after the run",
+				},
 			}, composeFlags...),
 		},
 		{
@@ -183,6 +316,12 @@ func main() {
 				},
 			}, composeFlags...),
 		},
+		{
+			Name:   "warm",
+			Usage:  "pull images listed in the given file (or STDIN if `-`), one per line, e.g. to pre-stage them on a new host",
+			Action: warmCommand,
+			Flags:  resolveFlags,
+		},
 		{
 			Name:   "rm",
 			Usage:  "stop and remove any containers specified in the manifest",
@@ -267,6 +406,7 @@ func runCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
 	dockerCli := initDockerClient(ctx)
+	defer compose.CloseDockerClient(dockerCli)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
 
@@ -279,6 +419,12 @@ func runCommand(ctx *cli.Context) {
 		Wait:     ctx.Duration("wait"),
 		Pull:     ctx.Bool("pull"),
 		Auth:     auth,
+		Registry: initRegistryConfig(ctx),
+		Resolve:  initResolveOptions(ctx),
+
+		PullOptions:     initPullOptions(ctx),
+		PullConcurrency: ctx.GlobalInt("pull-concurrency"),
+		AuthResolver:    initAuthResolver(ctx),
 	})
 
 	if err != nil {
@@ -296,6 +442,12 @@ func runCommand(ctx *cli.Context) {
 		fatalf(err)
 	}
 
+	if ctx.Bool("prune-dangling") && !ctx.Bool("dry") {
+		if err := compose.PruneDanglingAction(); err != nil {
+			log.Warn(err)
+		}
+	}
+
 	if ansibleResp != nil {
 		// ansibleResp.Success("done hehe").WriteTo(os.Stdout)
 		compose.WritePlan(ansibleResp).WriteTo(os.Stdout)
@@ -315,6 +467,7 @@ func pullCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
 	dockerCli := initDockerClient(ctx)
+	defer compose.CloseDockerClient(dockerCli)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
 
@@ -323,6 +476,12 @@ func pullCommand(ctx *cli.Context) {
 		Docker:   dockerCli,
 		DryRun:   ctx.Bool("dry"),
 		Auth:     auth,
+		Registry: initRegistryConfig(ctx),
+		Resolve:  initResolveOptions(ctx),
+
+		PullOptions:     initPullOptions(ctx),
+		PullConcurrency: ctx.GlobalInt("pull-concurrency"),
+		AuthResolver:    initAuthResolver(ctx),
 	})
 	if err != nil {
 		fatalf(err)
@@ -338,10 +497,66 @@ func pullCommand(ctx *cli.Context) {
 	}
 }
 
+func warmCommand(ctx *cli.Context) {
+	initLogs(ctx)
+
+	if len(ctx.Args()) != 1 {
+		log.Fatal("Expected exactly one argument, the file of images to pull")
+	}
+
+	var (
+		file = ctx.Args().First()
+		in   io.Reader
+	)
+	if file == "-" {
+		in = os.Stdin
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	inline := &docker.AuthConfigurations{}
+	images, err := compose.ParseImageList(in, inline)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	resolver := initAuthResolver(ctx)
+	// credentials given inline in the list take precedence over any other
+	if len(inline.Configs) > 0 {
+		resolver = compose.AuthResolvers{compose.NewStaticAuthResolver(inline), resolver}
+	}
+	client, err := compose.NewClient(&compose.DockerClient{
+		Docker:   initDockerClient(ctx),
+		Auth:     initAuthConfig(ctx),
+		Registry: initRegistryConfig(ctx),
+		Resolve:  initResolveOptions(ctx),
+
+		PullOptions:     initPullOptions(ctx),
+		PullConcurrency: ctx.GlobalInt("pull-concurrency"),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Close()
+
+	client.Registry.AuthResolver = resolver
+	client.PullOptions.AuthResolver = resolver
+
+	if err := client.WarmImages(images); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func rmCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
 	dockerCli := initDockerClient(ctx)
+	defer compose.CloseDockerClient(dockerCli)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
 
@@ -363,6 +578,7 @@ func cleanCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
 	dockerCli := initDockerClient(ctx)
+	defer compose.CloseDockerClient(dockerCli)
 	config := initComposeConfig(ctx, dockerCli)
 	auth := initAuthConfig(ctx)
 
@@ -420,6 +636,7 @@ func recoverCommand(ctx *cli.Context) {
 	initLogs(ctx)
 
 	dockerCli := initDockerClient(ctx)
+	defer compose.CloseDockerClient(dockerCli)
 	auth := initAuthConfig(ctx)
 
 	compose, err := compose.New(&compose.Config{
@@ -442,6 +659,9 @@ func recoverCommand(ctx *cli.Context) {
 func initLogs(ctx *cli.Context) {
 	logger := log.StandardLogger()
 
+	// traces are logged at the info level, they do not need --verbose
+	compose.TraceCalls = ctx.GlobalBool("trace")
+
 	if ctx.GlobalBool("verbose") {
 		logger.Level = log.DebugLevel
 	} else if ctx.Bool("print") && ctx.GlobalString("log") == "" {
@@ -491,7 +711,6 @@ func initComposeConfig(ctx *cli.Context, dockerCli *docker.Client) *config.Confi
 	var (
 		manifest *config.Config
 		err      error
-		bridgeIP *string
 		fd       io.Reader = os.Stdin
 		isTar              = ctx.Bool("tar")
 		print              = ctx.Bool("print")
@@ -503,18 +722,30 @@ func initComposeConfig(ctx *cli.Context, dockerCli *docker.Client) *config.Confi
 		vars["DemandArtifacts"] = true
 	}
 
+	// do not run the dummy container to get bridge ip in dry run
+	compose.BridgeIPDryRun = ctx.Bool("dry")
+
+	// air-gapped hosts may forbid any implicit pulls
+	compose.BridgeImagePullDisabled = ctx.GlobalBool("no-bridge-image-pull")
+
+	// custom networking may need its own way to find the gateway
+	if cmd := ctx.GlobalString("bridge-gateway-cmd"); cmd != "" {
+		compose.BridgeGatewayCommand = []string{"sh", "-c", cmd}
+	}
+
 	// TODO: find better place for providing this helper
 	funcs := map[string]interface{}{
-		// lazy get bridge ip
-		"bridgeIp": func() (ip string, err error) {
-			if bridgeIP == nil {
-				ip, err = compose.GetBridgeIP(dockerCli)
-				if err != nil {
-					return "", err
-				}
-				bridgeIP = &ip
+		// lazy get bridge ip, it is cached by compose.GetBridgeIP;
+		// optionally takes the name of the network, e.g. {{ bridgeIp "mynet" }}
+		"bridgeIp": func(network ...string) (ip string, err error) {
+			// the dummy container image may need credentials the same way as other images
+			if compose.BridgeImageAuth == nil {
+				compose.BridgeImageAuth = initAuthConfig(ctx)
+			}
+			if len(network) > 0 {
+				return compose.GetNetworkGatewayIP(dockerCli, network[0])
 			}
-			return *bridgeIP, nil
+			return compose.GetBridgeIP(dockerCli)
 		},
 	}
 
@@ -647,14 +878,57 @@ func initVars(c *cli.Context) template.Vars {
 }
 
 func initDockerClient(ctx *cli.Context) *docker.Client {
-	dockerClient, err := dockerclient.NewFromCli(ctx)
+	// the env is read by the library, the flags given explicitly take precedence over it
+	config, err := compose.NewDockerClientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	flags := dockerclient.NewConfigFromCli(ctx)
+	if ctx.GlobalIsSet("host") {
+		config.Host = flags.Host
+	}
+	if ctx.GlobalIsSet("tlsverify") {
+		config.Tlsverify = flags.Tlsverify
+		config.Tlscacert = flags.Tlscacert
+		config.Tlscert = flags.Tlscert
+		config.Tlskey = flags.Tlskey
+	}
+	config.DialTimeout = ctx.GlobalDuration("docker-dial-timeout")
+	config.ResponseHeaderTimeout = ctx.GlobalDuration("docker-response-timeout")
+
+	// the host and cert paths may reference other variables, e.g. ${DEPLOY_DOCKER_HOST}
+	clientConfig, err := compose.InterpolateDockerClientConfig(config, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dockerClient, err := compose.NewDockerClientFromConfig(clientConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// log.Fatal exits skipping the deferred close, the ssh tunnel would be left running
+	log.AddHook(closeOnFatalHook{dockerClient})
+
 	return dockerClient
 }
 
+// closeOnFatalHook closes the docker client when a fatal error is logged, right before exit
+type closeOnFatalHook struct {
+	client *docker.Client
+}
+
+// Levels implements log.Hook
+func (h closeOnFatalHook) Levels() []log.Level {
+	return []log.Level{log.FatalLevel}
+}
+
+// Fire implements log.Hook
+func (h closeOnFatalHook) Fire(entry *log.Entry) error {
+	return compose.CloseDockerClient(h.client)
+}
+
 func initAuthConfig(c *cli.Context) (auth *docker.AuthConfigurations) {
 	var err error
 	if c.GlobalIsSet("auth") {
@@ -677,7 +951,80 @@ func initAuthConfig(c *cli.Context) (auth *docker.AuthConfigurations) {
 	if auth, err = docker.NewAuthConfigurationsFromDockerCfg(); err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
-	return
+	// credentials injected by CI are added for the servers they name, unless --auth is given
+	return compose.WithEnvAuth(auth, registryEnvPrefix)
+}
+
+func initAuthResolver(c *cli.Context) compose.AuthResolver {
+	// credentials given explicitly take precedence over the docker config
+	if c.GlobalIsSet("auth") {
+		return nil
+	}
+	// a broken docker config only matters for the pulls that need credentials,
+	// those fail with the registry error and public images are pulled anonymously
+	resolver, err := compose.NewDockerConfigAuth()
+	if err != nil {
+		log.Warnf("Ignoring docker config credentials, error: %s", err)
+		return nil
+	}
+	return resolver
+}
+
+func initRegistryConfig(c *cli.Context) compose.RegistryConfig {
+	userAgent := "rocker-compose"
+	if Version != "built locally" {
+		userAgent += "/" + Version
+	}
+
+	return compose.RegistryConfig{
+		UserAgent:          userAgent,
+		Timeout:            c.GlobalDuration("registry-timeout"),
+		InsecureRegistries: c.GlobalStringSlice("insecure-registry"),
+		MaxTags:            c.GlobalInt("registry-max-tags"),
+		HubMirror:          c.GlobalString("hub-mirror"),
+	}
+}
+
+func initResolveOptions(c *cli.Context) compose.ResolveOptions {
+	strategy := compose.ResolveStrategy(c.String("resolve-strategy"))
+	if strategy != compose.ResolveSemver && strategy != compose.ResolveDate {
+		log.Fatalf("Unknown resolve strategy %q, expected 'semver' or 'date'", strategy)
+	}
+
+	wildcard := compose.WildcardPolicy(c.String("wildcard"))
+	if wildcard != compose.WildcardNewest && wildcard != compose.WildcardAll {
+		log.Fatalf("Unknown wildcard policy %q, expected 'newest' or 'all'", wildcard)
+	}
+
+	return compose.ResolveOptions{
+		IncludePrerelease: c.Bool("include-prerelease"),
+		Strategy:          strategy,
+		IgnoreLatest:      c.Bool("ignore-latest"),
+		StrictPinning:     c.Bool("strict-pinning"),
+		Wildcard:          wildcard,
+		IncludeArtifacts:  c.Bool("include-artifacts"),
+		IgnoreTags:        c.StringSlice("ignore-tag"),
+
+		VerifyFloatingTags: c.Bool("verify-floating-tags"),
+	}
+}
+
+func initPullOptions(c *cli.Context) compose.PullOptions {
+	policy, err := compose.ParsePullPolicy(c.GlobalString("pull-policy"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return compose.PullOptions{
+		Policy:             policy,
+		FallbackRegistries: c.GlobalStringSlice("fallback-registry"),
+		Timeout:            c.GlobalDuration("pull-timeout"),
+		Jitter:             c.GlobalDuration("pull-jitter"),
+		SummaryInterval:    c.GlobalDuration("pull-summary-interval"),
+		HubMirror:          c.GlobalString("hub-mirror"),
+		Platform:           c.GlobalString("platform"),
+		ReuseLocalDigest:   c.GlobalBool("reuse-local-digests"),
+	}
 }
 
 func initAnsubleResp(ctx *cli.Context) (ansibleResp *ansible.Response) {
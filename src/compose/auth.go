@@ -0,0 +1,418 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	dockerHubAuthKey       = "https://index.docker.io/v1/"
+	credHelperNotFoundText = "credentials not found"
+)
+
+// AuthResolver finds credentials for the registry of a given image.
+// It returns an empty AuthConfiguration if it has no credentials for the registry.
+type AuthResolver interface {
+	ResolveAuth(image *imagename.ImageName) (docker.AuthConfiguration, error)
+}
+
+// AuthProvider returns credentials right before every pull attempt or registry request,
+// so short-lived tokens can be renewed during long runs. It implements AuthResolver
+// and is used for any registry.
+type AuthProvider func() (docker.AuthConfiguration, error)
+
+// ResolveAuth implements AuthResolver
+func (p AuthProvider) ResolveAuth(image *imagename.ImageName) (docker.AuthConfiguration, error) {
+	return p()
+}
+
+// StaticAuthProvider returns AuthProvider of the fixed credentials
+func StaticAuthProvider(auth docker.AuthConfiguration) AuthProvider {
+	return func() (docker.AuthConfiguration, error) {
+		return auth, nil
+	}
+}
+
+// NewStaticAuthResolver returns AuthResolver that finds credentials of the registry among
+// the given auth configurations
+func NewStaticAuthResolver(auth *docker.AuthConfigurations) AuthResolver {
+	return staticAuthResolver{auth}
+}
+
+// AuthResolvers tries the resolvers in order and returns the first credentials found
+type AuthResolvers []AuthResolver
+
+// ResolveAuth implements AuthResolver
+func (r AuthResolvers) ResolveAuth(image *imagename.ImageName) (result docker.AuthConfiguration, err error) {
+	for _, resolver := range r {
+		if resolver == nil {
+			continue
+		}
+		if result, err = resolver.ResolveAuth(image); err != nil || result.Username != "" {
+			return
+		}
+	}
+	return
+}
+
+// staticAuthResolver finds credentials of the registry among the static auth configurations
+type staticAuthResolver struct {
+	auth *docker.AuthConfigurations
+}
+
+// ResolveAuth implements AuthResolver
+func (r staticAuthResolver) ResolveAuth(image *imagename.ImageName) (docker.AuthConfiguration, error) {
+	return dockerclient.GetAuthForRegistry(r.auth, image)
+}
+
+// DockerConfigAuth resolves registry credentials the same way docker cli does:
+// per registry credential helpers go first, then the default credentials store
+// and then the static "auths" entries of the docker config.json. Helpers are
+// the docker-credential-<name> binaries that should be found in PATH.
+type DockerConfigAuth struct {
+	Auths       map[string]docker.AuthConfiguration
+	CredsStore  string
+	CredHelpers map[string]string
+}
+
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth  string `json:"auth"`
+		Email string `json:"email"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// NewDockerConfigAuth reads $DOCKER_CONFIG/config.json and falls back to ~/.docker/config.json
+// if the former does not exist, e.g. when credentials are mounted at a custom path in CI.
+// If there is no config file at all, the returned resolver has no credentials.
+func NewDockerConfigAuth() (*DockerConfigAuth, error) {
+	paths, err := dockerConfigPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		auth, err := NewDockerConfigAuthFromFile(path)
+		if os.IsNotExist(err) {
+			log.Debugf("Docker config %s does not exist", path)
+			continue
+		}
+		return auth, err
+	}
+
+	return &DockerConfigAuth{}, nil
+}
+
+// dockerConfigPaths returns the docker config.json locations in the order of precedence
+func dockerConfigPaths() ([]string, error) {
+	paths := []string{}
+
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		expanded, err := homedir.Expand(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to expand DOCKER_CONFIG %s, error: %s", dir, err)
+		}
+		paths = append(paths, filepath.Join(expanded, "config.json"))
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(paths, filepath.Join(home, ".docker", "config.json")), nil
+}
+
+// NewDockerConfigAuthFromFile reads the given docker config.json
+func NewDockerConfigAuthFromFile(path string) (*DockerConfigAuth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := dockerConfigFile{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("Failed to parse docker config %s, error: %s", path, err)
+	}
+
+	auth := &DockerConfigAuth{
+		Auths:       map[string]docker.AuthConfiguration{},
+		CredsStore:  cfg.CredsStore,
+		CredHelpers: cfg.CredHelpers,
+	}
+
+	for registry, entry := range cfg.Auths {
+		// entries of registries kept in the credentials store have no auth
+		if entry.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode auth of registry %s in docker config %s, error: %s", registry, path, err)
+		}
+		userPass := strings.SplitN(string(decoded), ":", 2)
+		if len(userPass) != 2 {
+			return nil, fmt.Errorf("Invalid auth of registry %s in docker config %s", registry, path)
+		}
+		auth.Auths[registry] = docker.AuthConfiguration{
+			Username:      userPass[0],
+			Password:      userPass[1],
+			Email:         entry.Email,
+			ServerAddress: registry,
+		}
+	}
+
+	return auth, nil
+}
+
+// ResolveAuth implements AuthResolver
+func (a *DockerConfigAuth) ResolveAuth(image *imagename.ImageName) (docker.AuthConfiguration, error) {
+	registry := image.Registry
+	if IsDockerHub(image) {
+		registry = dockerHubAuthKey
+	}
+
+	helper := a.CredHelpers[registry]
+	if helper == "" {
+		helper = a.CredsStore
+	}
+
+	if helper != "" {
+		result, err := credHelperGet(helper, registry)
+		if err != nil || result.Username != "" {
+			return result, err
+		}
+	}
+
+	return staticAuthResolver{&docker.AuthConfigurations{Configs: a.Auths}}.ResolveAuth(image)
+}
+
+// credHelperGet asks docker-credential-<helper> for credentials of the registry
+func credHelperGet(helper, registry string) (result docker.AuthConfiguration, err error) {
+	var (
+		stdout bytes.Buffer
+		stderr bytes.Buffer
+	)
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(registry)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Debugf("Getting credentials of registry %s from docker-credential-%s", registry, helper)
+
+	if err := cmd.Run(); err != nil {
+		// helpers report missing credentials on stdout and exit with non-zero code
+		if strings.Contains(stdout.String(), credHelperNotFoundText) {
+			return result, nil
+		}
+		return result, fmt.Errorf("docker-credential-%s failed to get credentials of %s, error: %s %s",
+			helper, registry, err, strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+
+	creds := struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}{}
+
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return result, fmt.Errorf("Failed to parse the output of docker-credential-%s, error: %s", helper, err)
+	}
+
+	return docker.AuthConfiguration{
+		Username:      creds.Username,
+		Password:      creds.Secret,
+		ServerAddress: creds.ServerURL,
+	}, nil
+}
+
+// getAuthForImage resolves credentials for the image registry with the resolver if given,
+// falling back to the static auth configurations if the resolver has nothing.
+// It is called right before every request, so resolvers may hand out fresh tokens.
+func getAuthForImage(resolver AuthResolver, auth *docker.AuthConfigurations, image *imagename.ImageName) (docker.AuthConfiguration, error) {
+	if resolver != nil {
+		result, err := resolver.ResolveAuth(image)
+		if err != nil || result.Username != "" {
+			return result, err
+		}
+	}
+	return staticAuthResolver{auth}.ResolveAuth(image)
+}
+
+// WithEnvAuth returns the auth configurations with the credentials AuthFromEnv reads added,
+// the given ones take precedence for the same server. The environment is read once, so it
+// is meant to be called by the caller building the client, with its own prefix, e.g. "REGISTRY".
+// The auth is returned as is if the prefix is empty or there are no credentials in the environment.
+func WithEnvAuth(auth *docker.AuthConfigurations, prefix string) *docker.AuthConfigurations {
+	if prefix == "" {
+		return auth
+	}
+
+	envAuth := AuthFromEnv(prefix)
+	if len(envAuth.Configs) == 0 {
+		return auth
+	}
+
+	result := &docker.AuthConfigurations{Configs: envAuth.Configs}
+	if auth != nil {
+		for key, config := range auth.Configs {
+			result.Configs[key] = config
+		}
+	}
+	return result
+}
+
+// AuthFromEnv reads registry credentials from the environment, e.g. injected by CI, so no
+// docker config file has to be written. With the "REGISTRY" prefix these are:
+//
+//	REGISTRY_SERVER, REGISTRY_USER, REGISTRY_PASSWORD
+//	REGISTRY_<N>_SERVER, REGISTRY_<N>_USER, REGISTRY_<N>_PASSWORD
+//
+// where N is any number, to give credentials of several registries. The credentials are
+// sent only to the server they name, so the server is required; Docker Hub may be given as
+// docker.io or index.docker.io. Incomplete credentials, e.g. a REGISTRY_SERVER left by other
+// tooling, are skipped with a warning.
+func AuthFromEnv(prefix string) *docker.AuthConfigurations {
+	varRe := regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "_(?:([0-9]+)_)?(SERVER|USER|PASSWORD)=(.*)$")
+
+	// credentials by the number, the unnumbered ones go by ""
+	entries := map[string]map[string]string{}
+	for _, env := range os.Environ() {
+		match := varRe.FindStringSubmatch(env)
+		if match == nil {
+			continue
+		}
+		if entries[match[1]] == nil {
+			entries[match[1]] = map[string]string{}
+		}
+		entries[match[1]][match[2]] = match[3]
+	}
+
+	numbers := []string{}
+	for number := range entries {
+		numbers = append(numbers, number)
+	}
+	sort.Strings(numbers)
+
+	auth := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{}}
+	for _, number := range numbers {
+		entry := entries[number]
+
+		name := prefix + "_"
+		if number != "" {
+			name += number + "_"
+		}
+
+		server := entry["SERVER"]
+		if entry["USER"] == "" || entry["PASSWORD"] == "" || server == "" {
+			log.Warnf("Registry credentials %sSERVER, %sUSER and %sPASSWORD are not given together, ignoring them", name, name, name)
+			continue
+		}
+
+		key := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://"), "/")
+		if isHubRegistry(key) {
+			key = "index.docker.io"
+		}
+
+		auth.Configs[key] = docker.AuthConfiguration{
+			Username:      entry["USER"],
+			Password:      entry["PASSWORD"],
+			ServerAddress: server,
+		}
+	}
+
+	return auth
+}
+
+// ParseImageWithCredentials parses the image name that may carry credentials of its registry
+// inline, e.g. user:pass@registry.internal/app:1.0, which is handy for ad-hoc scripts. The
+// returned image has the credentials stripped, the returned auth is empty if there were none.
+// Special characters of the user and the password may be percent-encoded, e.g. %40 for "@".
+// Credentials in image names are insecure, they end up in logs and shell history.
+func ParseImageWithCredentials(name string) (*imagename.ImageName, docker.AuthConfiguration, error) {
+	stripped, auth, err := splitImageCredentials(name)
+	if err != nil {
+		return nil, auth, err
+	}
+	return imagename.NewFromString(stripped), auth, nil
+}
+
+// splitImageCredentials strips inline registry credentials off the image name,
+// see ParseImageWithCredentials
+func splitImageCredentials(name string) (string, docker.AuthConfiguration, error) {
+	auth := docker.AuthConfiguration{}
+
+	// the "@" of a digest, e.g. app@sha256:..., goes after the registry and the repository
+	slash := strings.Index(name, "/")
+	if slash < 0 {
+		return name, auth, nil
+	}
+	at := strings.LastIndex(name[:slash], "@")
+	if at < 0 {
+		return name, auth, nil
+	}
+	stripped := name[at+1:]
+
+	userPass := strings.SplitN(name[:at], ":", 2)
+	if len(userPass) != 2 || userPass[0] == "" {
+		return "", auth, fmt.Errorf("Invalid credentials of image %s, expected user:password@registry", stripped)
+	}
+
+	username, err := url.PathUnescape(userPass[0])
+	if err != nil {
+		return "", auth, fmt.Errorf("Failed to decode the user of image %s, error: %s", stripped, err)
+	}
+	password, err := url.PathUnescape(userPass[1])
+	if err != nil {
+		return "", auth, fmt.Errorf("Failed to decode the password of image %s, error: %s", stripped, err)
+	}
+
+	registry := imagename.NewFromString(stripped).Registry
+	if registry == "" {
+		return "", auth, fmt.Errorf("Credentials are given for image %s that has no registry", stripped)
+	}
+
+	log.Warnf("Credentials of registry %s are given inline in image %s, this is insecure and should not be used in committed manifests",
+		registry, stripped)
+
+	auth.Username = username
+	auth.Password = password
+	auth.ServerAddress = registry
+
+	return stripped, auth, nil
+}
@@ -0,0 +1,352 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+const testCredHelper = `#!/bin/sh
+read registry
+if [ "$registry" = "registry.example.com" ]; then
+  echo '{"ServerURL":"registry.example.com","Username":"helper","Secret":"s3cret"}'
+  exit 0
+fi
+echo "credentials not found in native keychain"
+exit 1
+`
+
+func TestDockerConfigAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(testCredHelper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config := `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "aHViOmh1YnBhc3M="},
+			"registry.example.com": {}
+		},
+		"credHelpers": {"registry.example.com": "test", "other.example.com": "test"}
+	}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver, err := NewDockerConfigAuthFromFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := resolver.ResolveAuth(imagename.NewFromString("registry.example.com/app:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "helper", auth.Username)
+	assert.Equal(t, "s3cret", auth.Password)
+
+	auth, err = resolver.ResolveAuth(imagename.NewFromString("alpine:3.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hub", auth.Username)
+	assert.Equal(t, "hubpass", auth.Password)
+
+	// the helper has no credentials, fall back to the static ones
+	static := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		"*": docker.AuthConfiguration{Username: "static"},
+	}}
+	auth, err = getAuthForImage(resolver, static, imagename.NewFromString("other.example.com/app:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "static", auth.Username)
+}
+
+func TestNewDockerConfigAuthMissing(t *testing.T) {
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer func(disable bool) { homedir.DisableCache = disable }(homedir.DisableCache)
+
+	homedir.DisableCache = true
+	os.Setenv("HOME", "/nonexistent/rocker-compose-test-home")
+	os.Setenv("DOCKER_CONFIG", "/nonexistent/rocker-compose-test")
+
+	resolver, err := NewDockerConfigAuth()
+	assert.Nil(t, err)
+
+	auth, err := resolver.ResolveAuth(imagename.NewFromString("alpine:3.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "", auth.Username)
+}
+
+func TestNewDockerConfigAuthFromEnv(t *testing.T) {
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer func(disable bool) { homedir.DisableCache = disable }(homedir.DisableCache)
+
+	dir, err := ioutil.TempDir("", "rocker-compose-test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(path, auth string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		config := fmt.Sprintf(`{"auths": {"https://index.docker.io/v1/": {"auth": "%s"}}}`, auth)
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// hub:hubpass in the home dir, ci:cipass in the custom dir
+	writeConfig(filepath.Join(dir, "home", ".docker", "config.json"), "aHViOmh1YnBhc3M=")
+	writeConfig(filepath.Join(dir, "custom", "config.json"), "Y2k6Y2lwYXNz")
+
+	homedir.DisableCache = true
+	os.Setenv("HOME", filepath.Join(dir, "home"))
+	os.Setenv("DOCKER_CONFIG", filepath.Join(dir, "custom"))
+
+	resolver, err := NewDockerConfigAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := resolver.ResolveAuth(imagename.NewFromString("alpine:3.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", auth.Username)
+	assert.Equal(t, "cipass", auth.Password)
+
+	// no config.json in DOCKER_CONFIG, fall back to the home one
+	os.Setenv("DOCKER_CONFIG", filepath.Join(dir, "empty"))
+
+	resolver, err = NewDockerConfigAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err = resolver.ResolveAuth(imagename.NewFromString("alpine:3.2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hub", auth.Username)
+}
+
+func TestAuthProviderCalledBeforeEveryPullAttempt(t *testing.T) {
+	var (
+		issued int
+		used   []string
+	)
+
+	provider := AuthProvider(func() (docker.AuthConfiguration, error) {
+		issued++
+		return docker.AuthConfiguration{Username: "sts", Password: fmt.Sprintf("token%d", issued)}, nil
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/create" {
+			fmt.Fprint(w, `{"Id":"abc"}`)
+			return
+		}
+
+		data, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := docker.AuthConfiguration{}
+		if err := json.Unmarshal(data, &auth); err != nil {
+			t.Fatal(err)
+		}
+		used = append(used, auth.Password)
+
+		// the first token has expired
+		if len(used) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := PullOptions{
+		AuthResolver: provider,
+		Retry:        RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("registry.example.com/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"token1", "token2"}, used)
+}
+
+func TestStaticAuthProvider(t *testing.T) {
+	auth, err := StaticAuthProvider(docker.AuthConfiguration{Username: "user"}).ResolveAuth(imagename.NewFromString("app:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "user", auth.Username)
+}
+
+func TestParseImageWithCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		image    string
+		username string
+		password string
+	}{
+		{"registry.internal/app:1.0", "registry.internal/app:1.0", "", ""},
+		{"app@sha256:0123456789abcdef", "app@sha256:0123456789abcdef", "", ""},
+		{"user:pass@registry.internal/app:1.0", "registry.internal/app:1.0", "user", "pass"},
+		{"user:pass@registry.internal:5000/team/app:~1.2", "registry.internal:5000/team/app:~1.2", "user", "pass"},
+		{"user:p%40ss:word@registry.internal/app@sha256:0123456789abcdef", "registry.internal/app@sha256:0123456789abcdef", "user", "p@ss:word"},
+		{"user:@registry.internal/app", "registry.internal/app:latest", "user", ""},
+	}
+
+	for _, test := range tests {
+		image, auth, err := ParseImageWithCredentials(test.name)
+		if err != nil {
+			t.Fatalf("Failed to parse %s, error: %s", test.name, err)
+		}
+		assert.Equal(t, test.image, image.String(), test.name)
+		assert.Equal(t, test.username, auth.Username, test.name)
+		assert.Equal(t, test.password, auth.Password, test.name)
+		if test.username != "" {
+			assert.Equal(t, image.Registry, auth.ServerAddress, test.name)
+		}
+	}
+
+	for _, name := range []string{
+		"user@registry.internal/app",
+		":pass@registry.internal/app",
+		"user:pass@library/app",
+		"user:%zz@registry.internal/app",
+	} {
+		_, _, err := ParseImageWithCredentials(name)
+		assert.NotNil(t, err, name)
+		assert.NotContains(t, fmt.Sprint(err), "pass@", name)
+	}
+}
+
+func TestAuthResolvers(t *testing.T) {
+	inline := NewStaticAuthResolver(&docker.AuthConfigurations{
+		Configs: map[string]docker.AuthConfiguration{
+			"registry.internal": {Username: "inline"},
+		},
+	})
+	resolver := AuthResolvers{inline, nil, StaticAuthProvider(docker.AuthConfiguration{Username: "default"})}
+
+	auth, err := resolver.ResolveAuth(imagename.NewFromString("registry.internal/app:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "inline", auth.Username)
+
+	auth, err = resolver.ResolveAuth(imagename.NewFromString("registry.example.com/app:1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "default", auth.Username)
+}
+
+func TestAuthFromEnv(t *testing.T) {
+	env := map[string]string{
+		"TEST_REGISTRY_USER":       "ci",
+		"TEST_REGISTRY_PASSWORD":   "secret",
+		"TEST_REGISTRY_1_SERVER":   "https://registry.internal/",
+		"TEST_REGISTRY_1_USER":     "deploy",
+		"TEST_REGISTRY_1_PASSWORD": "secret1",
+		"TEST_REGISTRY_2_SERVER":   "docker.io",
+		"TEST_REGISTRY_2_USER":     "hub",
+		"TEST_REGISTRY_2_PASSWORD": "secret2",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	// the unnumbered credentials name no server, they are not sent anywhere
+	auth := AuthFromEnv("TEST_REGISTRY")
+	assert.Len(t, auth.Configs, 2)
+	assert.Equal(t, "deploy", auth.Configs["registry.internal"].Username)
+	assert.Equal(t, "https://registry.internal/", auth.Configs["registry.internal"].ServerAddress)
+	assert.Equal(t, "hub", auth.Configs["index.docker.io"].Username)
+
+	static := &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		"registry.internal": {Username: "static"},
+	}}
+	merged := WithEnvAuth(static, "TEST_REGISTRY")
+
+	tests := map[string]string{
+		"registry.internal/app:1": "static",
+		"redis:3.2":               "hub",
+		"quay.io/org/app:1":       "",
+	}
+	for image, username := range tests {
+		result, err := getAuthForImage(nil, merged, imagename.NewFromString(image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, username, result.Username, image)
+	}
+
+	// the environment is not consulted per request
+	assert.Equal(t, "", mustAuthForImage(t, static, "redis:3.2").Username)
+	assert.Equal(t, static, WithEnvAuth(static, ""))
+}
+
+func mustAuthForImage(t *testing.T, auth *docker.AuthConfigurations, image string) docker.AuthConfiguration {
+	result, err := getAuthForImage(nil, auth, imagename.NewFromString(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestAuthFromEnvIncomplete(t *testing.T) {
+	env := map[string]string{
+		"TEST_REGISTRY_SERVER":     "registry.internal",
+		"TEST_REGISTRY_3_USER":     "deploy",
+		"TEST_REGISTRY_3_PASSWORD": "secret",
+		"TEST_REGISTRY_4_SERVER":   "quay.io",
+		"TEST_REGISTRY_4_USER":     "quay",
+		"TEST_REGISTRY_4_PASSWORD": "secret4",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	// incomplete entries are skipped, the rest is still used
+	auth := AuthFromEnv("TEST_REGISTRY")
+	assert.Equal(t, map[string]docker.AuthConfiguration{
+		"quay.io": {Username: "quay", Password: "secret4", ServerAddress: "quay.io"},
+	}, auth.Configs)
+
+	assert.Empty(t, AuthFromEnv("TEST_REGISTRY_NONE").Configs)
+	assert.Nil(t, WithEnvAuth(nil, "TEST_REGISTRY_NONE"))
+}
@@ -24,7 +24,6 @@ import (
 	"github.com/grammarly/rocker-compose/src/compose/config"
 	"github.com/grammarly/rocker-compose/src/util"
 
-	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/storage/s3"
 	"github.com/grammarly/rocker/src/template"
@@ -32,6 +31,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/fsouza/go-dockerclient"
+	"golang.org/x/net/context"
 )
 
 // Client interface describes a rocker-compose client that can do various operations
@@ -44,6 +44,7 @@ type Client interface {
 	EnsureContainerState(name *Container) error
 	PullAll(containers []*Container, vars template.Vars) error
 	Clean(config *config.Config) error
+	PruneDangling() error
 	AttachToContainers(container []*Container) error
 	AttachToContainer(container *Container) error
 	FetchImages(containers []*Container, vars template.Vars) error
@@ -61,9 +62,29 @@ type DockerClient struct {
 	Auth       *docker.AuthConfigurations
 	KeepImages int
 	Recover    bool
+	Registry   RegistryConfig
+	Resolve    ResolveOptions
+
+	PullOptions     PullOptions
+	PullConcurrency int
 
 	pulledImages  []*imagename.ImageName
 	removedImages []*imagename.ImageName
+
+	// resolved version ranges by the original image name, e.g. golang:1.4.*
+	resolveCache map[string]resolvedImage
+}
+
+// resolvedImage is a resolved version range along with the place its tag was found
+type resolvedImage struct {
+	image *imagename.ImageName
+	from  ResolvedFrom
+}
+
+// Close releases the docker connection of the client, see CloseDockerClient.
+// The client should not be used after it is closed.
+func (client *DockerClient) Close() error {
+	return CloseDockerClient(client.Docker)
 }
 
 // ErrContainerBadState is an error that describes state inconsistency
@@ -97,6 +118,11 @@ func NewClient(initialClient *DockerClient) (*DockerClient, error) {
 		Auth:       initialClient.Auth,
 		KeepImages: initialClient.KeepImages,
 		Recover:    initialClient.Recover,
+		Registry:   initialClient.Registry,
+		Resolve:    initialClient.Resolve,
+
+		PullOptions:     initialClient.PullOptions,
+		PullConcurrency: initialClient.PullConcurrency,
 	}
 	return client, nil
 }
@@ -303,6 +329,12 @@ func (client *DockerClient) PullAll(containers []*Container, vars template.Vars)
 	return client.pullImageForContainers(true, vars, containers...)
 }
 
+// PruneDangling removes untagged images that are not used by any container
+func (client *DockerClient) PruneDangling() error {
+	_, _, err := PruneDanglingImages(client.Docker)
+	return err
+}
+
 // Clean finds the obsolete image tags from container specs that exist in docker daemon,
 // skipping topN images that we want to keep (keep_images, default 5) and deletes them.
 func (client *DockerClient) Clean(config *config.Config) error {
@@ -337,7 +369,7 @@ func (client *DockerClient) Clean(config *config.Config) error {
 		for _, repoTag := range image.RepoTags {
 			imageName := imagename.NewFromString(repoTag)
 			for img := range images {
-				if img.IsSameKind(*imageName) {
+				if SameRepo(&img, imageName) {
 					images[img].Items = append(images[img].Items, &imagename.Tag{
 						ID:      image.ID,
 						Name:    *imageName,
@@ -606,17 +638,59 @@ func (client *DockerClient) flushContainerLogs(container *Container) {
 	}
 }
 
+// pullPolicy returns the policy of PullOptions if it is set, otherwise the images are
+// pulled always if the update is forced, e.g. by --pull, and only missing ones if not
+func (client *DockerClient) pullPolicy(forceUpdate bool) PullPolicy {
+	if client.PullOptions.Policy != "" {
+		return client.PullOptions.Policy
+	}
+	if forceUpdate {
+		return PullAlways
+	}
+	return PullIfNotPresent
+}
+
+// isFloatingTagMoved returns true if the local image of a floating tag, e.g. "latest", does not
+// have the digest the tag points to in the registry now. Images of immutable tags are never
+// checked; if the registry cannot tell the digest, the local image is considered up to date.
+func (client *DockerClient) isFloatingTagMoved(image *imagename.ImageName, img *docker.Image) bool {
+	if !IsFloating(image) || image.Storage == imagename.StorageS3 {
+		return false
+	}
+
+	remote, err := RegistryImageDigest(image, client.Auth, client.Registry)
+	if err != nil {
+		log.Warnf("Failed to verify image %s against the registry, using the local one, error: %s", image, err)
+		return false
+	}
+	if remote == "" {
+		log.Debugf("Registry does not tell the digest of image %s, using the local one", image)
+		return false
+	}
+
+	for _, digest := range imageRepoDigests(img, image) {
+		if digest == remote {
+			return false
+		}
+	}
+	return true
+}
+
 // pullImageForContainers goes through all containers and inspects their images
-// it pulls images if they cannot be found locally or forceUpdate flag is set to true
+// it pulls images according to the pull policy, see pullPolicy
+// missing images are pulled in parallel according to PullConcurrency
 func (client *DockerClient) pullImageForContainers(forceUpdate bool, vars template.Vars, containers ...*Container) (err error) {
+	policy := client.pullPolicy(forceUpdate)
 
-	if err := client.resolveVersions(true, forceUpdate, vars, containers); err != nil {
+	if err := client.resolveVersions(true, policy == PullAlways, vars, containers); err != nil {
 		return err
 	}
 
 	var (
-		img    *docker.Image
-		pulled = map[string]*docker.Image{}
+		img       *docker.Image
+		inspected = map[string]*docker.Image{}
+		toPull    = []*imagename.ImageName{}
+		waiting   = []*Container{}
 	)
 
 	// check images for each container
@@ -625,43 +699,371 @@ func (client *DockerClient) pullImageForContainers(forceUpdate bool, vars templa
 			err = fmt.Errorf("Cannot find image for container %s", container.Name)
 			return
 		}
-		// already pulled it for other container, skip
-		if img, ok := pulled[container.Image.String()]; ok {
-			container.ImageID = img.ID
+		name := container.Image.String()
+
+		// already inspected it for other container, skip
+		if img, ok := inspected[name]; ok {
+			if img == nil {
+				waiting = append(waiting, container)
+			} else {
+				container.ImageID = img.ID
+			}
 			continue
 		}
 
 		isSha := container.Image.TagIsSha()
 
-		if img, err = client.Docker.InspectImage(container.Image.String()); err == docker.ErrNoSuchImage || (forceUpdate && !isSha) {
+		img, err = client.Docker.InspectImage(name)
+		if isNoSuchImage(err) && policy == PullNever {
+			return fmt.Errorf("Image %s of container %s: %w", name, container.Name, ErrImageNotPresent)
+		}
+		if isNoSuchImage(err) || (policy == PullAlways && !isSha) {
 			log.Infof("Pulling image: %s for %s", container.Image, container.Name)
-			if img, err = PullDockerImage(client.Docker, container.Image, client.Auth); err != nil {
-				err = fmt.Errorf("Failed to pull image %s for container %s, error: %s", container.Image, container.Name, err)
-				return
-			}
-			client.pulledImages = append(client.pulledImages, container.Image)
+			inspected[name] = nil
+			toPull = append(toPull, container.Image)
+			waiting = append(waiting, container)
+			continue
 		}
 		if err != nil {
 			return
 		}
 
+		if policy == PullIfNotPresent && client.Resolve.VerifyFloatingTags && client.isFloatingTagMoved(container.Image, img) {
+			log.Infof("Image %s was moved in the registry, pulling it again for %s", container.Image, container.Name)
+			inspected[name] = nil
+			toPull = append(toPull, container.Image)
+			waiting = append(waiting, container)
+			continue
+		}
+
 		container.ImageID = img.ID
-		pulled[container.Image.String()] = img
+		inspected[name] = img
+		client.PullOptions.Recorder.record(container.requestedImage().String(), container.Image, imageRepoDigest(img, container.Image), ResolvedFromLocal)
+	}
+
+	if client.Resolve.Wildcard == WildcardAll && policy != PullNever {
+		all, err := client.wildcardTagsToPull(containers, inspected, policy)
+		if err != nil {
+			return err
+		}
+		toPull = append(toPull, all...)
+	}
+
+	if len(toPull) == 0 {
+		return nil
+	}
+
+	// it is decided already which images to pull
+	opts := client.PullOptions
+	opts.Policy = PullAlways
+	opts.Registry = client.Registry
+	opts.specs = map[string]string{}
+	for _, container := range waiting {
+		opts.specs[container.Image.String()] = container.requestedImage().String()
+	}
+
+	pulled, err := PullImages(context.Background(), client.Docker, toPull, client.Auth, opts, client.PullConcurrency)
+	for _, image := range toPull {
+		if image, ok := pulled[image.String()]; ok {
+			client.pulledImages = append(client.pulledImages, image)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, container := range waiting {
+		name := container.Image.String()
+		image := pulled[name]
+
+		if inspected[name] == nil {
+			if inspected[name], err = client.Docker.InspectImage(image.String()); err != nil {
+				return fmt.Errorf("Failed to inspect image %s after pull for container %s, error: %s", image, container.Name, err)
+			}
+		}
+
+		container.Image = image
+		container.ImageID = inspected[name].ID
 	}
 
 	return
 }
 
-// resolveVersions walks through the list of images and resolves their tags in case they are not strict
+// ResolveImageTag is the same as the ResolveImageTag function with the client's
+// auth, registry and resolve options
+func (client *DockerClient) ResolveImageTag(image *imagename.ImageName, force bool) (*imagename.ImageName, string, error) {
+	return ResolveImageTag(client.Docker, image, force, client.Auth, client.resolvePullOptions())
+}
+
+// resolvePullOptions returns PullOptions with the registry and resolve options of the client
+func (client *DockerClient) resolvePullOptions() PullOptions {
+	opts := client.PullOptions
+	opts.Registry = client.Registry
+	opts.Resolve = client.Resolve
+	return opts
+}
+
+// tags returns the resolver of version ranges of the client
+func (client *DockerClient) tags() tagResolver {
+	return newTagResolver(client.Docker, client.Auth, client.resolvePullOptions())
+}
+
+// ResolveImageTag resolves the version range of the image, e.g. app:~1.4, to the concrete
+// image without pulling anything, e.g. for a plan or a dry run. Local images are looked at
+// first, the remote tags are listed if there is no local match or force is set. It also
+// returns the content digest of the resolved image if the registry reports it, or an empty
+// string otherwise. Strict images are returned as is. The tags are matched according to
+// opts.Resolve and listed according to opts.Registry and opts.FallbackRegistries; the
+// results are cached according to opts.Resolve.Cache and recorded by opts.Recorder.
+func ResolveImageTag(client DockerAPI, image *imagename.ImageName, force bool, auth *docker.AuthConfigurations, opts PullOptions) (*imagename.ImageName, string, error) {
+	// forced lookups see the remote tags, they are cached apart from the local ones
+	cacheKey := fmt.Sprintf("%s#%t", image, force)
+	if cached, digest, ok := opts.Resolve.Cache.Get(cacheKey); ok {
+		log.Debugf("Resolve %s --> %s (cached)", image, cached.GetTag())
+		return cached, digest, nil
+	}
+
+	resolved, from, digest, err := newTagResolver(client, auth, opts).resolveImageTagAndDigest(image, force)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.Recorder.record(image.String(), resolved, digest, from)
+
+	opts.Resolve.Cache.Set(cacheKey, resolved, digest)
+	return resolved, digest, nil
+}
+
+// tagResolver finds the tags of version ranges among the local images and the remote tags,
+// it is shared by DockerClient and the ResolveImageTag function
+type tagResolver struct {
+	docker    DockerAPI
+	auth      *docker.AuthConfigurations
+	registry  RegistryConfig
+	resolve   ResolveOptions
+	fallbacks []string
+}
+
+// newTagResolver returns the resolver of the registry, resolve and fallback options of the pull
+func newTagResolver(client DockerAPI, auth *docker.AuthConfigurations, opts PullOptions) tagResolver {
+	return tagResolver{
+		docker:    client,
+		auth:      auth,
+		registry:  opts.Registry,
+		resolve:   opts.Resolve,
+		fallbacks: opts.FallbackRegistries,
+	}
+}
+
+// resolveImageTagAndDigest does the actual work of ResolveImageTag, it also tells
+// where the tag was found
+func (r tagResolver) resolveImageTagAndDigest(image *imagename.ImageName, force bool) (*imagename.ImageName, ResolvedFrom, string, error) {
+	var (
+		resolved = image
+		from     = ResolvedFromExact
+	)
+
+	if !image.IsStrict() {
+		all, err := r.docker.ListImages(docker.ListImagesOptions{})
+		if err != nil {
+			return nil, "", "", fmt.Errorf("Failed to list all images, error: %s", err)
+		}
+		if resolved, from, err = r.resolveImageTag(image, newLocalImageIndex(all).lookup(image), force); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	if resolved.TagIsDigest() {
+		return resolved, from, resolved.Tag, nil
+	}
+	if resolved.Storage == imagename.StorageS3 {
+		return resolved, from, "", nil
+	}
+
+	digest, err := RegistryImageDigest(resolved, r.auth, r.registry)
+	if err != nil {
+		log.Debugf("Failed to get the digest of image %s from the registry, error: %s", resolved, err)
+		return resolved, from, "", nil
+	}
+
+	return resolved, from, digest, nil
+}
+
+// wildcardTagsToPull returns the tags matching the wildcards of the containers, e.g. app:*,
+// besides the ones the containers run, see WildcardAll. Tags present locally are skipped
+// unless the policy is PullAlways.
+func (client *DockerClient) wildcardTagsToPull(containers []*Container, inspected map[string]*docker.Image, policy PullPolicy) ([]*imagename.ImageName, error) {
+	var (
+		result = []*imagename.ImageName{}
+		seen   = map[string]bool{}
+	)
+
+	for name := range inspected {
+		seen[name] = true
+	}
+
+	for _, container := range containers {
+		spec := container.ImageSpec
+		if spec == nil || !isWildcardTag(spec) || seen[spec.String()] {
+			continue
+		}
+		seen[spec.String()] = true
+
+		tags, err := client.ListSortedTags(spec, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, image := range tags {
+			name := image.String()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			if policy != PullAlways {
+				_, err := client.Docker.InspectImage(name)
+				if err == nil {
+					continue
+				}
+				if !isNoSuchImage(err) {
+					return nil, fmt.Errorf("Failed to inspect image %s, error: %s", name, err)
+				}
+			}
+
+			log.Infof("Pulling image: %s matching %s", image, spec)
+			result = append(result, image)
+		}
+	}
+
+	return result, nil
+}
+
+// ListSortedTags returns all tags of the image that satisfy its version range, newest first,
+// e.g. to offer them in a UI. Local images are looked at first, the remote tags are listed
+// if there is no local match or force is set, the same way ResolveImageTag does.
+// See sortTags for the order.
+func (client *DockerClient) ListSortedTags(image *imagename.ImageName, force bool) ([]*imagename.ImageName, error) {
+	all, err := client.Docker.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+	return client.tags().listSortedTags(image, newLocalImageIndex(all).lookup(image), force)
+}
+
+// listSortedTags does the actual work of ListSortedTags over the given local images
+func (r tagResolver) listSortedTags(image *imagename.ImageName, local []*imagename.ImageName, hub bool) ([]*imagename.ImageName, error) {
+	tags := matchingTags(image, local, r.resolve)
+
+	if hub || len(tags) == 0 {
+		remote, err := r.listRemoteTags(image)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list tags of image %s from the remote registry, error: %w", image, err)
+		}
+		tags = matchingTags(image, append(append([]*imagename.ImageName{}, local...), remote...), r.resolve)
+
+		images := tags[:0]
+		for _, tag := range tags {
+			if containsImage(local, tag) || !r.isRemoteArtifact(tag) {
+				images = append(images, tag)
+			}
+		}
+		tags = images
+	}
+
+	sortTags(tags, r.resolve)
+	return tags, nil
+}
+
+// resolveImageTag finds the most recent tag of the image among the local images and,
+// if there is no local match or hub is set, among the remote tags as well. It also tells
+// whether the found tag is present locally or only in the registry.
+func (r tagResolver) resolveImageTag(image *imagename.ImageName, local []*imagename.ImageName, hub bool) (*imagename.ImageName, ResolvedFrom, error) {
+	// looking locally first
+	candidate := findMostRecentTag(image, local, nil, true, r.resolve)
+
+	// in case we want to include external images as well, pulling list of available
+	// images from repository or central docker hub
+	if hub || candidate == nil {
+		log.Debugf("Getting list of tags for %s from the registry", image)
+
+		remote, err := r.listRemoteTags(image)
+		if err != nil {
+			return nil, "", fmt.Errorf("Failed to list tags of image %s from the remote registry, error: %w", image, err)
+		}
+
+		log.Debugf("remote: %v", remote)
+
+		// Re-Resolve having hub tags
+		candidate = findMostRecentTag(image, local, remote, false, r.resolve)
+
+		// the repository may keep OCI artifacts next to the images, those can't be run
+		for candidate != nil && !containsImage(local, candidate) && r.isRemoteArtifact(candidate) {
+			remote = withoutImage(remote, candidate)
+			candidate = findMostRecentTag(image, local, remote, false, r.resolve)
+		}
+	}
+
+	if candidate == nil {
+		return nil, "", fmt.Errorf("Image not found: %s", image)
+	}
+	candidate.IsOldS3Name = image.IsOldS3Name
+
+	from := ResolvedFromRegistry
+	if containsImage(local, candidate) {
+		from = ResolvedFromLocal
+	}
+
+	return candidate, from, nil
+}
+
+// isRemoteArtifact tells whether the remote tag is an OCI artifact rather than an image,
+// see RegistryIsImage. It is always false with ResolveOptions.IncludeArtifacts and for S3
+// images; tags whose manifest can't be fetched, e.g. listed from a fallback registry,
+// are taken as images and left for the pull to fail.
+func (r tagResolver) isRemoteArtifact(image *imagename.ImageName) bool {
+	if r.resolve.IncludeArtifacts || image.Storage == imagename.StorageS3 {
+		return false
+	}
+
+	isImage, err := RegistryIsImage(image, r.auth, r.registry)
+	if err != nil {
+		log.Debugf("Failed to get the manifest of %s, taking it as an image, error: %s", image, err)
+		return false
+	}
+	if !isImage {
+		log.Infof("Skipping %s, it is an OCI artifact rather than an image", image)
+	}
+
+	return !isImage
+}
+
+// listRemoteTags lists tags of the image in S3 or in the registry, trying the fallback registries
+func (r tagResolver) listRemoteTags(image *imagename.ImageName) ([]*imagename.ImageName, error) {
+	if image.Storage == imagename.StorageS3 {
+		dockerClient, ok := untracedDockerAPI(r.docker).(*docker.Client)
+		if !ok {
+			return nil, fmt.Errorf("Failed to list tags of image %s, S3 storage needs the real docker client", image)
+		}
+		s3storage := s3.New(dockerClient, os.TempDir())
+		return s3storage.ListTags(image.String())
+	}
+	return RegistryListTagsWithFallback(image, r.auth, r.registry, r.fallbacks)
+}
+
+// resolveVersions walks through the list of images and resolves their tags in case they are not strict.
+// Resolved images are cached for the lifetime of the client unless hub is given, which means
+// the registry should be consulted again.
 func (client *DockerClient) resolveVersions(local, hub bool, vars template.Vars, containers []*Container) (err error) {
+	if client.resolveCache == nil || hub {
+		client.resolveCache = map[string]resolvedImage{}
+	}
 
-	// Provide function getter of all images to fetch only once
-	var available []*imagename.ImageName
-	getImages := func() ([]*imagename.ImageName, error) {
+	// Provide function getter of the local images index to fetch only once
+	var available *localImageIndex
+	getImages := func() (*localImageIndex, error) {
 		if available == nil {
-			available = []*imagename.ImageName{}
-
 			if !local {
+				available = newLocalImageIndex(nil)
 				return available, nil
 			}
 
@@ -671,17 +1073,11 @@ func (client *DockerClient) resolveVersions(local, hub bool, vars template.Vars,
 				return nil, err
 			}
 
-			for _, image := range dockerImages {
-				for _, repoTag := range image.RepoTags {
-					available = append(available, imagename.NewFromString(repoTag))
-				}
-			}
+			available = newLocalImageIndex(dockerImages)
 		}
 		return available, nil
 	}
 
-	resolved := map[string]*imagename.ImageName{}
-
 	// check images for each container
 	for _, container := range containers {
 		// error in configuration, fail fast
@@ -705,59 +1101,51 @@ func (client *DockerClient) resolveVersions(local, hub bool, vars template.Vars,
 
 		// Do not resolve anything if the image is strict, e.g. "redis:2.8.11" or "redis:latest"
 		if container.Image.IsStrict() {
+			if container.ImageResolvedFrom == "" {
+				container.ImageResolvedFrom = ResolvedFromExact
+			}
 			continue
 		}
 
+		// remember what was asked for, e.g. to show "~1.2 → 1.2.7"
+		if container.ImageSpec == nil {
+			spec := *container.Image
+			container.ImageSpec = &spec
+		}
+
 		// already resolved it for other container
-		if _, ok := resolved[container.Image.String()]; ok {
-			container.Image = resolved[container.Image.String()]
+		name := container.Image.String()
+		if resolved, ok := client.resolveCache[name]; ok {
+			log.Debugf("Resolve %s --> %s (cached)", container.Image, resolved.image.GetTag())
+			container.Image = resolved.image
+			container.ImageResolvedFrom = resolved.from
 			continue
 		}
 
-		// Override to not change the common images slice
-		var images []*imagename.ImageName
-		if images, err = getImages(); err != nil {
+		var index *localImageIndex
+		if index, err = getImages(); err != nil {
 			return err
 		}
-
-		// looking locally first
-		candidate := container.Image.ResolveVersion(images, true)
-
-		// in case we want to include external images as well, pulling list of available
-		// images from repository or central docker hub
-		if hub || candidate == nil {
-			log.Debugf("Getting list of tags for %s from the registry", container.Image)
-
-			var remote []*imagename.ImageName
-
-			if container.Image.Storage == imagename.StorageS3 {
-				s3storage := s3.New(client.Docker, os.TempDir())
-				remote, err = s3storage.ListTags(container.Image.String())
-			} else {
-				remote, err = dockerclient.RegistryListTags(container.Image, client.Auth)
-			}
-
-			if err != nil {
-				return fmt.Errorf("Failed to list tags of image %s for container %s from the remote registry, error: %s",
-					container.Image, container.Name, err)
-			}
-
-			log.Debugf("remote: %v", remote)
-
-			// Re-Resolve having hub tags
-			candidate = container.Image.ResolveVersion(append(images, remote...), false)
-		}
-
-		if candidate == nil {
-			err = fmt.Errorf("Image not found: %s", container.Image)
-			return
+		images := index.lookup(container.Image)
+
+		var (
+			candidate *imagename.ImageName
+			from      ResolvedFrom
+		)
+		if candidate, from, err = client.tags().resolveImageTag(container.Image, images, hub); err != nil {
+			// keep the error matchable by errors.Is, e.g. against ErrRepositoryNotFound
+			return fmt.Errorf("Container %s: %w", container.Name, err)
 		}
-		candidate.IsOldS3Name = container.Image.IsOldS3Name
 
-		log.Infof("Resolve %s --> %s", container.Image, candidate.GetTag())
+		log.Infof("Resolve %s --> %s (%s)", container.Image, candidate.GetTag(), from)
 
 		container.Image = candidate
-		resolved[container.Image.String()] = candidate
+		container.ImageResolvedFrom = from
+		client.resolveCache[name] = resolvedImage{candidate, from}
+	}
+
+	if client.Resolve.StrictPinning {
+		return checkPinned(containers)
 	}
 
 	return
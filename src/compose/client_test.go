@@ -17,8 +17,11 @@
 package compose
 
 import (
+	"errors"
 	"fmt"
 	"github.com/grammarly/rocker-compose/src/compose/config"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -241,3 +244,454 @@ func TestClientResolveVersions(t *testing.T) {
 
 	pretty.Println(containers)
 }
+
+func TestClientResolveVersionsCached(t *testing.T) {
+	listed := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listed++
+		fmt.Fprint(w, `[{"Id":"a","RepoTags":["golang:1.4.1","golang:1.4.2"]}]`)
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &DockerClient{Docker: dockerCli}
+
+	newContainers := func() []*Container {
+		return []*Container{
+			&Container{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString("golang:1.4.*")},
+			&Container{Name: config.NewContainerName("test", "b"), Image: imagename.NewFromString("golang:1.4.*")},
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		containers := newContainers()
+		if err := client.resolveVersions(true, false, template.Vars{}, containers); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "golang:1.4.2", containers[0].Image.String())
+		assert.Equal(t, "golang:1.4.2", containers[1].Image.String())
+		assert.Equal(t, "golang:1.4.*", containers[1].ImageSpec.String())
+		assert.Equal(t, "1.4.* → 1.4.2", containers[1].ImageResolution())
+		assert.Equal(t, ResolvedFromLocal, containers[1].ImageResolvedFrom)
+	}
+
+	assert.Equal(t, 1, listed, "Expected images to be listed only once")
+}
+
+func TestClientResolveImageTag(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/tags/list":
+			fmt.Fprint(w, `{"name":"app","tags":["1.4.0","1.4.2","1.5.0"]}`)
+		case "/v2/app/manifests/1.4.0", "/v2/app/manifests/1.4.2":
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.docker.distribution.manifest.v2+json")
+			w.Header().Set("Docker-Content-Digest", "sha256:"+strings.Repeat(r.URL.Path[len(r.URL.Path)-1:], 64))
+			fmt.Fprint(w, `{"schemaVersion":2}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/json" {
+			t.Fatalf("Unexpected request %s %s, nothing should be pulled", r.Method, r.URL.Path)
+		}
+		fmt.Fprintf(w, `[{"Id":"a","RepoTags":["%s/app:1.4.0"]}]`, host)
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &DockerClient{
+		Docker:   dockerCli,
+		Auth:     &docker.AuthConfigurations{},
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+	}
+
+	// the local image satisfies the range
+	image, digest, err := client.ResolveImageTag(imagename.NewFromString(host+"/app:~1.4"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.4.0", image.String())
+	assert.Equal(t, "sha256:"+strings.Repeat("0", 64), digest)
+
+	image, digest, err = client.ResolveImageTag(imagename.NewFromString(host+"/app:~1.4"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.4.2", image.String())
+	assert.Equal(t, "sha256:"+strings.Repeat("2", 64), digest)
+
+	// the digest is optional
+	image, digest, err = client.ResolveImageTag(imagename.NewFromString(host+"/app:1.5.0"), false)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.5.0", image.String())
+	assert.Equal(t, "", digest)
+}
+
+func TestClientResolveImageTagCached(t *testing.T) {
+	listed := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/tags/list":
+			listed++
+			fmt.Fprint(w, `{"name":"app","tags":["1.4.0","1.4.2"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &DockerClient{
+		Docker:   dockerCli,
+		Auth:     &docker.AuthConfigurations{},
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+		Resolve:  ResolveOptions{Cache: NewResolveCache(time.Minute)},
+	}
+
+	for i := 0; i < 3; i++ {
+		image, _, err := client.ResolveImageTag(imagename.NewFromString(host+"/app:~1.4"), true)
+		assert.Nil(t, err)
+		assert.Equal(t, host+"/app:1.4.2", image.String())
+	}
+	assert.Equal(t, 1, listed, "registry should be queried once")
+
+	client.Resolve.Cache.Clear()
+	_, _, err = client.ResolveImageTag(imagename.NewFromString(host+"/app:~1.4"), true)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, listed, "registry should be queried again after Clear")
+}
+
+func TestClientResolveImageTagFrom(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.3.0","1.4.0","1.4.2"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	client := &DockerClient{
+		Auth:     &docker.AuthConfigurations{},
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+	}
+
+	local := []*imagename.ImageName{imagename.NewFromString(host + "/app:1.4.0")}
+
+	tests := []struct {
+		image    string
+		hub      bool
+		expected string
+		from     ResolvedFrom
+	}{
+		{host + "/app:~1.4", false, host + "/app:1.4.0", ResolvedFromLocal},
+		{host + "/app:~1.4", true, host + "/app:1.4.2", ResolvedFromRegistry},
+		{host + "/app:~1.3", false, host + "/app:1.3.0", ResolvedFromRegistry},
+	}
+
+	for _, test := range tests {
+		image, from, err := client.tags().resolveImageTag(imagename.NewFromString(test.image), local, test.hub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.expected, image.String(), "image %s, hub %t", test.image, test.hub)
+		assert.Equal(t, test.from, from, "image %s, hub %t", test.image, test.hub)
+	}
+
+	// strict images are not resolved at all
+	containers := []*Container{
+		&Container{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString("redis:2.8.11")},
+	}
+	if err := client.resolveVersions(true, false, template.Vars{}, containers); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ResolvedFromExact, containers[0].ImageResolvedFrom)
+}
+
+func TestClientResolveImageTagSkipsArtifacts(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/tags/list":
+			fmt.Fprint(w, `{"name":"app","tags":["1.4.0","1.4.1","1.4.2"]}`)
+		case "/v2/app/manifests/1.4.2":
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json"}}`)
+		case "/v2/app/manifests/1.4.1":
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	client := &DockerClient{
+		Auth:     &docker.AuthConfigurations{},
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+	}
+
+	image, from, err := client.tags().resolveImageTag(imagename.NewFromString(host+"/app:~1.4"), nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.4.1", image.String())
+	assert.Equal(t, ResolvedFromRegistry, from)
+
+	tags, err := client.tags().listSortedTags(imagename.NewFromString(host+"/app:~1.4"), nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []*imagename.ImageName{
+		imagename.NewFromString(host + "/app:1.4.1"),
+		imagename.NewFromString(host + "/app:1.4.0"),
+	}, tags)
+
+	// a local tag is never checked
+	local := []*imagename.ImageName{imagename.NewFromString(host + "/app:1.4.2")}
+	image, from, err = client.tags().resolveImageTag(imagename.NewFromString(host+"/app:~1.4"), local, true)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.4.2", image.String())
+	assert.Equal(t, ResolvedFromLocal, from)
+
+	client.Resolve.IncludeArtifacts = true
+	image, _, err = client.tags().resolveImageTag(imagename.NewFromString(host+"/app:~1.4"), nil, true)
+	assert.Nil(t, err)
+	assert.Equal(t, host+"/app:1.4.2", image.String())
+}
+
+func TestClientListSortedTags(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.3.0","1.4.0","1.4.2","1.5.0-rc1","latest"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	client := &DockerClient{
+		Auth:     &docker.AuthConfigurations{},
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+	}
+
+	local := []*imagename.ImageName{imagename.NewFromString(host + "/app:1.4.0")}
+
+	tests := []struct {
+		image    string
+		hub      bool
+		expected []string
+	}{
+		{host + "/app:~1.4", false, []string{"1.4.0"}},
+		{host + "/app:~1.4", true, []string{"1.4.2", "1.4.0"}},
+		{host + "/app:~1.3", false, []string{"1.3.0"}},
+		{host + "/app", true, []string{"latest", "1.5.0-rc1", "1.4.2", "1.4.0", "1.3.0"}},
+	}
+
+	for _, test := range tests {
+		images, err := client.tags().listSortedTags(imagename.NewFromString(test.image), local, test.hub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags := []string{}
+		for _, image := range images {
+			tags = append(tags, image.GetTag())
+		}
+		assert.Equal(t, test.expected, tags, "image %s, hub %t", test.image, test.hub)
+	}
+}
+
+func TestClientPullPolicy(t *testing.T) {
+	assert.Equal(t, PullAlways, (&DockerClient{}).pullPolicy(true))
+	assert.Equal(t, PullIfNotPresent, (&DockerClient{}).pullPolicy(false))
+	assert.Equal(t, PullNever, (&DockerClient{PullOptions: PullOptions{Policy: PullNever}}).pullPolicy(true))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			t.Fatalf("Unexpected pull with the Never pull policy")
+		}
+		http.Error(w, "no such image", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &DockerClient{
+		Docker:      dockerCli,
+		PullOptions: PullOptions{Policy: PullNever},
+	}
+	containers := []*Container{
+		&Container{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString("redis:2.8.11")},
+	}
+
+	err = client.PullAll(containers, template.Vars{})
+	assert.True(t, errors.Is(err, ErrImageNotPresent), "unexpected error %v", err)
+}
+
+func TestClientVerifyFloatingTags(t *testing.T) {
+	remoteDigest := "sha256:" + strings.Repeat("b", 64)
+
+	manifests := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v2/app/manifests/") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		manifests++
+		w.Header().Set("Docker-Content-Digest", remoteDigest)
+		fmt.Fprint(w, `{"schemaVersion":2}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	var (
+		pulls       int
+		localDigest string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			pulls++
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+			return
+		}
+		fmt.Fprintf(w, `{"Id":"abc","RepoDigests":["%s/app@%s"]}`, host, localDigest)
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image       string
+		verify      bool
+		localDigest string
+		manifests   int
+		pulls       int
+	}{
+		{"/app:latest", true, "sha256:" + strings.Repeat("a", 64), 1, 1},
+		{"/app:latest", true, remoteDigest, 1, 0},
+		{"/app:stable", true, "sha256:" + strings.Repeat("a", 64), 1, 1},
+		{"/app:latest", false, "sha256:" + strings.Repeat("a", 64), 0, 0},
+		{"/app:1.2.3", true, "sha256:" + strings.Repeat("a", 64), 0, 0},
+	}
+
+	for _, test := range tests {
+		pulls, manifests, localDigest = 0, 0, test.localDigest
+
+		client := &DockerClient{
+			Docker:   dockerCli,
+			Auth:     &docker.AuthConfigurations{},
+			Registry: RegistryConfig{InsecureRegistries: []string{host}},
+			Resolve:  ResolveOptions{VerifyFloatingTags: test.verify},
+		}
+		containers := []*Container{
+			&Container{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString(host + test.image)},
+		}
+
+		if err := client.FetchImages(containers, template.Vars{}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.manifests, manifests, "%s verify %t", test.image, test.verify)
+		assert.Equal(t, test.pulls, pulls, "%s verify %t", test.image, test.verify)
+	}
+}
+
+func TestClientPullWildcard(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.0.0","1.1.0","1.2.0"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	var (
+		pulled []string
+		local  map[string]bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images/json":
+			fmt.Fprint(w, `[]`)
+		case r.URL.Path == "/images/create":
+			name := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+			pulled = append(pulled, name)
+			local[name] = true
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+		case local[strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")]:
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		default:
+			http.Error(w, "no such image", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		wildcard WildcardPolicy
+		image    string
+		pulled   []string
+	}{
+		{WildcardNewest, "/app:*", []string{"/app:1.2.0"}},
+		{WildcardAll, "/app:*", []string{"/app:1.2.0", "/app:1.1.0"}},
+		{WildcardAll, "/app:~1", []string{"/app:1.2.0"}},
+	}
+
+	for _, test := range tests {
+		pulled, local = nil, map[string]bool{host + "/app:1.0.0": true}
+
+		client := &DockerClient{
+			Docker:   dockerCli,
+			Auth:     &docker.AuthConfigurations{},
+			Registry: RegistryConfig{InsecureRegistries: []string{host}},
+			Resolve:  ResolveOptions{Wildcard: test.wildcard},
+		}
+		containers := []*Container{
+			&Container{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString(host + test.image)},
+		}
+
+		if err := client.FetchImages(containers, template.Vars{}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{}
+		for _, name := range test.pulled {
+			expected = append(expected, host+name)
+		}
+		assert.Equal(t, expected, pulled, "%s %s", test.wildcard, test.image)
+		assert.Equal(t, host+"/app:1.2.0", containers[0].Image.String(), "%s %s", test.wildcard, test.image)
+	}
+}
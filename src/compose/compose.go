@@ -47,6 +47,14 @@ type Config struct {
 	Wait       time.Duration
 	Auth       *docker.AuthConfigurations
 	KeepImages int
+	Registry   RegistryConfig
+	Resolve    ResolveOptions
+
+	PullOptions     PullOptions
+	PullConcurrency int
+
+	// AuthResolver is passed to both Registry and PullOptions unless they have their own
+	AuthResolver AuthResolver
 }
 
 // Compose is the main object that executes actions and holds runtime information.
@@ -82,6 +90,18 @@ func New(config *Config) (*Compose, error) {
 		Auth:       config.Auth,
 		KeepImages: config.KeepImages,
 		Recover:    config.Recover,
+		Registry:   config.Registry,
+		Resolve:    config.Resolve,
+
+		PullOptions:     config.PullOptions,
+		PullConcurrency: config.PullConcurrency,
+	}
+
+	if cliConf.Registry.AuthResolver == nil {
+		cliConf.Registry.AuthResolver = config.AuthResolver
+	}
+	if cliConf.PullOptions.AuthResolver == nil {
+		cliConf.PullOptions.AuthResolver = config.AuthResolver
 	}
 
 	cli, err := NewClient(cliConf)
@@ -110,6 +130,12 @@ func (compose *Compose) RunAction() error {
 		expected = GetContainersFromConfig(compose.Manifest)
 	}
 
+	// remember version ranges to check if they resolve to older versions than running ones
+	ranges := map[*Container]bool{}
+	for _, c := range expected {
+		ranges[c] = c.Image != nil && !c.Image.IsStrict()
+	}
+
 	// if --pull is specified PullAll, otherwise Fetch required
 	if compose.Pull {
 		if err := compose.client.PullAll(expected, compose.Manifest.Vars); err != nil {
@@ -124,6 +150,11 @@ func (compose *Compose) RunAction() error {
 		for _, expectedC := range expected {
 			if expectedC.IsSameKind(actualC) {
 				expectedC.ID = actualC.ID
+
+				if ranges[expectedC] && isDowngrade(actualC.Image, expectedC.Image) {
+					log.Warnf("Container %s is going to be downgraded from %s to %s, the newer tag may have been removed from the registry",
+						expectedC.Name, actualC.Image.GetTag(), expectedC.Image.GetTag())
+				}
 			}
 		}
 	}
@@ -242,6 +273,15 @@ func (compose *Compose) CleanAction() error {
 	return nil
 }
 
+// PruneDanglingAction removes untagged images left by pulls, it is a part of 'rocker-compose run --prune-dangling'
+func (compose *Compose) PruneDanglingAction() error {
+	if err := compose.client.PruneDangling(); err != nil {
+		return fmt.Errorf("Failed to prune dangling images, error: %s", err)
+	}
+
+	return nil
+}
+
 // PinAction implements 'rocker-compose pin'
 func (compose *Compose) PinAction(local, hub bool) (template.Vars, error) {
 	containers := GetContainersFromConfig(compose.Manifest)
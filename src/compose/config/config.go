@@ -363,6 +363,10 @@ func ReadConfig(configName string, reader io.Reader, vars template.Vars, funcs m
 			return nil, fmt.Errorf("Image should be specified for container: %s", name)
 		}
 
+		if err := ValidateImageName(*container.Image); err != nil {
+			return nil, fmt.Errorf("Container %s: %s", name, err)
+		}
+
 		img := imagename.NewFromString(*container.Image)
 
 		if !img.IsStrict() && !img.HasVersionRange() && !img.All() {
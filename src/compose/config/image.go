@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+var (
+	// hostname with optional port, e.g. registry.example.com:5000
+	imageHostRe = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$`)
+
+	// path component of the repository, e.g. my-app or my_app.v2
+	imagePathRe = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+
+	// strict tag, also allows glob wildcards that are resolved over the registry tags
+	imageTagRe = regexp.MustCompile(`^[\w*?\[\]][\w.*?\[\]-]{0,127}$`)
+
+	imageDigestRe = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+)
+
+// ValidateImageName checks the image reference against the docker reference grammar:
+// the registry host, the repository path segments and the tag or digest. Besides of strict
+// tags it accepts version ranges, e.g. app:~1.4.0, that are resolved by rocker-compose.
+// It catches malformed names such as "foo::" or "foo//bar" that imagename.NewFromString
+// parses silently and that would only fail at pull time.
+func ValidateImageName(ref string) error {
+	invalid := func(reason string, args ...interface{}) error {
+		return fmt.Errorf("Invalid image reference '%s': %s", ref, fmt.Sprintf(reason, args...))
+	}
+
+	name := ref
+	if name == "" {
+		return invalid("empty reference")
+	}
+
+	// s3 images are named after the bucket, which is the host part
+	isS3 := false
+	for _, prefix := range []string{"s3.amazonaws.com/", "s3:"} {
+		if strings.HasPrefix(name, prefix) {
+			name = strings.TrimPrefix(name, prefix)
+			isS3 = true
+			break
+		}
+	}
+
+	var tag, digest string
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+		if !imageDigestRe.MatchString(digest) {
+			return invalid("invalid digest '%s'", digest)
+		}
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+		if tag == "" {
+			return invalid("empty tag")
+		}
+		if !imageTagRe.MatchString(tag) && !imagename.New("image", tag).HasVersionRange() {
+			return invalid("invalid tag '%s'", tag)
+		}
+	}
+
+	parts := strings.Split(name, "/")
+
+	// the same heuristic as imagename uses to tell the registry from the repository
+	if isS3 || (len(parts) > 1 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost")) {
+		if !imageHostRe.MatchString(parts[0]) {
+			return invalid("invalid registry host '%s'", parts[0])
+		}
+		parts = parts[1:]
+	}
+
+	if len(parts) == 0 {
+		return invalid("repository name is missing")
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			return invalid("empty repository path segment")
+		}
+		if !imagePathRe.MatchString(part) {
+			return invalid("invalid repository path segment '%s', it should be lowercase letters, digits and separators", part)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateImageNameValid(t *testing.T) {
+	for _, ref := range []string{
+		"redis",
+		"redis:3.0",
+		"grammarly/scratch:latest",
+		"busybox:buildroot-2013.08.1",
+		"quay.io/myapp:1.2.3",
+		"localhost:5000/team/my_app:v1",
+		"registry.example.com/app@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11",
+		"app:~1.4.0",
+		"app:1.*",
+		"app:2024*",
+		"s3.amazonaws.com/bucket/app:1.0",
+		"s3:bucket/app:1.0",
+	} {
+		assert.Nil(t, ValidateImageName(ref), ref)
+	}
+}
+
+func TestValidateImageNameInvalid(t *testing.T) {
+	tests := map[string]string{
+		"":                        "empty reference",
+		"foo::":                   "empty tag",
+		"foo:":                    "empty tag",
+		"foo//bar:1":              "empty repository path segment",
+		"registry.example.com/:1": "empty repository path segment",
+		"MyApp:1":                 "invalid repository path segment 'MyApp'",
+		"app:1.0!":                "invalid tag '1.0!'",
+		"app@sha256:xyz":          "invalid digest 'sha256:xyz'",
+		"-bad.example.com/app:1":  "invalid registry host '-bad.example.com'",
+	}
+
+	for ref, reason := range tests {
+		err := ValidateImageName(ref)
+		if assert.Error(t, err, ref) {
+			assert.Contains(t, err.Error(), "': "+reason, ref)
+			assert.Contains(t, err.Error(), "Invalid image reference '"+ref+"'")
+		}
+	}
+}
+
+func TestConfigInvalidImage(t *testing.T) {
+	_, err := ReadConfig("test", strings.NewReader("namespace: test\ncontainers:\n  main:\n    image: \"foo::\"\n"), template.Vars{}, map[string]interface{}{}, false)
+	if assert.Error(t, err) {
+		assert.Equal(t, "Container main: Invalid image reference 'foo::': empty tag", err.Error())
+	}
+}
@@ -17,6 +17,7 @@
 package compose
 
 import (
+	"fmt"
 	"github.com/grammarly/rocker-compose/src/compose/config"
 	"github.com/grammarly/rocker-compose/src/util"
 	"strings"
@@ -41,6 +42,14 @@ type Container struct {
 	Config        *config.Container
 	Io            *ContainerIo
 
+	// ImageSpec is the image as requested by the manifest, e.g. app:~1.2, it is kept
+	// when Image is replaced by the resolved version; nil if the image was not resolved
+	ImageSpec *imagename.ImageName
+
+	// ImageResolvedFrom tells whether the tag of Image was taken from a local image or from
+	// the registry, it is empty if the image was not resolved yet
+	ImageResolvedFrom ResolvedFrom
+
 	container *docker.Container
 }
 
@@ -122,6 +131,27 @@ func (a Container) String() string {
 	return a.Name.String()
 }
 
+// ImageResolution returns the tag of the image along with the requested one if the image
+// was resolved from a version range, e.g. "~1.2 → 1.2.7", or just the tag otherwise
+func (a *Container) ImageResolution() string {
+	if a.Image == nil {
+		return ""
+	}
+	if a.ImageSpec == nil || a.ImageSpec.GetTag() == a.Image.GetTag() {
+		return a.Image.GetTag()
+	}
+	return fmt.Sprintf("%s → %s", a.ImageSpec.GetTag(), a.Image.GetTag())
+}
+
+// requestedImage returns the image as requested by the manifest, e.g. app:~1.2,
+// it is Image itself if the image was not resolved
+func (a *Container) requestedImage() *imagename.ImageName {
+	if a.ImageSpec != nil {
+		return a.ImageSpec
+	}
+	return a.Image
+}
+
 // IsSameNamespace returns true if current and given containers are from same namespace
 func (a *Container) IsSameNamespace(b *Container) bool {
 	return a.Name.IsEqualNs(b.Name)
@@ -153,7 +183,7 @@ func (a *Container) IsEqualTo(b *Container) bool {
 	}
 
 	// check image version
-	if a.Image != nil && !a.Image.Contains(b.Image) {
+	if a.Image != nil && !ImageContains(a.Image, b.Image) {
 		log.Debugf("Comparing '%s' and '%s': image version '%s' is not satisfied (was %s should satisfy %s)",
 			a.Name.String(),
 			b.Name.String(),
@@ -474,6 +474,11 @@ func (m *clientMock) Clean(cfg *config.Config) error {
 	return args.Error(0)
 }
 
+func (m *clientMock) PruneDangling() error {
+	args := m.Called()
+	return args.Error(0)
+}
+
 func (m *clientMock) AttachToContainer(container *Container) error {
 	args := m.Called(container)
 	return args.Error(0)
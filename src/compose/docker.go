@@ -17,20 +17,133 @@
 package compose
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/term"
 	"github.com/fsouza/go-dockerclient"
-	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/storage/s3"
+	"golang.org/x/net/context"
 )
 
-const emptyImageName = "gliderlabs/alpine:3.2"
+const (
+	defaultBridgeNetwork = "bridge"
+	bridgeImageEnv       = "ROCKER_COMPOSE_BRIDGE_IMAGE"
+	pullDigestPrefix     = "Digest: "
+	bridgeContainerLabel = "rocker-compose-bridge-ip"
+
+	// BridgeIPPlaceholder is returned by GetBridgeIP instead of the real address in dry-run mode
+	BridgeIPPlaceholder = "0.0.0.0"
+)
+
+// DockerAPI is the part of the docker client used by the functions of this file, so they
+// can be tested with a fake one; *docker.Client is the real implementation
+type DockerAPI interface {
+	Endpoint() string
+
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	InspectContainer(id string) (*docker.Container, error)
+	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
+	StartContainer(id string, hostConfig *docker.HostConfig) error
+	StopContainer(id string, timeout uint) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	InspectImage(name string) (*docker.Image, error)
+	PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error
+	TagImage(name string, opts docker.TagImageOptions) error
+	RemoveImage(name string) error
+
+	NetworkInfo(id string) (*docker.Network, error)
+}
+
+var _ DockerAPI = (*docker.Client)(nil)
+
+// BridgeImageName is the image of the dummy container that GetBridgeIP runs to obtain
+// the bridge address; ROCKER_COMPOSE_BRIDGE_IMAGE environment variable takes precedence
+// over it, which is handy for air-gapped environments with internal mirrors
+var BridgeImageName = "gliderlabs/alpine:3.2"
+
+// BridgeImageAlternatives are images used for the dummy container instead of BridgeImageName
+// if they are present locally, so hosts that have some alpine image do not pull another one.
+// Names without a tag match any tag of the repository. BridgeImageName is pulled only if
+// none of them is present.
+var BridgeImageAlternatives = []string{"gliderlabs/alpine", "alpine"}
+
+// BridgeImageAuth are the credentials to pull the image of the dummy container, e.g. when it
+// lives in an authenticated mirror; the image is pulled without credentials if nil
+var BridgeImageAuth *docker.AuthConfigurations
+
+// BridgeImagePullDisabled forbids GetBridgeIP to pull the image of the dummy container, e.g. in
+// air-gapped environments where implicit pulls are not allowed; the dummy container is run only
+// if one of the images is present locally and ErrBridgeImagePullDisabled is returned otherwise
+var BridgeImagePullDisabled = false
+
+// ErrBridgeImagePullDisabled is matched by errors.Is if the dummy container cannot be run because
+// its image is not present and BridgeImagePullDisabled is set
+var ErrBridgeImagePullDisabled = errors.New("dummy image not present and pulling disabled")
+
+// BridgeContainerMaxAge is the age after which a dummy network container is considered orphaned
+var BridgeContainerMaxAge = 5 * time.Minute
+
+// BridgeContainerTimeout limits every stage of the dummy container lifecycle in GetBridgeIP:
+// the create, start and gateway lookup together, and the cleanup and the removal of each
+// orphaned container separately
+var BridgeContainerTimeout = 30 * time.Second
+
+// BridgeGatewayTimeout is how long GetBridgeIP waits for the dummy container to get the gateway
+var BridgeGatewayTimeout = 5 * time.Second
+
+// bridgeGatewayPollInterval is the pause between inspections of the dummy container
+var bridgeGatewayPollInterval = 100 * time.Millisecond
+
+// BridgeGatewayCommand, if given, is run instead of inspecting the network and the dummy
+// container, e.g. []string{"sh", "-c", "ip route | awk '/default/ {print $3}'"}, for
+// environments where the gateway docker reports is unreliable, such as custom CNI plugins.
+// The first word of its stdout is the gateway ip. The command runs on the host of
+// rocker-compose with ROCKER_COMPOSE_NETWORK set to the name of the network, it is limited
+// by BridgeContainerTimeout.
+var BridgeGatewayCommand []string
+
+// BridgeIPDryRun makes GetBridgeIP return BridgeIPPlaceholder without touching the docker
+// daemon, so dry runs have no side effects such as the dummy container
+var BridgeIPDryRun = false
+
+// bridgeIPCache keeps the gateway addresses per docker endpoint and network; mu guards
+// only the maps, a lookup runs without it and concurrent callers of the same key wait
+// for the one in flight. lookups is read-locked while a lookup runs.
+var bridgeIPCache = struct {
+	ips      map[string]string
+	inflight map[string]*bridgeIPLookup
+	mu       sync.Mutex
+	lookups  sync.RWMutex
+}{
+	ips:      map[string]string{},
+	inflight: map[string]*bridgeIPLookup{},
+}
+
+// bridgeIPLookup is a gateway lookup in flight, done is closed once ip and err are set
+type bridgeIPLookup struct {
+	done chan struct{}
+	ip   string
+	err  error
+}
 
 // GetBridgeIP gets the ip address of docker network bridge
 // it is useful when you want to loose couple containers and not have tightly link them
@@ -38,7 +151,9 @@ const emptyImageName = "gliderlabs/alpine:3.2"
 // a bridge ip address; it's a hacky solution, any better way to obtain bridge ip without ssh access
 // to host machine is welcome
 //
-// Here we create a dummy container and look at .NetworkSettings.Gateway value
+// Here we inspect the "bridge" network and take the gateway of its IPAM config.
+// If the daemon does not report it, we create a dummy container and look at
+// .NetworkSettings.Gateway value. BridgeGatewayCommand replaces both if it is set.
 //
 // TODO: maybe we don't need this anymore since docker 1.8 seem to specify all existing containers
 // 			 in a /etc/hosts file of every contianer. Need to research it further.
@@ -46,107 +161,2302 @@ const emptyImageName = "gliderlabs/alpine:3.2"
 // https://github.com/docker/docker/issues/1143
 // https://github.com/docker/docker/issues/11247
 //
-func GetBridgeIP(client *docker.Client) (ip string, err error) {
-	// Ensure empty image existing
-	_, err = client.InspectImage(emptyImageName)
-	if err != nil && err.Error() == "no such image" {
-		log.Infof("Pulling image %s to obtain network bridge address", emptyImageName)
-		if _, err := PullDockerImage(client, imagename.NewFromString(emptyImageName), nil); err != nil {
-			return "", err
+// The result is cached per docker endpoint for the lifetime of the process,
+// use ResetBridgeIPCache to drop it.
+//
+func GetBridgeIP(client DockerAPI) (ip string, err error) {
+	return GetNetworkGatewayIP(client, defaultBridgeNetwork)
+}
+
+// GetNetworkGatewayIP is the same as GetBridgeIP but for the given docker network, which is
+// useful on hosts with several bridge networks. If the gateway cannot be obtained from the
+// network inspect, the dummy container is attached to that network (NetworkMode) so its
+// gateway reflects the network rather than the default bridge.
+func GetNetworkGatewayIP(client DockerAPI, network string) (ip string, err error) {
+	return GetNetworkGatewayIPWithContainer(client, network, "")
+}
+
+// GetNetworkGatewayIPWithContainer is the same as GetNetworkGatewayIP but reads the gateway
+// of the given running container, e.g. a managed one, instead of creating the dummy container.
+// The dummy container is still used if the container is not given, not running or not attached
+// to the network, so there is no image pull and container churn in the common case.
+func GetNetworkGatewayIPWithContainer(client DockerAPI, network, containerID string) (ip string, err error) {
+	if BridgeIPDryRun {
+		log.Infof("[DRY] Would obtain gateway ip of network %s, using %s instead", network, BridgeIPPlaceholder)
+		return BridgeIPPlaceholder, nil
+	}
+
+	key := client.Endpoint() + "#" + network
+
+	bridgeIPCache.mu.Lock()
+	if ip, ok := bridgeIPCache.ips[key]; ok {
+		bridgeIPCache.mu.Unlock()
+		return ip, nil
+	}
+	if lookup, ok := bridgeIPCache.inflight[key]; ok {
+		bridgeIPCache.mu.Unlock()
+		<-lookup.done
+		return lookup.ip, lookup.err
+	}
+	lookup := &bridgeIPLookup{done: make(chan struct{})}
+	bridgeIPCache.inflight[key] = lookup
+	bridgeIPCache.mu.Unlock()
+
+	bridgeIPCache.lookups.RLock()
+	lookup.ip, lookup.err = lookupNetworkGateway(client, network, containerID)
+	bridgeIPCache.lookups.RUnlock()
+
+	bridgeIPCache.mu.Lock()
+	if lookup.err == nil {
+		bridgeIPCache.ips[key] = lookup.ip
+	}
+	delete(bridgeIPCache.inflight, key)
+	bridgeIPCache.mu.Unlock()
+	close(lookup.done)
+
+	return lookup.ip, lookup.err
+}
+
+// lookupNetworkGateway obtains the gateway address of the network bypassing the cache
+func lookupNetworkGateway(client DockerAPI, network, containerID string) (ip string, err error) {
+	if len(BridgeGatewayCommand) > 0 {
+		return commandNetworkGateway(network)
+	}
+
+	if ip, err = inspectNetworkGateway(client, network); err != nil || ip == "" {
+		log.Debugf("Cannot get gateway of network %s from the network inspect, falling back to a container; error: %v", network, err)
+		if containerID != "" {
+			if ip, err = containerNetworkGateway(client, containerID, network); err != nil || ip == "" {
+				log.Debugf("Cannot get gateway of network %s from container %.12s, falling back to dummy container; error: %v", network, containerID, err)
+			}
+		}
+		if ip == "" {
+			if ip, err = getBridgeIP(client, network); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return ip, nil
+}
+
+// ResetBridgeIPCache forgets bridge ip addresses obtained by GetBridgeIP
+func ResetBridgeIPCache() {
+	bridgeIPCache.mu.Lock()
+	defer bridgeIPCache.mu.Unlock()
+	bridgeIPCache.ips = map[string]string{}
+}
+
+// bridgeImageName returns the dummy container image respecting the env override
+func bridgeImageName() string {
+	if name := os.Getenv(bridgeImageEnv); name != "" {
+		return name
+	}
+	return BridgeImageName
+}
+
+// inspectNetworkGateway reads the gateway address of the network IPAM config
+func inspectNetworkGateway(client DockerAPI, network string) (string, error) {
+	info, err := client.NetworkInfo(network)
+	if err != nil {
+		return "", err
+	}
+	for _, config := range info.IPAM.Config {
+		if config.Gateway != "" {
+			// some daemons report the gateway in CIDR notation
+			return strings.SplitN(config.Gateway, "/", 2)[0], nil
+		}
+	}
+	return "", nil
+}
+
+// ensureBridgeImage returns the image for the dummy container: the preferred one if it is
+// present, otherwise the first of BridgeImageAlternatives present locally. If there is none,
+// the preferred image is pulled unless BridgeImagePullDisabled is set.
+func ensureBridgeImage(client DockerAPI) (string, error) {
+	preferred := bridgeImageName()
+
+	_, err := client.InspectImage(preferred)
+	if err == nil {
+		return preferred, nil
+	}
+	if !isNoSuchImage(err) {
+		return "", fmt.Errorf("Failed to inspect image %s, error: %s", preferred, err)
+	}
+
+	if len(BridgeImageAlternatives) > 0 {
+		all, err := client.ListImages(docker.ListImagesOptions{})
+		if err != nil {
+			return "", fmt.Errorf("Failed to list all images, error: %s", err)
+		}
+
+		index := newLocalImageIndex(all)
+		for _, alternative := range BridgeImageAlternatives {
+			image := imagename.NewFromString(alternative)
+			for _, local := range index.lookup(image) {
+				if !image.HasTag() || image.Tag == local.Tag {
+					log.Debugf("Using image %s present locally to obtain network bridge address", local)
+					return local.String(), nil
+				}
+			}
 		}
-	} else if err != nil {
-		return "", fmt.Errorf("Failed to inspect image %s, error: %s", emptyImageName, err)
 	}
 
-	container, err := client.CreateContainer(docker.CreateContainerOptions{
+	if BridgeImagePullDisabled {
+		return "", fmt.Errorf("Failed to obtain network bridge address, image %s: %w", preferred, ErrBridgeImagePullDisabled)
+	}
+
+	log.Infof("Pulling image %s to obtain network bridge address", preferred)
+	if _, err := PullDockerImage(client, imagename.NewFromString(preferred), BridgeImageAuth); err != nil {
+		return "", err
+	}
+
+	return preferred, nil
+}
+
+// isNoSuchImage returns true if the error tells the image does not exist. Besides of
+// docker.ErrNoSuchImage it recognizes 404 responses and the "No such image: name" messages
+// of daemons and client versions that phrase it differently.
+func isNoSuchImage(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, docker.ErrNoSuchImage) {
+		return true
+	}
+	var apiErr *docker.Error
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "no such image")
+}
+
+// containerNetworkGateway reads the gateway of the network from the running container,
+// it returns an empty string if the container is not running or not attached to the network
+func containerNetworkGateway(client DockerAPI, id, network string) (string, error) {
+	inspect, err := client.InspectContainer(id)
+	if err != nil {
+		return "", err
+	}
+	if !inspect.State.Running || inspect.NetworkSettings == nil {
+		return "", nil
+	}
+
+	if settings, ok := inspect.NetworkSettings.Networks[network]; ok {
+		return settings.Gateway, nil
+	}
+
+	// older daemons do not report networks, only the default bridge is known then
+	if network == defaultBridgeNetwork && len(inspect.NetworkSettings.Networks) == 0 {
+		return inspect.NetworkSettings.Gateway, nil
+	}
+
+	return "", nil
+}
+
+// commandNetworkGateway runs BridgeGatewayCommand and parses the gateway ip from its stdout
+func commandNetworkGateway(network string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), BridgeContainerTimeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, BridgeGatewayCommand[0], BridgeGatewayCommand[1:]...)
+	cmd.Env = append(os.Environ(), "ROCKER_COMPOSE_NETWORK="+network)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("Timeout running gateway command %q: %w", strings.Join(BridgeGatewayCommand, " "), ctx.Err())
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to run gateway command %q, error: %s %s", strings.Join(BridgeGatewayCommand, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || net.ParseIP(fields[0]) == nil {
+		return "", fmt.Errorf("Gateway command %q printed %q, expected the gateway ip of network %s",
+			strings.Join(BridgeGatewayCommand, " "), strings.TrimSpace(string(out)), network)
+	}
+
+	log.Debugf("Got gateway %s of network %s from the gateway command", fields[0], network)
+	return fields[0], nil
+}
+
+// getBridgeIP does the actual gateway ip lookup through the dummy container attached to the network
+func getBridgeIP(client DockerAPI, network string) (ip string, err error) {
+	emptyImageName, err := ensureBridgeImage(client)
+	if err != nil {
+		return "", err
+	}
+
+	// a wedged daemon should not block the whole run, the client is shared by all the
+	// calls of the lookup including the cleanup
+	bounded, err := boundedDockerClient(client, BridgeContainerTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	// dummy containers may be left by a previous run that crashed before the cleanup
+	if _, err := removeOrphanedBridgeContainers(bounded, BridgeContainerMaxAge); err != nil {
+		log.Warnf("Failed to remove orphaned dummy network containers, error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BridgeContainerTimeout)
+	defer cancel()
+
+	container, err := bounded.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
-			Image: emptyImageName,
-			Cmd:   []string{"/bin/sh", "-c", "while true; do sleep 1; done"},
+			Image:  emptyImageName,
+			Cmd:    []string{"sleep", "3600"},
+			Labels: map[string]string{bridgeContainerLabel: "true"},
+		},
+		HostConfig: &docker.HostConfig{
+			NetworkMode: network,
 		},
-		HostConfig: &docker.HostConfig{},
+		Context: ctx,
 	})
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("Timeout creating dummy network container: %w", ctx.Err())
+	}
 	if err != nil {
 		return "", fmt.Errorf("Failed to create dummy network container, error: %s", err)
 	}
 	defer func() {
-		removeOpts := docker.RemoveContainerOptions{
-			ID:            container.ID,
-			Force:         true,
-			RemoveVolumes: true,
-		}
-		if err2 := client.RemoveContainer(removeOpts); err2 != nil && err == nil {
+		// the cleanup has its own deadline, the one of the lookup may be exceeded already
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), BridgeContainerTimeout)
+		defer cancel()
+
+		if err2 := removeBridgeContainer(cleanupCtx, bounded, container.ID); err2 != nil && err == nil {
 			err = err2
 		}
 	}()
 
-	if err := client.StartContainer(container.ID, &docker.HostConfig{}); err != nil {
+	if err := callWithContext(ctx, func() error { return bounded.StartContainer(container.ID, nil) }); err != nil {
+		if err == ctx.Err() {
+			return "", fmt.Errorf("Timeout starting dummy network container %.12s: %w", container.ID, err)
+		}
 		return "", fmt.Errorf("Failed to start dummy network container %.12s, error: %s", container.ID, err)
 	}
 
-	inspect, err := client.InspectContainer(container.ID)
-	if err != nil {
-		return "", fmt.Errorf("Failed to inspect dummy network container %.12s, error: %s", container.ID, err)
-	}
+	return waitBridgeGateway(ctx, bounded, container.ID, network)
+}
 
-	return inspect.NetworkSettings.Gateway, nil
+// callWithContext makes the call of a client made by boundedDockerClient that does not accept
+// a context, such as StartContainer. The request itself is aborted by the timeout of the client
+// rather than left running, so the daemon does not act on it long after ctx is done.
+func callWithContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := call()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
-// PullDockerImage pulls an image and streams to a logger respecting terminal features
-func PullDockerImage(client *docker.Client, image *imagename.ImageName, auth *docker.AuthConfigurations) (*docker.Image, error) {
-	if image.Storage == imagename.StorageS3 {
-		s3storage := s3.New(client, os.TempDir())
-		if err := s3storage.Pull(image.String()); err != nil {
+// boundedDockerClient returns a client of the same daemon whose HTTP requests time out after
+// the given timeout. The timeout is set on a client of its own, the one of the given client
+// is shared with concurrent calls, so it is made once and reused by the calls that need it.
+// Clients other than *docker.Client are returned as is.
+func boundedDockerClient(client DockerAPI, timeout time.Duration) (DockerAPI, error) {
+	c, ok := untracedDockerAPI(client).(*docker.Client)
+	if !ok {
+		return client, nil
+	}
+
+	var bounded *docker.Client
+	if strings.HasPrefix(c.Endpoint(), "unix://") {
+		// the http client of the unix socket is not exported, a new one is made
+		// with the API version the given client was created with
+		var err error
+		if bounded, err = docker.NewVersionedClient(c.Endpoint(), dockerAPIVersion(c)); err != nil {
 			return nil, err
 		}
+		bounded.SkipServerVersionCheck = c.SkipServerVersionCheck
+		bounded.Dialer = c.Dialer
 	} else {
-		pipeReader, pipeWriter := io.Pipe()
-
-		pullOpts := docker.PullImageOptions{
-			Repository:    image.NameWithRegistry(),
-			Registry:      image.Registry,
-			Tag:           image.Tag,
-			OutputStream:  pipeWriter,
-			RawJSONStream: true,
+		// the copy keeps the endpoint scheme, the API version and the TLS transport
+		copied := *c
+		bounded = &copied
+		if c.HTTPClient != nil {
+			bounded.HTTPClient = &http.Client{Transport: c.HTTPClient.Transport}
 		}
+	}
+	bounded.SetTimeout(timeout)
+
+	return traceDockerAPI(bounded), nil
+}
+
+// waitBridgeGateway polls the started dummy container until its gateway is known: on slow
+// hosts the network settings may be empty for a moment after the start. It gives up after
+// BridgeGatewayTimeout, when the context is done or as soon as the container exits.
+// The client is the bounded one of the lookup, see boundedDockerClient.
+func waitBridgeGateway(ctx context.Context, client DockerAPI, id, network string) (string, error) {
+	deadline := time.Now().Add(BridgeGatewayTimeout)
 
-		repoAuth, err := dockerclient.GetAuthForRegistry(auth, image)
+	for {
+		var inspect *docker.Container
+		err := callWithContext(ctx, func() (err error) {
+			inspect, err = client.InspectContainer(id)
+			return err
+		})
+		if err != nil && err == ctx.Err() {
+			return "", fmt.Errorf("Timeout inspecting dummy network container %.12s: %w", id, err)
+		}
 		if err != nil {
-			return nil, fmt.Errorf("Failed to authenticate registry %s, error: %s", image.Registry, err)
+			return "", fmt.Errorf("Failed to inspect dummy network container %.12s, error: %s", id, err)
+		}
+
+		if settings := inspect.NetworkSettings; settings != nil {
+			// newer daemons report the gateway per network
+			if endpoint, ok := settings.Networks[network]; ok && endpoint.Gateway != "" {
+				return endpoint.Gateway, nil
+			}
+			if settings.Gateway != "" {
+				return settings.Gateway, nil
+			}
 		}
 
-		errch := make(chan error, 1)
+		if !inspect.State.Running && !inspect.State.FinishedAt.IsZero() {
+			return "", fmt.Errorf("Dummy network container %.12s exited with code %d before the gateway of network %s is known",
+				id, inspect.State.ExitCode, network)
+		}
 
-		go func() {
-			err := client.PullImage(pullOpts, repoAuth)
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("Gateway of network %s is still empty in dummy network container %.12s after %s",
+				network, id, BridgeGatewayTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("Timeout waiting for the gateway of dummy network container %.12s: %w", id, ctx.Err())
+		case <-time.After(bridgeGatewayPollInterval):
+		}
+	}
+}
+
+// ListManagedImages returns images present in docker that match any of the given image names,
+// e.g. the images of the manifest containers. Version ranges such as 1.2.* match every tag
+// they contain, the same way they are resolved.
+func ListManagedImages(client DockerAPI, images []*imagename.ImageName) ([]docker.APIImages, error) {
+	all, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	result := []docker.APIImages{}
 
-			if err := pipeWriter.Close(); err != nil {
-				log.Errorf("Failed to close pull image stream for %s, error: %s", image, err)
+	for _, image := range all {
+		if imageMatchesAny(image, images) {
+			result = append(result, image)
+		}
+	}
+
+	return result, nil
+}
+
+// imageMatchesAny returns true if any tag of the image is contained by any of the names
+func imageMatchesAny(image docker.APIImages, images []*imagename.ImageName) bool {
+	for _, repoTag := range image.RepoTags {
+		name := imagename.NewFromString(repoTag)
+		for _, img := range images {
+			if ImageContains(img, name) {
+				return true
 			}
+		}
+	}
+	return false
+}
 
-			errch <- err
-		}()
+// FindLocalImages reports for every given image whether it is already present in docker,
+// listing the images only once instead of inspecting them one by one. Version ranges such
+// as 1.2.* are present if any local tag is contained by them. The result is keyed by the
+// original image reference, e.g. to tell "3 images to pull, 5 already present".
+func FindLocalImages(client DockerAPI, images []*imagename.ImageName) (map[string]bool, error) {
+	all, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	local := map[string]struct{}{}
+	for _, image := range all {
+		for _, ref := range image.RepoTags {
+			local[ref] = struct{}{}
+		}
+		for _, ref := range image.RepoDigests {
+			local[ref] = struct{}{}
+		}
+	}
 
-		def := log.StandardLogger()
-		fd, isTerminal := term.GetFdInfo(def.Out)
-		out := def.Out
+	var (
+		result = make(map[string]bool, len(images))
+		index  *localImageIndex
+	)
 
-		if !isTerminal {
-			out = def.Writer()
+	for _, image := range images {
+		ref := image.String()
+		if _, ok := local[ref]; ok {
+			result[ref] = true
+			continue
+		}
+		result[ref] = false
+		if image.IsStrict() {
+			continue
 		}
+		if index == nil {
+			index = newLocalImageIndex(all)
+		}
+		for _, name := range index.lookup(image) {
+			if ImageContains(image, name) {
+				result[ref] = true
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// localImageIndex groups tags of the local images by repository, so looking up the tags
+// of an image does not scan and parse the tags of every other repository. Image names
+// are built only for the repositories that are looked up, and only once.
+type localImageIndex struct {
+	tags  map[string][]string
+	names map[string][]*imagename.ImageName
+}
 
-		if err := jsonmessage.DisplayJSONMessagesStream(pipeReader, out, fd, isTerminal); err != nil {
-			return nil, fmt.Errorf("Failed to process json stream for image: %s, error: %s", image, err)
+// newLocalImageIndex indexes RepoTags of the images listed by docker
+func newLocalImageIndex(images []docker.APIImages) *localImageIndex {
+	index := &localImageIndex{
+		tags:  map[string][]string{},
+		names: map[string][]*imagename.ImageName{},
+	}
+
+	// many tags share the repository, parse every repository name once
+	keys := map[string]string{}
+
+	for _, image := range images {
+		for _, repoTag := range image.RepoTags {
+			repo, tag := imagename.ParseRepositoryTag(repoTag)
+			if repo == "<none>" {
+				continue
+			}
+			key, ok := keys[repo]
+			if !ok {
+				key = localImageKey(imagename.New(repo, ""))
+				keys[repo] = key
+			}
+			index.tags[key] = append(index.tags[key], repo+":"+tag)
 		}
+	}
+
+	return index
+}
 
-		if err := <-errch; err != nil {
-			return nil, fmt.Errorf("Failed to pull image %s, error: %s", image, err)
+// lookup returns the local images of the same repository as the given one
+func (index *localImageIndex) lookup(image *imagename.ImageName) []*imagename.ImageName {
+	key := localImageKey(image)
+	if names, ok := index.names[key]; ok {
+		return names
+	}
+
+	names := make([]*imagename.ImageName, 0, len(index.tags[key]))
+	for _, repoTag := range index.tags[key] {
+		names = append(names, imagename.NewFromString(repoTag))
+	}
+	index.names[key] = names
+
+	return names
+}
+
+// localImageKey identifies the repository the same way as SameRepo, so e.g. redis
+// and docker.io/library/redis share the key
+func localImageKey(image *imagename.ImageName) string {
+	registry, name := normalizeRepo(image)
+	return registry + "/" + name
+}
+
+// InspectImages looks up many images at once: docker is asked for the list of images once
+// and InspectImage is called only for the found images that need the details, according to
+// detailed (nil means none). For the others the result is filled from the listing, which has
+// the ID, repository tags and digests, size and labels. It returns the results by the image
+// references; missing images are nil rather than an error, so one missing image does not
+// fail the whole batch.
+func InspectImages(client DockerAPI, images []*imagename.ImageName, detailed func(image *imagename.ImageName) bool) (map[string]*docker.Image, error) {
+	all, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	listed := map[string]*docker.APIImages{}
+	for i, image := range all {
+		for _, repoTag := range image.RepoTags {
+			repo, tag := imagename.ParseRepositoryTag(repoTag)
+			if repo != "<none>" {
+				listed[imageReferenceKey(imagename.New(repo, tag))] = &all[i]
+			}
+		}
+		for _, repoDigest := range image.RepoDigests {
+			if at := strings.LastIndex(repoDigest, "@"); at >= 0 {
+				listed[imageReferenceKey(imagename.New(repoDigest[:at], repoDigest[at+1:]))] = &all[i]
+			}
 		}
 	}
 
-	img, err := client.InspectImage(image.String())
+	result := map[string]*docker.Image{}
+	for _, image := range images {
+		name := image.String()
+		if _, ok := result[name]; ok {
+			continue
+		}
+
+		found, ok := listed[imageReferenceKey(image)]
+		if !ok {
+			result[name] = nil
+			continue
+		}
+
+		if detailed == nil || !detailed(image) {
+			result[name] = listedImage(found)
+			continue
+		}
+
+		img, err := client.InspectImage(name)
+		if isNoSuchImage(err) {
+			// removed since it was listed
+			result[name] = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to inspect image %s, error: %s", name, err)
+		}
+		result[name] = img
+	}
+
+	return result, nil
+}
+
+// imageReferenceKey identifies the tag or the digest of the repository, Docker Hub
+// aliases share the key, see localImageKey
+func imageReferenceKey(image *imagename.ImageName) string {
+	if image.TagIsDigest() {
+		return localImageKey(image) + "@" + image.GetTag()
+	}
+	return localImageKey(image) + ":" + image.GetTag()
+}
+
+// listedImage converts the image listed by docker to the inspected one, the details that
+// are not listed, e.g. Config, are left empty
+func listedImage(image *docker.APIImages) *docker.Image {
+	return &docker.Image{
+		ID:          image.ID,
+		RepoTags:    image.RepoTags,
+		RepoDigests: image.RepoDigests,
+		Parent:      image.ParentID,
+		Created:     time.Unix(image.Created, 0),
+		Size:        image.Size,
+		VirtualSize: image.VirtualSize,
+		Config:      &docker.Config{Labels: image.Labels},
+	}
+}
+
+// removeBridgeContainer stops the dummy container gracefully before removing it,
+// so the daemon does not have to SIGKILL it. The client is a bounded one, see boundedDockerClient.
+func removeBridgeContainer(ctx context.Context, client DockerAPI, id string) error {
+	if err := callWithContext(ctx, func() error { return client.StopContainer(id, 1) }); err != nil {
+		if _, ok := err.(*docker.ContainerNotRunning); !ok {
+			log.Debugf("Failed to stop dummy network container %.12s, error: %s", id, err)
+		}
+	}
+	err := client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:            id,
+		Force:         true,
+		RemoveVolumes: true,
+		Context:       ctx,
+	})
+	if ctx.Err() != nil {
+		return fmt.Errorf("Timeout removing dummy network container %.12s: %w", id, ctx.Err())
+	}
+	return err
+}
+
+// RemoveOrphanedBridgeContainers removes dummy network containers older than maxAge, they are
+// left if rocker-compose was killed before the cleanup. Younger ones may belong to a concurrent
+// run and are kept. It returns the number of removed containers.
+func RemoveOrphanedBridgeContainers(client DockerAPI, maxAge time.Duration) (int, error) {
+	bounded, err := boundedDockerClient(client, BridgeContainerTimeout)
+	if err != nil {
+		return 0, err
+	}
+	return removeOrphanedBridgeContainers(bounded, maxAge)
+}
+
+// removeOrphanedBridgeContainers does the actual work of RemoveOrphanedBridgeContainers
+// with a bounded client, see boundedDockerClient
+func removeOrphanedBridgeContainers(client DockerAPI, maxAge time.Duration) (int, error) {
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		All:     true,
+		Filters: map[string][]string{"label": []string{bridgeContainerLabel}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list dummy network containers, error: %s", err)
+	}
+
+	removed := 0
+	for _, c := range containers {
+		if time.Since(time.Unix(c.Created, 0)) < maxAge {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), BridgeContainerTimeout)
+		err := removeBridgeContainer(ctx, client, c.ID)
+		cancel()
+		if err != nil {
+			log.Warnf("Failed to remove orphaned dummy network container %.12s, error: %s", c.ID, err)
+			continue
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Infof("Removed %d orphaned dummy network container(s)", removed)
+	}
+
+	return removed, nil
+}
+
+// PruneDanglingImages removes untagged <none>:<none> images left by pulls of moving tags,
+// skipping the ones still used by containers. It returns the number of removed images and
+// the disk space they took according to the image list. The dummy network container image
+// is never removed, and the pruning waits for GetBridgeIP calls in flight.
+func PruneDanglingImages(client DockerAPI) (removed int, reclaimed int64, err error) {
+	// the lookups of GetNetworkGatewayIP may run the dummy container
+	bridgeIPCache.lookups.Lock()
+	defer bridgeIPCache.lookups.Unlock()
+
+	images, err := client.ListImages(docker.ListImagesOptions{
+		Filters: map[string][]string{"dangling": []string{"true"}},
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to list dangling images, error: %s", err)
+	}
+
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true})
 	if err != nil {
-		return nil, fmt.Errorf("Failed to inspect image %s after pull, error: %s", image, err)
+		return 0, 0, fmt.Errorf("Failed to list containers, error: %s", err)
+	}
+
+	used := map[string]struct{}{}
+	for _, c := range containers {
+		used[strings.TrimPrefix(c.Image, "sha256:")] = struct{}{}
+	}
+	if bridgeImage, err := client.InspectImage(bridgeImageName()); err == nil {
+		used[strings.TrimPrefix(bridgeImage.ID, "sha256:")] = struct{}{}
+	}
+
+	for _, image := range images {
+		if len(image.RepoTags) > 0 && image.RepoTags[0] != "<none>:<none>" {
+			continue
+		}
+		if isImageUsed(image.ID, used) {
+			log.Debugf("Skipping dangling image %.19s, it is used by a container", image.ID)
+			continue
+		}
+
+		if err := client.RemoveImage(image.ID); err != nil {
+			log.Warnf("Failed to remove dangling image %.19s, error: %s", image.ID, err)
+			continue
+		}
+
+		removed++
+		reclaimed += image.Size
+	}
+
+	if removed > 0 {
+		log.Infof("Removed %d dangling image(s), reclaimed %d bytes", removed, reclaimed)
+	}
+
+	return removed, reclaimed, nil
+}
+
+// isImageUsed returns true if the image id matches any of used ids; containers
+// of untagged images may refer to them by the short id
+func isImageUsed(id string, used map[string]struct{}) bool {
+	id = strings.TrimPrefix(id, "sha256:")
+	for ref := range used {
+		if len(ref) >= 12 && strings.HasPrefix(id, ref) {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageRewriter, if set, transforms every image reference before it is pulled or its tags
+// are listed, e.g. to redirect some namespaces to an internal registry. An error blocks
+// the pull, e.g. of images from registries that are not allowed. The tags are listed from
+// the rewritten repository but keep the original names, so version ranges resolve the same
+// way; the pulled image gets the rewritten name.
+var ImageRewriter func(image *imagename.ImageName) (*imagename.ImageName, error)
+
+// rewriteImage applies ImageRewriter to the image, the image is returned as is if it is not set
+func rewriteImage(image *imagename.ImageName) (*imagename.ImageName, error) {
+	if ImageRewriter == nil {
+		return image, nil
+	}
+	rewritten, err := ImageRewriter(image)
+	if err != nil {
+		return nil, fmt.Errorf("Image %s is rejected: %w", image, err)
+	}
+	if rewritten == nil {
+		return image, nil
+	}
+	return rewritten, nil
+}
+
+// PullDockerImage pulls an image and streams to a logger respecting terminal features.
+// Version ranges, e.g. app:~1.4, are resolved by ResolveImageTag first and the resolved
+// tag is pulled.
+func PullDockerImage(client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations) (*docker.Image, error) {
+	result, err := PullDockerImageWithOptions(client, image, auth, PullOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return result.Image, nil
+}
+
+// PullResult is what PullDockerImageWithOptions pulled
+type PullResult struct {
+	Image *docker.Image
+
+	// Name is the name the image was pulled by, it differs from the requested one if the
+	// image was rewritten by ImageRewriter or pulled from a fallback registry
+	Name *imagename.ImageName
+
+	// Digest is the content digest of the image, empty if the daemon did not report it
+	Digest string
+
+	// Kept is the reference the replaced image is kept by, see PullOptions.KeepPrevious;
+	// nil if there is no previous image locally
+	Kept *imagename.ImageName
+
+	// Warnings are the advisory warnings of the pull, e.g. retried attempts or the use of a
+	// fallback registry. They are still logged, the list lets callers such as a server
+	// integration present them in a response.
+	Warnings []Warning
+}
+
+// PullDockerImageWithOptions is the same as PullDockerImage but accepts PullOptions that
+// tune the pull behavior, e.g. retry policy, fallback registries or the pull policy, and
+// returns what was pulled. The given image is never modified. The result is returned even
+// if the pull failed, with the warnings and the kept previous image only.
+func PullDockerImageWithOptions(client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (*PullResult, error) {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result := &PullResult{Warnings: []Warning{}}
+	opts.warnings = &result.Warnings
+
+	if opts.KeepPrevious {
+		kept, err := keepPreviousImage(client, image, opts.Previous, opts.PreviousTag)
+		if err != nil {
+			return result, err
+		}
+		result.Kept = kept
+	}
+
+	img, name, digest, err := pullDockerImage(ctx, client, image, auth, opts)
+	if err != nil {
+		return result, err
+	}
+	if err := verifyImageDigest(img, name, digest, opts.ExpectedDigest); err != nil {
+		return result, err
+	}
+
+	result.Image, result.Name, result.Digest = img, name, digest
+	return result, nil
+}
+
+// localImageForPolicy returns the local image if the pull policy allows to skip the pull,
+// or nil if the image should be pulled. Version ranges are resolved to tags already.
+func localImageForPolicy(client DockerAPI, image *imagename.ImageName, policy PullPolicy) (*docker.Image, error) {
+	if policy != PullIfNotPresent && policy != PullNever {
+		return nil, nil
+	}
+
+	img, err := client.InspectImage(image.String())
+	if err == nil {
+		log.Debugf("Image %s is present locally, skipping pull", image)
+		return img, nil
+	}
+	if !isNoSuchImage(err) {
+		return nil, fmt.Errorf("Failed to inspect image %s, error: %s", image, err)
+	}
+	if policy == PullNever {
+		return nil, fmt.Errorf("Image %s: %w", image, ErrImageNotPresent)
+	}
+	return nil, nil
+}
+
+// resolvePulledImage resolves the version range of the image before the pull according to
+// the pull policy, see PullOptions.Resolve. The pull records the resolution on its own.
+func resolvePulledImage(client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (*imagename.ImageName, error) {
+	if opts.Policy == PullNever {
+		all, err := client.ListImages(docker.ListImagesOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+		}
+		resolved := findMostRecentTag(image, newLocalImageIndex(all).lookup(image), nil, true, opts.Resolve)
+		if resolved == nil {
+			return nil, fmt.Errorf("Image %s has a version range that cannot be resolved locally: %w", image, ErrImageNotPresent)
+		}
+		return resolved, nil
+	}
+
+	opts.Recorder = nil
+	resolved, _, err := ResolveImageTag(client, image, opts.Policy != PullIfNotPresent, auth, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Resolve %s --> %s", image, resolved.GetTag())
+	return resolved, nil
+}
+
+// keepPreviousImage tags the local previous image with the tag, or finds its digest
+// reference if the tag is empty; it returns nil if the image is not present locally.
+// If previous is nil, the image under the name the pull replaces is the previous one.
+func keepPreviousImage(client DockerAPI, image, previous *imagename.ImageName, tag string) (*imagename.ImageName, error) {
+	if previous == nil {
+		rewritten, err := rewriteImage(image)
+		if err != nil {
+			return nil, err
+		}
+		previous = rewritten
+	}
+
+	img, err := client.InspectImage(previous.String())
+	if isNoSuchImage(err) {
+		log.Debugf("There is no local image %s to keep for rollback", previous)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inspect image %s, error: %s", previous, err)
+	}
+
+	if tag == "" {
+		digest := imageRepoDigest(img, previous)
+		if digest == "" {
+			log.Warnf("Image %s replaced by %s has no registry digest, it is not kept for rollback", previous, image)
+			return nil, nil
+		}
+		kept := WithDigest(previous, digest)
+		log.Infof("Image %s replaced by %s is recorded as %s", previous, image, kept)
+		return kept, nil
+	}
+
+	kept := WithTag(previous, tag)
+	if err := client.TagImage(img.ID, docker.TagImageOptions{
+		Repo:  kept.NameWithRegistry(),
+		Tag:   tag,
+		Force: true,
+	}); err != nil {
+		return nil, fmt.Errorf("Failed to tag image %s as %s, error: %s", previous, kept, err)
+	}
+
+	log.Infof("Image %s replaced by %s is kept as %s for rollback", previous, image, kept)
+	return kept, nil
+}
+
+// pullDockerImage does the actual work of PullDockerImageWithOptions on a copy of the image
+func pullDockerImage(ctx context.Context, client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (*docker.Image, *imagename.ImageName, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, "", err
+	}
+
+	spec := image.String()
+	if unresolved, ok := opts.specs[spec]; ok {
+		spec = unresolved
+	}
+	client = traceDockerAPI(client)
+
+	// the image is pulled under the rewritten name
+	rewritten, err := rewriteImage(image)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if rewritten != image {
+		log.Debugf("Image %s is rewritten to %s", image, rewritten)
+	}
+
+	// the registry is replaced if the image is pulled from a fallback one,
+	// the caller's image is left as is
+	pulled := *rewritten
+	image = &pulled
+
+	if image.HasVersionRange() && !image.IsStrict() {
+		resolved, err := resolvePulledImage(client, image, auth, opts)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		pulled = *resolved
+	}
+
+	img, err := localImageForPolicy(client, image, opts.Policy)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if img != nil {
+		digest := imageRepoDigest(img, image)
+		opts.Recorder.record(spec, image, digest, ResolvedFromLocal)
+		return img, image, digest, nil
+	}
+
+	// the digest is verified before the image gets to the host by a pull or a tag
+	verified, err := verifyImage(image, auth, opts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if opts.ReuseLocalDigest {
+		img, digest, err := reuseLocalImage(client, image, auth, opts)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if img != nil {
+			opts.Recorder.record(spec, image, digest, ResolvedFromLocal)
+			return img, image, digest, nil
+		}
+	}
+
+	if err := pullJitterSleep(ctx, opts.Jitter); err != nil {
+		return nil, nil, "", err
+	}
+
+	var (
+		digest string
+		stats  *pullStatsCollector
+	)
+
+	if opts.Stats != nil {
+		stats = newPullStatsCollector(opts.Progress)
+		opts.Progress = stats.progress
+	}
+
+	if image.Storage == imagename.StorageS3 {
+		dockerClient, ok := untracedDockerAPI(client).(*docker.Client)
+		if !ok {
+			return nil, nil, "", fmt.Errorf("Failed to pull image %s, S3 storage needs the real docker client", image)
+		}
+		s3storage := s3.New(dockerClient, os.TempDir())
+		if err := s3storage.Pull(image.String()); err != nil {
+			return nil, nil, "", err
+		}
+	} else {
+		registries := pullRegistries(image, opts.FallbackRegistries)
+		errs := []string{}
+
+		for _, registry := range registries {
+			candidate := *image
+			candidate.Registry = registry
+
+			if registryHost(registry) != RegistryHost(image) {
+				log.Infof("Pulling image %s from the fallback registry %s", image, registry)
+				opts.addWarning(WarningFallbackRegistry, "Image %s is pulled from the fallback registry %s", image, registry)
+			}
+
+			pulledDigest, err := pullDockerImageMirrored(ctx, client, &candidate, auth, opts)
+			if err == nil {
+				// record the registry we actually pulled from
+				image.Registry = registry
+				digest = pulledDigest
+				errs = nil
+				break
+			}
+			if err == ctx.Err() || len(registries) == 1 {
+				return nil, nil, "", err
+			}
+			errs = append(errs, fmt.Sprintf("%s: %s", candidate.NameWithRegistry(), err))
+		}
+
+		if len(errs) > 0 {
+			return nil, nil, "", fmt.Errorf("Failed to pull image %s from any of the registries, errors: %s", image, strings.Join(errs, "; "))
+		}
+	}
+
+	inspectName := image.String()
+	if image.TagIsDigest() {
+		inspectName = hubMirrorImage(image, opts.HubMirror).String()
+	}
+
+	if img, err = client.InspectImage(inspectName); err != nil {
+		return nil, nil, "", fmt.Errorf("Failed to inspect image %s after pull, error: %s", image, err)
+	}
+
+	if err := checkImagePlatform(img, image, opts.Platform); err != nil {
+		return nil, nil, "", err
+	}
+
+	// the stream of older daemons does not have the digest, try the image itself
+	if digest == "" && image.TagIsDigest() {
+		digest = image.Tag
+	}
+	if digest == "" {
+		digest = imageRepoDigest(img, image)
+	}
+
+	// the tag may have been moved in between
+	if verified != "" && digest != "" && digest != verified {
+		return nil, nil, "", fmt.Errorf("Image %s changed in the registry after verification, verified %s but pulled %s: %w",
+			image, verified, digest, ErrImageNotVerified)
+	}
+
+	if stats != nil {
+		summary := stats.summary(image.String())
+		log.Infof("Pulled image %s: %s", image, summary)
+		opts.Stats(summary)
+	}
+
+	opts.Recorder.record(spec, image, digest, ResolvedFromRegistry)
+
+	return img, image, digest, nil
+}
+
+// verifyImage calls PullOptions.Verify with the digest the image has in the registry
+// and returns the verified digest; it does nothing if there is no verifier
+func verifyImage(image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (string, error) {
+	if opts.Verify == nil {
+		return "", nil
+	}
+
+	digest := ""
+	if image.TagIsDigest() {
+		digest = image.Tag
+	} else if image.Storage != imagename.StorageS3 {
+		var err error
+		if digest, err = RegistryImageDigest(image, auth, opts.Registry); err != nil {
+			return "", fmt.Errorf("Failed to get digest of image %s to verify it, error: %s", image, err)
+		}
+	}
+	if digest == "" {
+		return "", fmt.Errorf("Image %s cannot be verified, its digest is unknown: %w", image, ErrImageNotVerified)
+	}
+
+	ref := image.NameWithRegistry()
+	if err := opts.Verify(ref, digest); err != nil {
+		return "", fmt.Errorf("Image %s@%s is rejected by verification: %s: %w", ref, digest, err, ErrImageNotVerified)
+	}
+
+	log.Debugf("Image %s@%s is verified", ref, digest)
+	return digest, nil
+}
+
+// reuseLocalImage looks for a local image of the same content digest as the image has in the
+// registry, e.g. the same image pulled from a mirror, and tags it with the image name instead
+// of pulling, see PullOptions.ReuseLocalDigest. It returns nil if there is no such image or
+// the digest is unknown; digest references and S3 images are never reused.
+func reuseLocalImage(client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (*docker.Image, string, error) {
+	if image.TagIsDigest() || image.Storage == imagename.StorageS3 {
+		return nil, "", nil
+	}
+
+	digest, err := RegistryImageDigest(image, auth, opts.Registry)
+	if err != nil || digest == "" {
+		log.Debugf("Cannot reuse a local image for %s, the digest is unknown, error: %v", image, err)
+		return nil, "", nil
+	}
+
+	all, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	var found *docker.APIImages
+	for i, candidate := range all {
+		for _, repoDigest := range candidate.RepoDigests {
+			if strings.HasSuffix(repoDigest, "@"+digest) {
+				found = &all[i]
+				break
+			}
+		}
+		if found != nil {
+			break
+		}
+	}
+	if found == nil {
+		return nil, "", nil
+	}
+
+	log.Infof("Image %s has the same digest %s as the local image %.12s, tagging it instead of pulling", image, digest, found.ID)
+
+	if err := client.TagImage(found.ID, docker.TagImageOptions{
+		Repo:  image.NameWithRegistry(),
+		Tag:   image.GetTag(),
+		Force: true,
+	}); err != nil {
+		return nil, "", fmt.Errorf("Failed to tag the local image %.12s as %s, error: %s", found.ID, image, err)
+	}
+
+	img, err := client.InspectImage(image.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to inspect image %s after tagging, error: %s", image, err)
+	}
+	if err := checkImagePlatform(img, image, opts.Platform); err != nil {
+		return nil, "", err
+	}
+
+	return img, digest, nil
+}
+
+// DigestMismatchError is returned by PullDockerImageWithOptions if the pulled image
+// does not have the content digest of PullOptions.ExpectedDigest
+type DigestMismatchError struct {
+	Image    string
+	Expected string
+	Actual   []string
+}
+
+// Error returns string representation of the error
+func (e *DigestMismatchError) Error() string {
+	actual := "none"
+	if len(e.Actual) > 0 {
+		actual = strings.Join(e.Actual, ", ")
+	}
+	return fmt.Sprintf("Digest mismatch of image %s: expected %s, got %s", e.Image, e.Expected, actual)
+}
+
+// verifyImageDigest checks that the image has the expected digest among the RepoDigests
+// of its repository or the digest reported by the pull; sha256 is assumed if the expected
+// digest has no algorithm
+func verifyImageDigest(img *docker.Image, image *imagename.ImageName, pulledDigest, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	if !strings.Contains(expected, ":") {
+		expected = "sha256:" + expected
+	}
+
+	actual := []string{}
+	if pulledDigest != "" {
+		actual = append(actual, pulledDigest)
+	}
+	for _, digest := range imageRepoDigests(img, image) {
+		if digest != pulledDigest {
+			actual = append(actual, digest)
+		}
+	}
+
+	for _, digest := range actual {
+		if digest == expected {
+			return nil
+		}
+	}
+
+	return &DigestMismatchError{Image: image.String(), Expected: expected, Actual: actual}
+}
+
+// pullDockerImageMirrored pulls Docker Hub images through PullOptions.HubMirror if given
+// and tags them back with the original name, other images are pulled as usual
+func pullDockerImageMirrored(ctx context.Context, client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (string, error) {
+	mirrored := hubMirrorImage(image, opts.HubMirror)
+	if mirrored == image {
+		return pullDockerImageRetry(ctx, client, image, auth, opts)
+	}
+
+	log.Debugf("Pulling image %s through the Docker Hub mirror as %s", image, mirrored)
+
+	digest, err := pullDockerImageRetry(ctx, client, mirrored, auth, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// images referenced by digest cannot be tagged, they are inspected by the mirror name
+	if image.TagIsDigest() {
+		return digest, nil
+	}
+
+	if err := client.TagImage(mirrored.String(), docker.TagImageOptions{
+		Repo:  image.NameWithRegistry(),
+		Tag:   image.Tag,
+		Force: true,
+	}); err != nil {
+		return "", fmt.Errorf("Failed to tag image %s pulled from the mirror as %s, error: %s", mirrored, image, err)
+	}
+
+	return digest, nil
+}
+
+// hubMirrorImage returns the name of the Docker Hub image in the mirror,
+// e.g. nginx:1.9 becomes mirror.example.com/library/nginx:1.9; images of other
+// registries, or any image if there is no mirror, are returned as is
+func hubMirrorImage(image *imagename.ImageName, mirror string) *imagename.ImageName {
+	if mirror == "" || !IsDockerHub(image) || image.Storage == imagename.StorageS3 {
+		return image
+	}
+
+	mirrored := *image
+	mirrored.Registry = mirror
+	mirrored.Name = hubRepositoryName(mirrored.Name)
+	return &mirrored
+}
+
+// checkImagePlatform makes sure the pulled image is of the architecture of the platform,
+// e.g. "linux/arm64/v8". The vendored docker client cannot pass the platform to the daemon,
+// so the variant is chosen by the daemon and a wrong one is reported instead of being run.
+func checkImagePlatform(img *docker.Image, image *imagename.ImageName, platform string) error {
+	if platform == "" {
+		return nil
+	}
+
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Invalid platform %q, expected os/arch[/variant]", platform)
+	}
+
+	if img.Architecture != "" && img.Architecture != parts[1] {
+		return fmt.Errorf("Image %s was pulled for architecture %s, but platform %s is required; make sure the daemon default platform is %s",
+			image, img.Architecture, platform, platform)
+	}
+
+	return nil
+}
+
+// imageRepoDigest finds the digest of the image among RepoDigests of the inspected one
+func imageRepoDigest(img *docker.Image, image *imagename.ImageName) string {
+	prefix := image.NameWithRegistry() + "@"
+	for _, repoDigest := range img.RepoDigests {
+		if strings.HasPrefix(repoDigest, prefix) {
+			return strings.TrimPrefix(repoDigest, prefix)
+		}
+	}
+	return ""
+}
+
+// imageRepoDigests returns the content digests the image is known by in the repository
+// of the given name, Docker Hub aliases are treated as the same repository
+func imageRepoDigests(img *docker.Image, image *imagename.ImageName) []string {
+	digests := []string{}
+	for _, repoDigest := range img.RepoDigests {
+		i := strings.LastIndex(repoDigest, "@")
+		if i >= 0 && SameRepo(image, imagename.NewFromString(repoDigest[:i])) {
+			digests = append(digests, repoDigest[i+1:])
+		}
+	}
+	return digests
+}
+
+// PullImages pulls given images in parallel using up to concurrency workers, failed pulls
+// do not stop the others. It returns the pulled images by their original names; the
+// registry of a pulled image may differ in case it was pulled from a fallback registry.
+// To keep the output readable, progress is rendered line by line when pulling in parallel.
+func PullImages(ctx context.Context, client DockerAPI, images []*imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions, concurrency int) (map[string]*imagename.ImageName, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > 1 {
+		opts.PlainOutput = true
+	}
+	opts.Context = ctx
+
+	type pullResult struct {
+		name  string
+		image *imagename.ImageName
+		err   error
+	}
+
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan *imagename.ImageName)
+		results = make(chan pullResult, len(images))
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range jobs {
+				result, err := PullDockerImageWithOptions(client, image, auth, opts)
+				if err != nil {
+					results <- pullResult{image.String(), nil, err}
+					continue
+				}
+				results <- pullResult{image.String(), result.Name, nil}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for _, image := range images {
+			select {
+			case jobs <- image:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(results)
+
+	var (
+		pulled = map[string]*imagename.ImageName{}
+		errs   = map[string]error{}
+	)
+
+	for res := range results {
+		if res.err != nil {
+			errs[res.name] = res.err
+			continue
+		}
+		pulled[res.name] = res.image
+	}
+
+	if err := ctx.Err(); err != nil {
+		return pulled, err
+	}
+
+	if len(errs) > 0 {
+		messages := []string{}
+		for _, image := range images {
+			if err, ok := errs[image.String()]; ok {
+				messages = append(messages, fmt.Sprintf("%s: %s", image, err))
+			}
+		}
+		return pulled, fmt.Errorf("Failed to pull %d of %d images, errors: %s", len(errs), len(images), strings.Join(messages, "; "))
+	}
+
+	return pulled, nil
+}
+
+// pullDockerImageRetry pulls the image retrying according to the retry policy
+func pullDockerImageRetry(ctx context.Context, client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (string, error) {
+	retry := opts.Retry.withDefaults()
+	backoff := retry.InitialBackoff
+	resets := 0
+
+	for attempt := 1; ; attempt++ {
+		digest, err := pullDockerImageAttempt(ctx, client, image, auth, opts)
+		if err == nil {
+			return digest, nil
+		}
+
+		// the daemon socket dropped mid-stream, the pull is restarted right away and
+		// does not count as an attempt; retries are disabled with MaxAttempts of 1
+		if retry.MaxAttempts > 1 && resets < retry.MaxResets && isConnectionReset(err) && ctx.Err() == nil {
+			resets++
+			attempt--
+			log.Warnf("Connection to the docker daemon was reset while pulling image %s, restarting the pull %d/%d, error: %s",
+				image, resets, retry.MaxResets, err)
+			opts.addWarning(WarningPullRetry, "Connection reset while pulling image %s, restart %d/%d, error: %s",
+				image, resets, retry.MaxResets, err)
+			continue
+		}
+
+		if attempt >= retry.MaxAttempts || !isRetryablePullError(err) {
+			return "", err
+		}
+
+		// do not come back before the registry allows to
+		if e, ok := err.(*RateLimitError); ok && e.RetryAfter > backoff {
+			backoff = e.RetryAfter
+		}
+
+		log.Warnf("Failed to pull image %s, attempt %d/%d, retrying in %s, error: %s",
+			image, attempt, retry.MaxAttempts, backoff, err)
+		opts.addWarning(WarningPullRetry, "Failed to pull image %s, attempt %d/%d, error: %s",
+			image, attempt, retry.MaxAttempts, err)
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = time.Duration(float64(backoff) * retry.Multiplier)
+	}
+}
+
+var pullJitterSeed sync.Once
+
+// pullJitterSleep sleeps a random duration up to max, so many hosts deploying at
+// the same time do not hit the registry at the same instant
+func pullJitterSleep(ctx context.Context, max time.Duration) error {
+	if max <= 0 {
+		return nil
+	}
+
+	pullJitterSeed.Do(func() {
+		rand.Seed(time.Now().UnixNano())
+	})
+
+	delay := time.Duration(rand.Int63n(int64(max)))
+	log.Debugf("Sleeping %s before pulling to spread the registry load", delay)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// pullRegistries returns the image registry followed by fallbacks, without duplicates;
+// Docker Hub aliases, e.g. docker.io for redis, are duplicates as well
+func pullRegistries(image *imagename.ImageName, fallbacks []string) []string {
+	registries := []string{image.Registry}
+	seen := map[string]struct{}{RegistryHost(image): struct{}{}}
+	for _, registry := range fallbacks {
+		if _, ok := seen[registryHost(registry)]; ok || registry == "" {
+			continue
+		}
+		seen[registryHost(registry)] = struct{}{}
+		registries = append(registries, registry)
+	}
+	return registries
+}
+
+// pullDockerImageAttempt does a single pull of the image from the registry and returns
+// the digest reported by the daemon. Every attempt uses its own pipe so the json stream
+// is never shared between retries.
+func pullDockerImageAttempt(ctx context.Context, client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, opts PullOptions) (digest string, err error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	attemptCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		attemptCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	// aborted returns the error to report if the pull was cancelled or timed out
+	aborted := func() error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attemptCtx.Err() != nil {
+			return &pullAttemptError{
+				message: fmt.Sprintf("Timeout pulling image %s, waited %s", image, opts.Timeout),
+				cause:   errPullTimeout,
+			}
+		}
+		return nil
+	}
+
+	pullOpts := docker.PullImageOptions{
+		Repository:    image.NameWithRegistry(),
+		Registry:      image.Registry,
+		Tag:           image.Tag,
+		OutputStream:  pipeWriter,
+		RawJSONStream: true,
+		Context:       attemptCtx,
+	}
+
+	// digest references are pulled as repository@sha256:...
+	if image.TagIsDigest() {
+		pullOpts.Repository = image.String()
+		pullOpts.Tag = ""
+	}
+
+	repoAuth, err := getAuthForImage(opts.AuthResolver, auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to authenticate registry %s, error: %s", image.Registry, err)
+	}
+
+	errch := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	// abort the json stream as soon as the context is cancelled or the timeout is exceeded
+	go func() {
+		select {
+		case <-attemptCtx.Done():
+			pipeReader.CloseWithError(attemptCtx.Err())
+		case <-done:
+		}
+	}()
+
+	go func() {
+		err := client.PullImage(pullOpts, repoAuth)
+
+		if err := pipeWriter.Close(); err != nil {
+			log.Errorf("Failed to close pull image stream for %s, error: %s", image, err)
+		}
+
+		errch <- err
+	}()
+
+	def := opts.Logger
+	if def == nil {
+		def = log.StandardLogger()
+	}
+	fd, isTerminal := term.GetFdInfo(def.Out)
+	out := def.Out
+
+	_, isJSONLog := def.Formatter.(*log.JSONFormatter)
+
+	if !isTerminal || opts.PlainOutput {
+		isTerminal = false
+		logWriter := def.Writer()
+		defer logWriter.Close()
+		out = logWriter
+	}
+
+	// progress bars make no sense for log aggregators, log status changes instead
+	if isJSONLog && !isTerminal {
+		out = ioutil.Discard
+	}
+
+	// CI logs get periodic summaries rather than every progress message
+	var summary *pullSummaryLogger
+	if !isJSONLog && !isTerminal && opts.SummaryInterval > 0 {
+		summary = newPullSummaryLogger(def, image.String(), opts.SummaryInterval)
+		out = ioutil.Discard
+	}
+
+	// the digest comes as a status message, e.g. "Digest: sha256:..."
+	progress := func(layerID string, current, total int64, status string) {
+		if strings.HasPrefix(status, pullDigestPrefix) {
+			digest = strings.TrimPrefix(status, pullDigestPrefix)
+		}
+		if isJSONLog && !isTerminal && isPullStatusChange(status) {
+			def.WithFields(log.Fields{
+				"image":  image.String(),
+				"layer":  layerID,
+				"status": status,
+			}).Info(status)
+		}
+		if summary != nil {
+			summary.progress(layerID, current, total, status)
+		}
+		if opts.Progress != nil {
+			opts.Progress(layerID, current, total, status)
+		}
+	}
+
+	progressWriter := &pullProgressWriter{fn: progress, copy: opts.ProgressCopy, image: image.String()}
+	stream := io.TeeReader(pipeReader, progressWriter)
+
+	// streamError returns the error the daemon reported in the stream, if any
+	streamError := func(err error) error {
+		progressWriter.flush()
+		last := progressWriter.last
+		if last.Error == nil && last.ErrorMessage == "" {
+			return nil
+		}
+		pullErr := newPullError(image, err, last)
+		if pullErr.Code == http.StatusTooManyRequests || isRateLimitMessage(pullErr.Message) {
+			return &RateLimitError{Registry: image.Registry, Message: pullErr.Message}
+		}
+		return pullErr
+	}
+
+	if err := jsonmessage.DisplayJSONMessagesStream(stream, out, fd, isTerminal); err != nil {
+		if err := aborted(); err != nil {
+			pipeReader.CloseWithError(err)
+			return "", err
+		}
+
+		// the daemon reported the error in the stream, keep it for the caller
+		if _, ok := err.(*jsonmessage.JSONError); ok {
+			pipeReader.CloseWithError(err)
+			return "", streamError(err)
+		}
+
+		// only the output rendering broke, e.g. on a garbled message, which should not fail
+		// the pull; consume the rest of the stream and let the pull result decide
+		log.Warnf("Failed to display pull progress of image %s, error: %s", image, err)
+
+		if _, err := io.Copy(ioutil.Discard, stream); err != nil {
+			pipeReader.CloseWithError(err)
+			if err := aborted(); err != nil {
+				return "", err
+			}
+			return "", &pullAttemptError{
+				message: fmt.Sprintf("Failed to process json stream for image: %s, error: %s", image, err),
+				cause:   err,
+			}
+		}
+		if err := streamError(err); err != nil {
+			return "", err
+		}
+	}
+
+	if err := <-errch; err != nil {
+		if err := aborted(); err != nil {
+			return "", err
+		}
+		if e, ok := err.(*docker.Error); ok && (e.Status == http.StatusTooManyRequests || isRateLimitMessage(e.Message)) {
+			return "", &RateLimitError{Registry: image.Registry, Message: e.Message}
+		}
+		return "", &pullAttemptError{
+			message: fmt.Sprintf("Failed to pull image %s, error: %s", image, err),
+			cause:   err,
+		}
+	}
+
+	return digest, nil
+}
+
+// isPullStatusChange returns true for the pull stream statuses worth a log entry,
+// unlike "Downloading" or "Extracting" that come for every progress update
+func isPullStatusChange(status string) bool {
+	for _, prefix := range []string{"Pulling", "Already exists", "Download complete", "Pull complete", pullDigestPrefix, "Status:"} {
+		if strings.HasPrefix(status, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// PullPolicy tells when images are pulled, it has the semantics of the imagePullPolicy of Kubernetes
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image even if it is present locally, this is the default
+	PullAlways PullPolicy = "Always"
+
+	// PullIfNotPresent pulls the image only if it is not present locally
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+
+	// PullNever never pulls, ErrImageNotPresent is returned if the image is not present locally
+	PullNever PullPolicy = "Never"
+)
+
+// DefaultPreviousTag is the conventional tag of the images kept for rollback, see PullOptions.PreviousTag
+const DefaultPreviousTag = "previous"
+
+// ErrImageNotVerified is matched by errors.Is if PullOptions.Verify rejected the image
+var ErrImageNotVerified = errors.New("image verification failed")
+
+// ErrImageNotPresent is matched by errors.Is if the image is not present locally
+// and the PullNever policy forbids to pull it
+var ErrImageNotPresent = errors.New("image is not present locally and the pull policy is Never")
+
+// ParsePullPolicy parses the pull policy case-insensitively, "missing" is accepted for
+// IfNotPresent; an empty string gives the empty policy, i.e. the default behavior
+func ParsePullPolicy(value string) (PullPolicy, error) {
+	switch strings.ToLower(value) {
+	case "":
+		return "", nil
+	case "always":
+		return PullAlways, nil
+	case "ifnotpresent", "missing":
+		return PullIfNotPresent, nil
+	case "never":
+		return PullNever, nil
+	}
+	return "", fmt.Errorf("Invalid pull policy %q, expected one of Always, IfNotPresent, Never", value)
+}
+
+// PullOptions is a set of optional settings for PullDockerImageWithOptions
+type PullOptions struct {
+	// Retry is the policy of re-attempting the pull on transient registry errors
+	Retry RetryPolicy
+
+	// FallbackRegistries are tried in order when the pull from the image's own registry fails.
+	// On success the image registry is replaced with the one the image was pulled from.
+	FallbackRegistries []string
+
+	// Progress, if given, is called for every message of the pull stream
+	Progress PullProgressFunc
+
+	// PlainOutput forces line-based progress output even if the log output is a terminal
+	PlainOutput bool
+
+	// SummaryInterval, if set, replaces the line-based progress output of non-terminals,
+	// e.g. CI logs, with a summary line of the downloaded layers and bytes at most once
+	// per the interval; messages that are not about layers, e.g. the digest, are logged
+	// as usual. The terminal output is not affected, every message is logged if zero.
+	SummaryInterval time.Duration
+
+	// Timeout limits the pull from a registry, it is aborted and not retried when exceeded;
+	// no limit if zero
+	Timeout time.Duration
+
+	// AuthResolver, if given, finds credentials of the image registry, the static
+	// auth configurations are used if it has none
+	AuthResolver AuthResolver
+
+	// Jitter is the maximum random delay before the pull, it spreads the registry load
+	// when many hosts deploy at once; no delay if zero
+	Jitter time.Duration
+
+	// HubMirror is the host[:port] of a pull-through mirror of Docker Hub. Docker Hub
+	// images are pulled from it and tagged back with their original names.
+	HubMirror string
+
+	// ProgressCopy, if given, receives a plain text copy of the pull progress in addition
+	// to the output of the logger, e.g. an audit log file. Lines are prefixed by the image
+	// name and have no terminal control sequences. It should be safe for concurrent use
+	// when pulling in parallel.
+	ProgressCopy io.Writer
+
+	// Context, if given, cancels the pull: the pull stream is aborted and ctx.Err() is returned
+	Context context.Context
+
+	// KeepPrevious makes the pull first protect the local image the pulled one replaces, so a
+	// rollback is instant and does not depend on the registry. The kept reference is returned
+	// as PullResult.Kept.
+	KeepPrevious bool
+
+	// Previous is the image of the running container being upgraded, see KeepPrevious; if it
+	// is nil, the image currently under the same name is the one replaced, e.g. when "latest" moves
+	Previous *imagename.ImageName
+
+	// PreviousTag is the tag the replaced image is given, e.g. DefaultPreviousTag, which keeps
+	// it from PruneDangling and the cleanup; it is only recorded by its digest if it is empty
+	PreviousTag string
+
+	// ExpectedDigest, if given, is the content digest, e.g. "sha256:...", the image must have
+	// when the tag is pinned to it. The digests of the image repository are taken from the
+	// RepoDigests of the pulled image, a DigestMismatchError is returned if none of them is
+	// the expected one, e.g. when the tag was moved or the registry was tampered with.
+	ExpectedDigest string
+
+	// Platform is the os/arch[/variant] the pulled image must be built for, e.g. "linux/arm64";
+	// the image is checked against it after the pull, any platform is accepted if empty
+	Platform string
+
+	// Logger receives the pull progress, the terminal detection is done against its output.
+	// It lets concurrent operations route progress to their own destinations;
+	// the standard logger is used if nil.
+	Logger *log.Logger
+
+	// Policy tells whether images present locally are pulled, PullAlways is used if empty
+	Policy PullPolicy
+
+	// Stats, if given, receives the download statistics of the image when it is pulled,
+	// they are logged as well
+	Stats PullStatsFunc
+
+	// ReuseLocalDigest makes the pull look for a local image of the same content digest as the
+	// image has in the registry, e.g. the same image pulled earlier from a mirror, and tag it
+	// instead of downloading the image again. The digest is asked from the registry according
+	// to Registry, the image is pulled as usual if it is unknown.
+	ReuseLocalDigest bool
+
+	// Registry is the config of the registry requests made by the pull itself,
+	// see ReuseLocalDigest, Verify and Resolve
+	Registry RegistryConfig
+
+	// Resolve tells how the version ranges of the pulled images, e.g. app:~1.4, are resolved
+	// to tags, see ResolveImageTag. The local images are looked at first if the policy is
+	// PullIfNotPresent, the remote tags are listed otherwise; PullNever looks at the local
+	// images only.
+	Resolve ResolveOptions
+
+	// Verify, if given, is the supply-chain policy gate of the pull, e.g. a function that
+	// shells out to cosign: it is called with the image reference and the content digest
+	// the image has in the registry before anything is pulled, and the pull is aborted with
+	// ErrImageNotVerified if it returns an error. Images present locally are not verified.
+	// The verification fails if the digest is unknown, e.g. for S3 or AWS ECR images, and
+	// the pull fails if the daemon pulled another digest than the verified one.
+	Verify func(ref, digest string) error
+
+	// Recorder, if given, collects what the pulled images were resolved to, see ResolutionRecorder
+	Recorder *ResolutionRecorder
+
+	// warnings collects advisory warnings of the pull, see PullResult.Warnings
+	warnings *[]Warning
+
+	// specs are the unresolved images by the resolved ones, e.g. "app:1.2.7" -> "app:~1.2",
+	// so Recorder gets what was asked for rather than the resolved tag
+	specs map[string]string
+}
+
+// Warning codes of the pull
+const (
+	WarningPullRetry        = "pull_retry"
+	WarningFallbackRegistry = "fallback_registry"
+)
+
+// Warning is an advisory message of an operation that did not fail because of it
+type Warning struct {
+	Code    string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Code, w.Message)
+}
+
+// addWarning records the warning if the caller collects them
+func (opts PullOptions) addWarning(code, format string, args ...interface{}) {
+	if opts.warnings == nil {
+		return
+	}
+	*opts.warnings = append(*opts.warnings, Warning{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// PullProgressFunc receives pull progress of a single layer. For messages that have
+// no progress detail (e.g. "Pull complete") current and total are zero.
+type PullProgressFunc func(layerID string, current, total int64, status string)
+
+// PullStatsFunc receives the download statistics of the pulled image
+type PullStatsFunc func(stats PullStats)
+
+// PullStats are the download statistics of an image pull, collected from the pull stream
+type PullStats struct {
+	Image  string
+	Layers []LayerStats
+
+	// Bytes is the total size of the downloaded layers
+	Bytes int64
+
+	// Duration is the time of the whole pull, DownloadDuration is the time from the start
+	// of the first layer download till the end of the last one; layers that already
+	// existed are not counted in both Bytes and DownloadDuration
+	Duration         time.Duration
+	DownloadDuration time.Duration
+}
+
+// LayerStats are the download statistics of a single layer
+type LayerStats struct {
+	ID       string
+	Bytes    int64
+	Duration time.Duration
+
+	// Cached is true if the layer already existed and was not downloaded
+	Cached bool
+}
+
+// MBPerSecond returns the effective download speed in megabytes per second,
+// zero if nothing was downloaded
+func (s PullStats) MBPerSecond() float64 {
+	if s.Bytes == 0 || s.DownloadDuration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / (1024 * 1024) / s.DownloadDuration.Seconds()
+}
+
+// CachedLayers returns the number of layers that were not downloaded
+func (s PullStats) CachedLayers() (n int) {
+	for _, layer := range s.Layers {
+		if layer.Cached {
+			n++
+		}
+	}
+	return n
+}
+
+func (s PullStats) String() string {
+	return fmt.Sprintf("%.1f MB in %s, %.2f MB/s, %d of %d layers cached",
+		float64(s.Bytes)/(1024*1024), s.Duration, s.MBPerSecond(), s.CachedLayers(), len(s.Layers))
+}
+
+// pullLayerStatuses are the statuses of the pull stream that are reported per layer
+var pullLayerStatuses = []string{
+	"Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum",
+	"Download complete", "Extracting", "Pull complete", "Already exists",
+}
+
+// pullStatsCollector gathers PullStats from the progress of the pull stream
+type pullStatsCollector struct {
+	next    PullProgressFunc
+	started time.Time
+	layers  map[string]*pullLayerStats
+	order   []string
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type pullLayerStats struct {
+	bytes      int64
+	start, end time.Time
+	cached     bool
+}
+
+func newPullStatsCollector(next PullProgressFunc) *pullStatsCollector {
+	c := &pullStatsCollector{
+		next:   next,
+		layers: map[string]*pullLayerStats{},
+		now:    time.Now,
+	}
+	c.started = c.now()
+	return c
+}
+
+// progress implements PullProgressFunc and passes the messages to the next one
+func (c *pullStatsCollector) progress(layerID string, current, total int64, status string) {
+	if c.next != nil {
+		c.next(layerID, current, total, status)
+	}
+	if layerID == "" || !isPullLayerStatus(status) {
+		return
+	}
+
+	layer, ok := c.layers[layerID]
+	if !ok {
+		layer = &pullLayerStats{}
+		c.layers[layerID] = layer
+		c.order = append(c.order, layerID)
+	}
+
+	switch status {
+	case "Already exists":
+		layer.cached = true
+	case "Downloading":
+		now := c.now()
+		if layer.start.IsZero() {
+			layer.start = now
+		}
+		layer.end = now
+		if total > layer.bytes {
+			layer.bytes = total
+		} else if current > layer.bytes {
+			layer.bytes = current
+		}
+	case "Download complete":
+		if !layer.start.IsZero() {
+			layer.end = c.now()
+		}
+	}
+}
+
+// summary returns the statistics collected so far; layers with no download progress, e.g.
+// the ones that already existed or tiny ones, do not affect the download speed
+func (c *pullStatsCollector) summary(image string) PullStats {
+	stats := PullStats{
+		Image:    image,
+		Layers:   []LayerStats{},
+		Duration: c.now().Sub(c.started),
+	}
+
+	var first, last time.Time
+
+	for _, id := range c.order {
+		layer := c.layers[id]
+		if layer.cached || layer.start.IsZero() {
+			stats.Layers = append(stats.Layers, LayerStats{ID: id, Cached: layer.cached})
+			continue
+		}
+
+		stats.Layers = append(stats.Layers, LayerStats{ID: id, Bytes: layer.bytes, Duration: layer.end.Sub(layer.start)})
+		stats.Bytes += layer.bytes
+
+		if first.IsZero() || layer.start.Before(first) {
+			first = layer.start
+		}
+		if layer.end.After(last) {
+			last = layer.end
+		}
+	}
+
+	if !first.IsZero() {
+		stats.DownloadDuration = last.Sub(first)
+	}
+
+	return stats
+}
+
+// pullSummaryLogger logs the pull progress as periodic summary lines, see PullOptions.SummaryInterval
+type pullSummaryLogger struct {
+	logger   *log.Logger
+	image    string
+	interval time.Duration
+	now      func() time.Time
+	logged   time.Time
+
+	order  []string
+	layers map[string]*pullSummaryLayer
+}
+
+type pullSummaryLayer struct {
+	current, total int64
+	done           bool
+}
+
+func newPullSummaryLogger(logger *log.Logger, image string, interval time.Duration) *pullSummaryLogger {
+	s := &pullSummaryLogger{
+		logger:   logger,
+		image:    image,
+		interval: interval,
+		now:      time.Now,
+		layers:   map[string]*pullSummaryLayer{},
+	}
+	s.logged = s.now()
+	return s
+}
+
+// progress implements PullProgressFunc
+func (s *pullSummaryLogger) progress(layerID string, current, total int64, status string) {
+	if layerID == "" || !isPullLayerStatus(status) {
+		if status == "" {
+			return
+		}
+		// the final status goes after the final summary
+		if strings.HasPrefix(status, "Status:") && len(s.order) > 0 {
+			s.log()
+		}
+		s.logger.Infof("%s: %s", s.image, status)
+		return
+	}
+
+	layer, ok := s.layers[layerID]
+	if !ok {
+		layer = &pullSummaryLayer{}
+		s.layers[layerID] = layer
+		s.order = append(s.order, layerID)
+	}
+
+	switch status {
+	case "Downloading":
+		layer.current, layer.total = current, total
+	case "Download complete":
+		layer.current = layer.total
+	case "Pull complete", "Already exists":
+		layer.current = layer.total
+		layer.done = true
+	}
+
+	if s.now().Sub(s.logged) >= s.interval {
+		s.log()
+	}
+}
+
+// log writes the summary line of the pull so far
+func (s *pullSummaryLogger) log() {
+	var (
+		done           int
+		current, total int64
+	)
+	for _, id := range s.order {
+		layer := s.layers[id]
+		if layer.done {
+			done++
+		}
+		current += layer.current
+		total += layer.total
+	}
+
+	s.logger.Infof("%s: %d of %d layers complete, %.1f of %.1f MB downloaded",
+		s.image, done, len(s.order), float64(current)/(1024*1024), float64(total)/(1024*1024))
+	s.logged = s.now()
+}
+
+func isPullLayerStatus(status string) bool {
+	for _, s := range pullLayerStatuses {
+		if status == s {
+			return true
+		}
+	}
+	return false
+}
+
+// pullProgressWriter decodes the raw json pull stream passing through it
+// and feeds messages to PullProgressFunc
+type pullProgressWriter struct {
+	fn      PullProgressFunc
+	pending []byte
+	last    jsonmessage.JSONMessage
+
+	// copy receives plain text lines of the messages prefixed by the image name
+	copy  io.Writer
+	image string
+}
+
+// Write implements io.Writer; it is called synchronously by the stream reader
+func (w *pullProgressWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+
+	// the daemon terminates every json message with \r\n
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.pending[:i]
+		w.pending = w.pending[i+1:]
+		w.decode(line)
+	}
+
+	return len(p), nil
+}
+
+// flush decodes the message left without the line terminator, e.g. when the stream
+// reader stopped right after the error message
+func (w *pullProgressWriter) flush() {
+	line := w.pending
+	w.pending = nil
+	w.decode(line)
+}
+
+func (w *pullProgressWriter) decode(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	msg := jsonmessage.JSONMessage{}
+	if err := json.Unmarshal(line, &msg); err != nil {
+		log.Debugf("Failed to decode pull progress message %q, error: %s", line, err)
+		return
+	}
+	w.last = msg
+
+	if w.copy != nil {
+		w.writeCopy(msg)
+	}
+
+	var current, total int64
+	if msg.Progress != nil {
+		current, total = int64(msg.Progress.Current), int64(msg.Progress.Total)
+	}
+	w.fn(msg.ID, current, total, msg.Status)
+}
+
+// writeCopy renders the message the way it is shown in non-terminal outputs,
+// progress bars are skipped
+func (w *pullProgressWriter) writeCopy(msg jsonmessage.JSONMessage) {
+	buf := &bytes.Buffer{}
+	if err := msg.Display(buf, false); err != nil {
+		fmt.Fprintf(buf, "Error: %s\n", err)
+	}
+	if buf.Len() == 0 {
+		return
+	}
+	if _, err := fmt.Fprintf(w.copy, "%s %s", w.image, buf); err != nil {
+		log.Debugf("Failed to write pull progress copy of %s, error: %s", w.image, err)
+	}
+}
+
+// RetryPolicy describes how many times and how often the pull is retried.
+// Zero values are replaced with the ones from DefaultRetryPolicy, except MaxResets;
+// an empty policy is DefaultRetryPolicy as a whole.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	Multiplier     float64
+
+	// MaxResets is how many times the pull is restarted from scratch when the connection
+	// to the docker daemon is reset mid-stream, see isConnectionReset. The restarts do not
+	// count against MaxAttempts and do not wait for the backoff. Zero disables the restarts.
+	MaxResets int
+}
+
+// DefaultRetryPolicy is the retry policy used when none is specified
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 1 * time.Second,
+	Multiplier:     2,
+	MaxResets:      2,
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p == (RetryPolicy{}) {
+		return DefaultRetryPolicy
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = DefaultRetryPolicy.InitialBackoff
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	if p.MaxResets < 0 {
+		p.MaxResets = 0
+	}
+	return p
+}
+
+// pullAttemptError is the error of a single pull attempt, it keeps
+// the original error so we can decide whether to retry
+type pullAttemptError struct {
+	message string
+	cause   error
+}
+
+// Error returns string representation of the error
+func (e *pullAttemptError) Error() string {
+	return e.message
+}
+
+// PullError is returned when the daemon reports an error in the pull stream, e.g.
+// a missing image, denied access or no space left on the device. Callers may branch
+// on Code instead of matching the error text; Code is zero if the daemon did not set it.
+type PullError struct {
+	Image   string
+	Code    int
+	Message string
+
+	// Last is the last message of the pull stream as it came from the daemon
+	Last jsonmessage.JSONMessage
+}
+
+// newPullError makes PullError of the stream error and the last message of the stream
+func newPullError(image *imagename.ImageName, err error, last jsonmessage.JSONMessage) *PullError {
+	e := &PullError{
+		Image:   image.String(),
+		Message: err.Error(),
+		Last:    last,
+	}
+	if last.Error != nil {
+		e.Code = last.Error.Code
+		e.Message = last.Error.Message
+	} else if last.ErrorMessage != "" {
+		e.Message = last.ErrorMessage
+	}
+	return e
+}
+
+// Error returns string representation of the error
+func (e *PullError) Error() string {
+	return fmt.Sprintf("Failed to process json stream for image: %s, error: %s", e.Image, e.Message)
+}
+
+// errPullTimeout is the cause of a pull attempt that exceeded PullOptions.Timeout
+var errPullTimeout = errors.New("pull timeout exceeded")
+
+// isConnectionReset returns true if the pull failed because the connection to the docker
+// daemon was reset or closed mid-stream, e.g. "read: connection reset by peer" or an EOF.
+// Errors the daemon reported in the stream are not resets of the daemon socket, even if the
+// registry reset the connection of the daemon.
+func isConnectionReset(err error) bool {
+	e, ok := err.(*pullAttemptError)
+	if !ok || e.cause == nil || e.cause == errPullTimeout {
+		return false
+	}
+	if errors.Is(e.cause, syscall.ECONNRESET) || errors.Is(e.cause, io.EOF) || errors.Is(e.cause, io.ErrUnexpectedEOF) {
+		return true
+	}
+	return strings.Contains(strings.ToLower(e.cause.Error()), "connection reset by peer")
+}
+
+// isRetryablePullError returns true for network and 5xx-class errors;
+// auth errors (401/403), missing images (404) and timeouts are never retried
+func isRetryablePullError(err error) bool {
+	if e, ok := err.(*pullAttemptError); ok {
+		err = e.cause
+	}
+	if e, ok := err.(*PullError); ok {
+		err = &jsonmessage.JSONError{Code: e.Code, Message: e.Message}
+	}
+
+	switch e := err.(type) {
+	case *RateLimitError:
+		return true
+	case *docker.Error:
+		return e.Status >= 500
+	case *jsonmessage.JSONError:
+		if e.Code == 401 || e.Code == 403 || e.Code == 404 {
+			return false
+		}
+		msg := strings.ToLower(e.Message)
+		for _, fatal := range []string{"unauthorized", "denied", "not found", "manifest unknown", "authentication required"} {
+			if strings.Contains(msg, fatal) {
+				return false
+			}
+		}
+		return true
+	case net.Error:
+		return true
 	}
 
-	return img, nil
+	return err == io.ErrUnexpectedEOF || err == docker.ErrConnectionRefused
 }
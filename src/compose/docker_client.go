@@ -0,0 +1,523 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/mitchellh/go-homedir"
+)
+
+const (
+	// DockerAPIVersionEnv is the environment variable that pins the docker API version
+	DockerAPIVersionEnv = "DOCKER_API_VERSION"
+
+	// DockerTLSVerifyEnv is the environment variable that turns TLS verification on
+	DockerTLSVerifyEnv = "DOCKER_TLS_VERIFY"
+
+	// DockerHostEnv is the environment variable with the address of the docker daemon
+	DockerHostEnv = "DOCKER_HOST"
+
+	sshScheme           = "ssh://"
+	sshRemoteSocket     = "/var/run/docker.sock"
+	sshTunnelWaitPeriod = 10 * time.Second
+)
+
+// sshTunnel is a running `ssh` process that forwards the remote docker
+// socket to a local unix socket
+type sshTunnel struct {
+	cmd    *exec.Cmd
+	dir    string
+	socket string
+}
+
+// DockerClientConfig represents docker client connection parameters
+type DockerClientConfig struct {
+	dockerclient.Config
+
+	// APIVersion pins the docker API version, e.g. "1.21", which is needed for older
+	// daemons that reject requests of newer clients; the default version if empty
+	APIVersion string
+
+	// DialTimeout limits establishing of the connection to the daemon,
+	// the library default is used if zero
+	DialTimeout time.Duration
+
+	// ResponseHeaderTimeout limits waiting for the daemon response headers after
+	// the request is sent, there is no limit if zero
+	ResponseHeaderTimeout time.Duration
+}
+
+var (
+	// defaultDockerSocket is the conventional unix socket of the docker daemon
+	defaultDockerSocket = "/var/run/docker.sock"
+
+	// hostOS is the platform the default docker host is chosen for, see defaultDockerHost
+	hostOS = runtime.GOOS
+
+	sshTunnels   = map[string]*sshTunnel{}
+	sshTunnelsMu sync.Mutex
+
+	// dockerAPIVersions are the pinned API versions of the clients by the endpoint,
+	// the docker client does not tell the version it was created with
+	dockerAPIVersions   = map[string]string{}
+	dockerAPIVersionsMu sync.Mutex
+
+	envReferenceRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// NewDockerClientConfig returns docker client config resolved from the current ENV.
+// In case DOCKER_HOST has the ssh:// scheme, TLS options are dropped because
+// the connection is secured by ssh itself. A leading "~" of DOCKER_CERT_PATH
+// is expanded to the home directory of the current user. The API version is taken
+// from DOCKER_API_VERSION. DOCKER_TLS_VERIFY is parsed by ParseTLSVerify, an invalid
+// value is an error. If DOCKER_HOST is not set, the conventional socket of the platform
+// is used, see defaultDockerHost; the host is left empty on Windows.
+func NewDockerClientConfig() (*DockerClientConfig, error) {
+	config := &DockerClientConfig{
+		Config:     *dockerclient.NewConfig(),
+		APIVersion: os.Getenv(DockerAPIVersionEnv),
+	}
+	if os.Getenv(DockerHostEnv) == "" {
+		config.Host = defaultDockerHost()
+	}
+
+	verify, err := ParseTLSVerify(os.Getenv(DockerTLSVerifyEnv))
+	if err != nil {
+		return nil, err
+	}
+	config.Tlsverify = verify
+
+	if isSSHHost(config.Host) {
+		config.Tlsverify = false
+	}
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); strings.HasPrefix(certPath, "~") {
+		if expanded, err := homedir.Expand(certPath); err != nil {
+			log.Warnf("Failed to expand DOCKER_CERT_PATH %s, error: %s", certPath, err)
+		} else {
+			config.Tlscacert = filepath.Join(expanded, "ca.pem")
+			config.Tlscert = filepath.Join(expanded, "cert.pem")
+			config.Tlskey = filepath.Join(expanded, "key.pem")
+		}
+	}
+	return config, nil
+}
+
+// InterpolateDockerClientConfig returns a copy of the config with ${VAR} references in the
+// host and the TLS cert paths replaced by the values of the environment variables, e.g.
+// ${DEPLOY_DOCKER_HOST}, so a single templated config serves several deployments. Other
+// text, including $VAR without braces, is left as is. An undefined variable is an error,
+// unless keepUndefined is set, in which case the reference itself is kept.
+func InterpolateDockerClientConfig(config *DockerClientConfig, keepUndefined bool) (*DockerClientConfig, error) {
+	result := *config
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"host", &result.Host},
+		{"CA cert", &result.Tlscacert},
+		{"cert", &result.Tlscert},
+		{"key", &result.Tlskey},
+	}
+
+	for _, field := range fields {
+		var undefined []string
+
+		*field.value = envReferenceRe.ReplaceAllStringFunc(*field.value, func(ref string) string {
+			name := envReferenceRe.FindStringSubmatch(ref)[1]
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			undefined = append(undefined, name)
+			return ref
+		})
+
+		if len(undefined) > 0 && !keepUndefined {
+			return nil, fmt.Errorf("Undefined environment variable %s in docker %s %q", strings.Join(undefined, ", "), field.name, *field.value)
+		}
+	}
+
+	return &result, nil
+}
+
+// ParseTLSVerify parses the value of DOCKER_TLS_VERIFY: "1", "true", "yes" and "on" turn
+// the verification on, "0", "false", "no", "off" and empty value turn it off, case-insensitive.
+// Other values are an error, so typos do not silently disable TLS.
+func ParseTLSVerify(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true, nil
+	case "0", "false", "no", "off", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid %s value %q, expected one of 1, true, yes, on, 0, false, no, off", DockerTLSVerifyEnv, value)
+}
+
+// NewDockerClientFromConfig returns a new docker client connection with given config.
+// Besides of the tcp:// and unix:// hosts handled by dockerclient.NewFromConfig it also
+// understands ssh://[user@]host[:port][/path/to/docker.sock] hosts. For those, the remote
+// docker socket is forwarded to a local one by the `ssh` binary, so the user's ssh config,
+// agent and known_hosts are respected. TLS options and cert files are not used in this mode.
+//
+// When TLS is on, the cert files are checked before connecting, so a wrong DOCKER_CERT_PATH
+// is reported clearly instead of failing somewhere in the TLS handshake.
+//
+// Callers should defer CloseDockerClient, the ssh tunnel is not closed otherwise.
+func NewDockerClientFromConfig(config *DockerClientConfig) (*docker.Client, error) {
+	client, err := newDockerClient(config)
+	if err != nil {
+		return nil, err
+	}
+	setClientTimeouts(client, config)
+	return client, nil
+}
+
+func newDockerClient(config *DockerClientConfig) (*docker.Client, error) {
+	// the conventional socket is used if the host is not given, it has to exist
+	if config.Host == "" {
+		withHost := *config
+		withHost.Host = defaultDockerHost()
+		config = &withHost
+	}
+	if config.Host == "" {
+		return nil, fmt.Errorf("Docker daemon address is not set; set %s to the tcp address of the daemon, e.g. tcp://localhost:2375",
+			DockerHostEnv)
+	}
+	if err := checkDockerHost(config.Host); err != nil {
+		return nil, err
+	}
+
+	if isSSHHost(config.Host) {
+		return newSSHDockerClient(config.Host, config.APIVersion)
+	}
+
+	tlsConfig := &config.Config
+	if config.Tlsverify {
+		var err error
+		if tlsConfig, err = checkTLSFiles(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.APIVersion == "" {
+		return dockerclient.NewFromConfig(tlsConfig)
+	}
+
+	var (
+		client *docker.Client
+		err    error
+	)
+	if tlsConfig.Tlsverify {
+		client, err = docker.NewVersionedTLSClient(tlsConfig.Host, tlsConfig.Tlscert, tlsConfig.Tlskey, tlsConfig.Tlscacert, config.APIVersion)
+	} else {
+		client, err = docker.NewVersionedClient(tlsConfig.Host, config.APIVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setDockerAPIVersion(client, config.APIVersion)
+	return client, nil
+}
+
+// setDockerAPIVersion remembers the pinned API version of the client, see dockerAPIVersion
+func setDockerAPIVersion(client *docker.Client, apiVersion string) {
+	dockerAPIVersionsMu.Lock()
+	defer dockerAPIVersionsMu.Unlock()
+	dockerAPIVersions[client.Endpoint()] = apiVersion
+}
+
+// dockerAPIVersion returns the API version the client was pinned to by NewDockerClientFromConfig,
+// or empty string for the default version
+func dockerAPIVersion(client *docker.Client) string {
+	dockerAPIVersionsMu.Lock()
+	defer dockerAPIVersionsMu.Unlock()
+	return dockerAPIVersions[client.Endpoint()]
+}
+
+// defaultDockerHost returns the conventional unix socket of the docker daemon, or empty
+// string on Windows: the named pipe of the daemon is not supported by the docker client
+func defaultDockerHost() string {
+	if hostOS == "windows" {
+		return ""
+	}
+	return "unix://" + defaultDockerSocket
+}
+
+// checkDockerHost makes sure the conventional unix socket exists if the host is that socket,
+// so a host without the daemon gets a hint about DOCKER_HOST rather than a cryptic dial error
+// on the first API call. Named pipes of the daemon on Windows are not supported by the
+// docker client, DOCKER_HOST has to point to a tcp address there.
+func checkDockerHost(host string) error {
+	if strings.HasPrefix(host, "npipe://") {
+		return fmt.Errorf("Docker daemon named pipe %s is not supported; set %s to the tcp address of the daemon, e.g. tcp://localhost:2375",
+			host, DockerHostEnv)
+	}
+	if host != "unix://"+defaultDockerSocket {
+		return nil
+	}
+	if _, err := os.Stat(defaultDockerSocket); err != nil {
+		return fmt.Errorf("Docker daemon socket %s is not available, error: %s; make sure the docker daemon is running or set %s to its address, e.g. tcp://docker.example.com:2376",
+			defaultDockerSocket, err, DockerHostEnv)
+	}
+	return nil
+}
+
+// setClientTimeouts applies the dial and response header timeouts of the config to the
+// http transport of the client, so a dead daemon connection fails instead of hanging.
+// The dialer of the client is updated as well, it is used for unix sockets and for
+// hijacked connections, e.g. attach.
+func setClientTimeouts(client *docker.Client, config *DockerClientConfig) {
+	if config.DialTimeout > 0 && client.Dialer != nil {
+		client.Dialer.Timeout = config.DialTimeout
+	}
+
+	if client.HTTPClient == nil {
+		return
+	}
+	tr, ok := client.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return
+	}
+
+	if config.DialTimeout > 0 {
+		tr.Dial = (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		tr.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+}
+
+// NewDockerClientWithPing is the same as NewDockerClientFromConfig but also pings the daemon
+// within the given timeout, so an unreachable daemon is reported right away rather than
+// on the first API call.
+func NewDockerClientWithPing(config *DockerClientConfig, timeout time.Duration) (*docker.Client, error) {
+	client, err := NewDockerClientFromConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := dockerclient.Ping(client, int(timeout/time.Millisecond)); err != nil {
+		closeSSHTunnel(client)
+		return nil, fmt.Errorf("Cannot connect to the Docker daemon at %s, is it running? Error: %s", config.Host, err)
+	}
+
+	return client, nil
+}
+
+// checkTLSFiles returns a copy of the config with "~" expanded in the cert paths,
+// it fails if any of the cert files is missing or not readable
+func checkTLSFiles(config *dockerclient.Config) (*dockerclient.Config, error) {
+	result := *config
+
+	files := []struct {
+		name string
+		path *string
+	}{
+		{"CA certificate", &result.Tlscacert},
+		{"certificate", &result.Tlscert},
+		{"key", &result.Tlskey},
+	}
+
+	for _, file := range files {
+		path, err := homedir.Expand(*file.path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to expand TLS %s path %s, error: %s", file.name, *file.path, err)
+		}
+		*file.path = path
+
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("TLS %s file %s cannot be read (DOCKER_CERT_PATH=%q), error: %s",
+				file.name, path, os.Getenv("DOCKER_CERT_PATH"), err)
+		}
+		f.Close()
+	}
+
+	return &result, nil
+}
+
+func isSSHHost(host string) bool {
+	return strings.HasPrefix(host, sshScheme)
+}
+
+// parseSSHHost extracts user, host, port and the remote socket path from ssh:// url
+func parseSSHHost(host string) (user, hostname, port, socket string, err error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("Failed to parse docker host %s, error: %s", host, err)
+	}
+	if u.Scheme != "ssh" || u.Host == "" {
+		return "", "", "", "", fmt.Errorf("Invalid ssh docker host %s, expected ssh://[user@]host[:port]", host)
+	}
+
+	if u.User != nil {
+		user = u.User.Username()
+	}
+
+	hostname = u.Host
+	if strings.Contains(u.Host, ":") {
+		if hostname, port, err = net.SplitHostPort(u.Host); err != nil {
+			return "", "", "", "", fmt.Errorf("Failed to parse docker host %s, error: %s", host, err)
+		}
+	}
+
+	socket = u.Path
+	if socket == "" || socket == "/" {
+		socket = sshRemoteSocket
+	}
+
+	return user, hostname, port, socket, nil
+}
+
+func newSSHDockerClient(host, apiVersion string) (*docker.Client, error) {
+	tunnel, err := openSSHTunnel(host)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := docker.NewVersionedClient("unix://"+tunnel.socket, apiVersion)
+	if err != nil {
+		tunnel.close()
+		return nil, err
+	}
+
+	sshTunnelsMu.Lock()
+	sshTunnels[client.Endpoint()] = tunnel
+	sshTunnelsMu.Unlock()
+	setDockerAPIVersion(client, apiVersion)
+
+	return client, nil
+}
+
+func openSSHTunnel(host string) (*sshTunnel, error) {
+	user, hostname, port, remoteSocket, err := parseSSHHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "rocker-compose-ssh")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create directory for ssh tunnel socket, error: %s", err)
+	}
+
+	tunnel := &sshTunnel{
+		dir:    dir,
+		socket: filepath.Join(dir, "docker.sock"),
+	}
+
+	args := []string{"-nNT", "-o", "ExitOnForwardFailure=yes", "-L", tunnel.socket + ":" + remoteSocket}
+	if user != "" {
+		args = append(args, "-l", user)
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", hostname)
+
+	log.Debugf("Opening ssh tunnel to docker host %s: ssh %s", host, strings.Join(args, " "))
+
+	tunnel.cmd = exec.Command("ssh", args...)
+	tunnel.cmd.Stderr = log.StandardLogger().Writer()
+
+	if err := tunnel.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Failed to start ssh tunnel to %s, error: %s", host, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- tunnel.cmd.Wait()
+	}()
+
+	timeout := time.After(sshTunnelWaitPeriod)
+
+	// wait until ssh creates the forwarded socket
+	for {
+		if _, err := os.Stat(tunnel.socket); err == nil {
+			return tunnel, nil
+		}
+
+		select {
+		case err := <-exited:
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("ssh tunnel to %s exited unexpectedly, error: %v", host, err)
+		case <-timeout:
+			tunnel.close()
+			return nil, fmt.Errorf("Timeout waiting for ssh tunnel to %s, waited %s", host, sshTunnelWaitPeriod)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// CloseDockerClient releases the resources held by the client made by NewDockerClientFromConfig:
+// the ssh tunnel process of ssh:// hosts is killed and its socket is removed, idle connections
+// are closed. It does nothing else for other clients. Callers that create many short-lived
+// clients, e.g. a long-running server, should defer it right after the client is created.
+func CloseDockerClient(client *docker.Client) error {
+	if client == nil {
+		return nil
+	}
+	if client.HTTPClient != nil {
+		if tr, ok := client.HTTPClient.Transport.(*http.Transport); ok {
+			tr.CloseIdleConnections()
+		}
+	}
+	return closeSSHTunnel(client)
+}
+
+// closeSSHTunnel closes the ssh tunnel of the client if there is any
+func closeSSHTunnel(client *docker.Client) error {
+	sshTunnelsMu.Lock()
+	tunnel, ok := sshTunnels[client.Endpoint()]
+	delete(sshTunnels, client.Endpoint())
+	sshTunnelsMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return tunnel.close()
+}
+
+func (t *sshTunnel) close() error {
+	var err error
+	if t.cmd != nil && t.cmd.Process != nil {
+		err = t.cmd.Process.Kill()
+	}
+	if err2 := os.RemoveAll(t.dir); err2 != nil && err == nil {
+		err = err2
+	}
+	return err
+}
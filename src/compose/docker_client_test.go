@@ -0,0 +1,460 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/mitchellh/go-homedir"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSSHHost(t *testing.T) {
+	user, host, port, socket, err := parseSSHHost("ssh://deploy@docker.example.com:2222")
+	assert.Nil(t, err)
+	assert.Equal(t, "deploy", user)
+	assert.Equal(t, "docker.example.com", host)
+	assert.Equal(t, "2222", port)
+	assert.Equal(t, "/var/run/docker.sock", socket)
+}
+
+func TestParseSSHHostDefaults(t *testing.T) {
+	user, host, port, socket, err := parseSSHHost("ssh://docker.example.com/run/user/docker.sock")
+	assert.Nil(t, err)
+	assert.Equal(t, "", user)
+	assert.Equal(t, "docker.example.com", host)
+	assert.Equal(t, "", port)
+	assert.Equal(t, "/run/user/docker.sock", socket)
+}
+
+func TestParseSSHHostInvalid(t *testing.T) {
+	_, _, _, _, err := parseSSHHost("ssh://")
+	assert.Error(t, err)
+}
+
+func TestNewDockerClientConfigSSHSkipsTLS(t *testing.T) {
+	defer os.Setenv("DOCKER_HOST", os.Getenv("DOCKER_HOST"))
+	defer os.Setenv("DOCKER_TLS_VERIFY", os.Getenv("DOCKER_TLS_VERIFY"))
+
+	os.Setenv("DOCKER_HOST", "ssh://deploy@docker.example.com")
+	os.Setenv("DOCKER_TLS_VERIFY", "1")
+
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "ssh://deploy@docker.example.com", config.Host)
+	assert.False(t, config.Tlsverify)
+}
+
+func TestNewDockerClientConfigDefaultHost(t *testing.T) {
+	defer os.Setenv("DOCKER_HOST", os.Getenv("DOCKER_HOST"))
+
+	os.Setenv("DOCKER_HOST", "tcp://docker.example.com:2376")
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "tcp://docker.example.com:2376", config.Host)
+
+	os.Setenv("DOCKER_HOST", "")
+	config, err = NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultDockerHost(), config.Host)
+}
+
+func TestNewDockerClientConfigWindowsHost(t *testing.T) {
+	defer os.Setenv("DOCKER_HOST", os.Getenv("DOCKER_HOST"))
+	defer func(goos string) { hostOS = goos }(hostOS)
+
+	hostOS = "windows"
+	os.Setenv("DOCKER_HOST", "")
+
+	// the named pipe is not defaulted to, the host has to be given
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "", config.Host)
+
+	_, err = NewDockerClientFromConfig(config)
+	assert.EqualError(t, err, "Docker daemon address is not set; set DOCKER_HOST to the tcp address of the daemon, e.g. tcp://localhost:2375")
+}
+
+func TestNewDockerClientDefaultSocket(t *testing.T) {
+	defer func(goos string) { hostOS = goos }(hostOS)
+	defer func(socket string) { defaultDockerSocket = socket }(defaultDockerSocket)
+
+	hostOS = "linux"
+
+	dir, err := ioutil.TempDir("", "rocker-compose-socket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultDockerSocket = filepath.Join(dir, "docker.sock")
+
+	_, err = NewDockerClientFromConfig(&DockerClientConfig{})
+	assert.EqualError(t, err, "Docker daemon socket "+defaultDockerSocket+" is not available, error: stat "+defaultDockerSocket+
+		": no such file or directory; make sure the docker daemon is running or set DOCKER_HOST to its address, e.g. tcp://docker.example.com:2376")
+
+	if err := ioutil.WriteFile(defaultDockerSocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &DockerClientConfig{}
+	client, err := NewDockerClientFromConfig(config)
+	assert.Nil(t, err)
+	assert.Equal(t, "unix://"+defaultDockerSocket, client.Endpoint())
+	assert.Equal(t, "", config.Host)
+}
+
+func TestNewDockerClientNamedPipe(t *testing.T) {
+	config := &DockerClientConfig{}
+	config.Host = "npipe:////./pipe/docker_engine"
+
+	_, err := NewDockerClientFromConfig(config)
+	assert.EqualError(t, err, "Docker daemon named pipe npipe:////./pipe/docker_engine is not supported; "+
+		"set DOCKER_HOST to the tcp address of the daemon, e.g. tcp://localhost:2375")
+}
+
+func TestNewDockerClientFromConfigMissingTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-test-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"ca.pem", "cert.pem"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = NewDockerClientFromConfig(&DockerClientConfig{Config: dockerclient.Config{
+		Host:      "tcp://127.0.0.1:2376",
+		Tlsverify: true,
+		Tlscacert: filepath.Join(dir, "ca.pem"),
+		Tlscert:   filepath.Join(dir, "cert.pem"),
+		Tlskey:    filepath.Join(dir, "key.pem"),
+	}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "TLS key file "+filepath.Join(dir, "key.pem")+" cannot be read")
+	}
+}
+
+func TestCheckTLSFilesExpandsHome(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer func(disable bool) { homedir.DisableCache = disable }(homedir.DisableCache)
+
+	home, err := ioutil.TempDir("", "rocker-compose-test-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	if err := os.Mkdir(filepath.Join(home, ".docker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ca.pem", "cert.pem", "key.pem"} {
+		if err := ioutil.WriteFile(filepath.Join(home, ".docker", name), []byte("test"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	os.Setenv("HOME", home)
+	homedir.DisableCache = true
+
+	config, err := checkTLSFiles(&dockerclient.Config{
+		Tlsverify: true,
+		Tlscacert: "~/.docker/ca.pem",
+		Tlscert:   "~/.docker/cert.pem",
+		Tlskey:    "~/.docker/key.pem",
+	})
+	if assert.Nil(t, err) {
+		assert.Equal(t, filepath.Join(home, ".docker", "key.pem"), config.Tlskey)
+	}
+}
+
+func TestNewDockerClientConfigExpandsCertPath(t *testing.T) {
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("DOCKER_CERT_PATH", os.Getenv("DOCKER_CERT_PATH"))
+	defer func(disable bool) { homedir.DisableCache = disable }(homedir.DisableCache)
+
+	os.Setenv("HOME", "/home/deploy")
+	os.Setenv("DOCKER_CERT_PATH", "~/foo")
+	homedir.DisableCache = true
+
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/deploy/foo/ca.pem", config.Tlscacert)
+	assert.Equal(t, "/home/deploy/foo/cert.pem", config.Tlscert)
+	assert.Equal(t, "/home/deploy/foo/key.pem", config.Tlskey)
+
+	os.Setenv("DOCKER_CERT_PATH", "certs")
+
+	config, err = NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "certs/ca.pem", config.Tlscacert)
+}
+
+func TestNewDockerClientWithPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+
+	client, err := NewDockerClientWithPing(&DockerClientConfig{Config: dockerclient.Config{Host: server.URL}}, time.Second)
+	assert.Nil(t, err)
+	assert.NotNil(t, client)
+
+	server.Close()
+
+	_, err = NewDockerClientWithPing(&DockerClientConfig{Config: dockerclient.Config{Host: server.URL}}, time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Cannot connect to the Docker daemon at "+server.URL+", is it running?")
+	}
+}
+
+func TestNewDockerClientAPIVersion(t *testing.T) {
+	defer os.Setenv("DOCKER_API_VERSION", os.Getenv("DOCKER_API_VERSION"))
+
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/version") {
+			fmt.Fprint(w, `{"ApiVersion":"1.21"}`)
+			return
+		}
+		path = r.URL.Path
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+
+	os.Setenv("DOCKER_API_VERSION", "1.21")
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "1.21", config.APIVersion)
+
+	config.Host = server.URL
+	client, err := NewDockerClientFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, client.Ping())
+	assert.Equal(t, "/v1.21/_ping", path)
+
+	os.Setenv("DOCKER_API_VERSION", "")
+	config, err = NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "", config.APIVersion)
+}
+
+func TestNewDockerClientTimeouts(t *testing.T) {
+	config := &DockerClientConfig{
+		Config: dockerclient.Config{Host: "tcp://127.0.0.1:2375"},
+	}
+
+	client, err := NewDockerClientFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := client.HTTPClient.Transport.(*http.Transport)
+	assert.Equal(t, time.Duration(0), tr.ResponseHeaderTimeout)
+	assert.Equal(t, time.Duration(0), client.Dialer.Timeout)
+
+	config.DialTimeout = 5 * time.Second
+	config.ResponseHeaderTimeout = time.Minute
+
+	client, err = NewDockerClientFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr = client.HTTPClient.Transport.(*http.Transport)
+	assert.Equal(t, time.Minute, tr.ResponseHeaderTimeout)
+	assert.NotNil(t, tr.Dial)
+	assert.Equal(t, 5*time.Second, client.Dialer.Timeout)
+}
+
+func TestParseTLSVerify(t *testing.T) {
+	tests := []struct {
+		value  string
+		verify bool
+		valid  bool
+	}{
+		{"1", true, true},
+		{"true", true, true},
+		{"TRUE", true, true},
+		{"yes", true, true},
+		{"On", true, true},
+		{"0", false, true},
+		{"false", false, true},
+		{"False", false, true},
+		{"no", false, true},
+		{"off", false, true},
+		{"", false, true},
+		{"ture", false, false},
+		{"2", false, false},
+	}
+
+	for _, test := range tests {
+		verify, err := ParseTLSVerify(test.value)
+		assert.Equal(t, test.verify, verify, test.value)
+		assert.Equal(t, test.valid, err == nil, test.value)
+	}
+}
+
+func TestNewDockerClientConfigInvalidTLSVerify(t *testing.T) {
+	defer os.Setenv("DOCKER_TLS_VERIFY", os.Getenv("DOCKER_TLS_VERIFY"))
+
+	os.Setenv("DOCKER_TLS_VERIFY", "ture")
+	_, err := NewDockerClientConfig()
+	assert.EqualError(t, err, `Invalid DOCKER_TLS_VERIFY value "ture", expected one of 1, true, yes, on, 0, false, no, off`)
+
+	os.Setenv("DOCKER_TLS_VERIFY", "true")
+	config, err := NewDockerClientConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, !isSSHHost(config.Host), config.Tlsverify)
+}
+
+func TestCloseDockerClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-ssh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+
+	client, err := docker.NewClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshTunnelsMu.Lock()
+	sshTunnels[client.Endpoint()] = &sshTunnel{dir: dir, socket: socket}
+	sshTunnelsMu.Unlock()
+
+	assert.Nil(t, CloseDockerClient(client))
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err), "tunnel directory should be removed")
+
+	sshTunnelsMu.Lock()
+	_, ok := sshTunnels[client.Endpoint()]
+	sshTunnelsMu.Unlock()
+	assert.False(t, ok, "tunnel should be forgotten")
+
+	// closing again and closing clients without a tunnel is a no-op
+	assert.Nil(t, CloseDockerClient(client))
+	assert.Nil(t, (&DockerClient{Docker: client}).Close())
+	assert.Nil(t, CloseDockerClient(nil))
+}
+
+func TestBoundedDockerClientAPIVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-compose-socket-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make(chan string, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	client, err := NewDockerClientFromConfig(&DockerClientConfig{
+		Config:     dockerclient.Config{Host: "unix://" + socket},
+		APIVersion: "1.21",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	// the unix socket client is made anew, it keeps the pinned version
+	bounded, err := boundedDockerClient(client, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bounded.InspectContainer("abc"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/v1.21/containers/abc/json", <-paths)
+}
+
+func TestInterpolateDockerClientConfig(t *testing.T) {
+	defer os.Unsetenv("TEST_DEPLOY_DOCKER_HOST")
+	defer os.Unsetenv("TEST_DEPLOY_CERTS")
+	os.Setenv("TEST_DEPLOY_DOCKER_HOST", "tcp://10.0.0.1:2376")
+	os.Setenv("TEST_DEPLOY_CERTS", "/etc/deploy")
+
+	config := &DockerClientConfig{
+		Config: dockerclient.Config{
+			Host:      "${TEST_DEPLOY_DOCKER_HOST}",
+			Tlscacert: "${TEST_DEPLOY_CERTS}/ca.pem",
+			Tlscert:   "${TEST_DEPLOY_CERTS}/cert.pem",
+			Tlskey:    "/literal/$TEST_DEPLOY_CERTS/key.pem",
+		},
+		APIVersion: "1.21",
+	}
+
+	result, err := InterpolateDockerClientConfig(config, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "tcp://10.0.0.1:2376", result.Host)
+	assert.Equal(t, "/etc/deploy/ca.pem", result.Tlscacert)
+	assert.Equal(t, "/etc/deploy/cert.pem", result.Tlscert)
+	assert.Equal(t, "/literal/$TEST_DEPLOY_CERTS/key.pem", result.Tlskey)
+	assert.Equal(t, "1.21", result.APIVersion)
+
+	// the original config is not changed
+	assert.Equal(t, "${TEST_DEPLOY_DOCKER_HOST}", config.Host)
+}
+
+func TestInterpolateDockerClientConfigUndefined(t *testing.T) {
+	os.Unsetenv("TEST_UNDEFINED_DOCKER_HOST")
+
+	config := &DockerClientConfig{
+		Config: dockerclient.Config{Host: "tcp://${TEST_UNDEFINED_DOCKER_HOST}:2376"},
+	}
+
+	_, err := InterpolateDockerClientConfig(config, false)
+	assert.EqualError(t, err, `Undefined environment variable TEST_UNDEFINED_DOCKER_HOST in docker host "tcp://${TEST_UNDEFINED_DOCKER_HOST}:2376"`)
+
+	result, err := InterpolateDockerClientConfig(config, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "tcp://${TEST_UNDEFINED_DOCKER_HOST}:2376", result.Host)
+}
@@ -18,11 +18,29 @@ package compose
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/fsouza/go-dockerclient"
 	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
 )
 
 func TestEntrypointOverride(t *testing.T) {
@@ -86,3 +104,1959 @@ func TestEntrypointOverride(t *testing.T) {
 		t.Fatal(fmt.Errorf("Failed to run container, exit with code %d", statusCode))
 	}
 }
+
+func TestRetryPolicyDefaults(t *testing.T) {
+	p := RetryPolicy{}.withDefaults()
+	assert.Equal(t, 3, p.MaxAttempts)
+	assert.Equal(t, 1*time.Second, p.InitialBackoff)
+	assert.Equal(t, 2.0, p.Multiplier)
+
+	assert.Equal(t, 2, p.MaxResets)
+
+	p = RetryPolicy{MaxAttempts: 1, InitialBackoff: time.Millisecond, Multiplier: 3, MaxResets: 5}.withDefaults()
+	assert.Equal(t, 1, p.MaxAttempts)
+	assert.Equal(t, time.Millisecond, p.InitialBackoff)
+	assert.Equal(t, 3.0, p.Multiplier)
+	assert.Equal(t, 5, p.MaxResets)
+
+	// the restarts are off unless asked for in a policy of its own
+	p = RetryPolicy{MaxAttempts: 5}.withDefaults()
+	assert.Equal(t, 5, p.MaxAttempts)
+	assert.Equal(t, 0, p.MaxResets)
+}
+
+func TestIsConnectionReset(t *testing.T) {
+	wrap := func(err error) error { return &pullAttemptError{message: "wrapped", cause: err} }
+
+	assert.True(t, isConnectionReset(wrap(&net.OpError{Op: "read", Net: "unix", Err: syscall.ECONNRESET})))
+	assert.True(t, isConnectionReset(wrap(io.EOF)))
+	assert.True(t, isConnectionReset(wrap(io.ErrUnexpectedEOF)))
+	assert.True(t, isConnectionReset(wrap(errors.New("read tcp 10.0.0.1:2376: connection reset by peer"))))
+
+	assert.False(t, isConnectionReset(wrap(errPullTimeout)))
+	assert.False(t, isConnectionReset(wrap(&docker.Error{Status: 500})))
+	assert.False(t, isConnectionReset(&PullError{Message: "read: connection reset by peer"}))
+	assert.False(t, isConnectionReset(io.EOF))
+}
+
+// resettingPullAPI fails the first pulls the way a dropped daemon socket does
+type resettingPullAPI struct {
+	fakeDockerAPI
+	resets int
+}
+
+func (f *resettingPullAPI) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	if f.resets > 0 {
+		f.resets--
+		f.pulled = append(f.pulled, opts.Repository+":"+opts.Tag)
+		return &net.OpError{Op: "read", Net: "unix", Err: syscall.ECONNRESET}
+	}
+	return f.fakeDockerAPI.PullImage(opts, auth)
+}
+
+func TestPullDockerImageConnectionReset(t *testing.T) {
+	// resets do not count as attempts, so even a single retry is enough
+	client := &resettingPullAPI{resets: 2}
+	opts := PullOptions{Retry: RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Hour, MaxResets: 2}}
+
+	_, err := PullDockerImageWithOptions(client, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test/app:1", "test/app:1", "test/app:1"}, client.pulled)
+
+	// no restarts if retries are disabled
+	client = &resettingPullAPI{resets: 1}
+	opts.Retry.MaxAttempts = 1
+
+	_, err = PullDockerImageWithOptions(client, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.EqualError(t, err, "Failed to pull image test/app:1, error: read unix: connection reset by peer")
+	assert.Equal(t, []string{"test/app:1"}, client.pulled)
+
+	// with the restarts disabled the reset is an attempt of its own
+	client = &resettingPullAPI{resets: 1}
+	opts.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxResets: 0}
+
+	result, err := PullDockerImageWithOptions(client, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test/app:1", "test/app:1"}, client.pulled)
+	if assert.Len(t, result.Warnings, 1) {
+		assert.Contains(t, result.Warnings[0].Message, "attempt 1/2")
+	}
+}
+
+func TestIsRetryablePullError(t *testing.T) {
+	wrap := func(err error) error {
+		return &pullAttemptError{message: err.Error(), cause: err}
+	}
+
+	assert.True(t, isRetryablePullError(wrap(&docker.Error{Status: 500})))
+	assert.True(t, isRetryablePullError(wrap(&docker.Error{Status: 503})))
+	assert.True(t, isRetryablePullError(wrap(io.ErrUnexpectedEOF)))
+	assert.True(t, isRetryablePullError(wrap(&jsonmessage.JSONError{Message: "received unexpected HTTP status: 500 Internal Server Error"})))
+
+	assert.False(t, isRetryablePullError(wrap(&docker.Error{Status: 404})))
+	assert.False(t, isRetryablePullError(wrap(&docker.Error{Status: 401})))
+	assert.False(t, isRetryablePullError(wrap(&jsonmessage.JSONError{Message: "unauthorized: authentication required"})))
+	assert.False(t, isRetryablePullError(wrap(&jsonmessage.JSONError{Message: "manifest for foo:1.0 not found"})))
+	assert.False(t, isRetryablePullError(wrap(&jsonmessage.JSONError{Code: 403, Message: "forbidden"})))
+	assert.False(t, isRetryablePullError(errors.New("Failed to authenticate registry")))
+}
+
+func TestPullDockerImageCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := PullDockerImageWithOptions(nil, imagename.NewFromString("alpine:3.2"), nil, PullOptions{Context: ctx})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestGetBridgeIPCached(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	cli, err := docker.NewClient("unix:///var/run/rocker-compose-test.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bridgeIPCache.ips[cli.Endpoint()+"#bridge"] = "172.17.42.1"
+
+	ip, err := GetBridgeIP(cli)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.17.42.1", ip)
+
+	ResetBridgeIPCache()
+	assert.Empty(t, bridgeIPCache.ips)
+}
+
+func TestGetNetworkGatewayIPFromInspect(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/networks/custom" {
+			t.Fatalf("Unexpected request %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"Name":"custom","IPAM":{"Config":[{"Subnet":"172.18.0.0/16","Gateway":"172.18.0.1/16"}]}}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := GetNetworkGatewayIP(cli, "custom")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.18.0.1", ip)
+}
+
+func TestGetNetworkGatewayIPConcurrent(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	var (
+		inspects int32
+		release  = make(chan struct{})
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&inspects, 1)
+		<-release
+		fmt.Fprint(w, `{"Name":"custom","IPAM":{"Config":[{"Gateway":"172.18.0.1"}]}}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := GetNetworkGatewayIP(cli, "custom")
+			assert.Nil(t, err)
+			assert.Equal(t, "172.18.0.1", ip)
+		}()
+	}
+
+	// the cache of other keys is not blocked by the lookup in flight
+	for atomic.LoadInt32(&inspects) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	bridgeIPCache.mu.Lock()
+	bridgeIPCache.ips[cli.Endpoint()+"#other"] = "172.19.0.1"
+	bridgeIPCache.mu.Unlock()
+	ip, err := GetNetworkGatewayIP(cli, "other")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.19.0.1", ip)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&inspects))
+}
+
+func TestGetNetworkGatewayIPFromContainer(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/networks/custom":
+			// no IPAM gateway reported, so the dummy container is used
+			fmt.Fprint(w, `{"Name":"custom","IPAM":{"Config":[]}}`)
+		case r.URL.Path == "/containers/create":
+			body := struct {
+				HostConfig docker.HostConfig
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "custom", body.HostConfig.NetworkMode)
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"dummy"}`)
+		case r.URL.Path == "/containers/dummy/json":
+			fmt.Fprint(w, `{"Id":"dummy","NetworkSettings":{"Gateway":"","Networks":{"custom":{"Gateway":"172.19.0.1"}}}}`)
+		case strings.HasPrefix(r.URL.Path, "/images/"):
+			fmt.Fprint(w, `{"Id":"alpine"}`)
+		case r.URL.Path == "/containers/json":
+			fmt.Fprint(w, `[]`)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := GetNetworkGatewayIP(cli, "custom")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.19.0.1", ip)
+}
+
+func TestGetBridgeIPPullsImageWithAuth(t *testing.T) {
+	defer ResetBridgeIPCache()
+	defer func() { BridgeImageAuth = nil }()
+
+	BridgeImageAuth = &docker.AuthConfigurations{Configs: map[string]docker.AuthConfiguration{
+		"*": docker.AuthConfiguration{Username: "mirror", Password: "secret"},
+	}}
+
+	var (
+		pulled   bool
+		username string
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/networks/bridge":
+			w.WriteHeader(http.StatusNotFound)
+		case r.URL.Path == "/images/create":
+			pulled = true
+			auth := docker.AuthConfiguration{}
+			data, err := base64.URLEncoding.DecodeString(r.Header.Get("X-Registry-Auth"))
+			if err == nil {
+				json.Unmarshal(data, &auth)
+			}
+			username = auth.Username
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+		case r.URL.Path == "/images/json":
+			fmt.Fprint(w, `[{"Id":"b","RepoTags":["busybox:latest"]}]`)
+		case strings.HasPrefix(r.URL.Path, "/images/"):
+			if !pulled {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `{"Id":"alpine"}`)
+		case r.URL.Path == "/containers/create":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"dummy"}`)
+		case r.URL.Path == "/containers/dummy/json":
+			fmt.Fprint(w, `{"Id":"dummy","NetworkSettings":{"Gateway":"172.17.42.1"}}`)
+		case r.URL.Path == "/containers/json":
+			fmt.Fprint(w, `[]`)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := GetBridgeIP(cli)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.17.42.1", ip)
+	assert.True(t, pulled)
+	assert.Equal(t, "mirror", username)
+}
+
+func TestEnsureBridgeImage(t *testing.T) {
+	defer func(alternatives []string) { BridgeImageAlternatives = alternatives }(BridgeImageAlternatives)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/json":
+			fmt.Fprint(w, `[{"Id":"a","RepoTags":["busybox:1.24","alpine:3.4"]},{"Id":"b","RepoTags":["alpine:edge"]}]`)
+		case "/images/create":
+			t.Fatalf("Unexpected pull, an alternative image is present")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any tag of alpine
+	image, err := ensureBridgeImage(cli)
+	assert.Nil(t, err)
+	assert.Equal(t, "alpine:3.4", image)
+
+	BridgeImageAlternatives = []string{"alpine:edge", "busybox"}
+
+	image, err = ensureBridgeImage(cli)
+	assert.Nil(t, err)
+	assert.Equal(t, "alpine:edge", image)
+}
+
+func TestEnsureBridgeImagePullDisabled(t *testing.T) {
+	defer func() { BridgeImagePullDisabled = false }()
+	BridgeImagePullDisabled = true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/json":
+			fmt.Fprint(w, `[{"Id":"a","RepoTags":["busybox:1.24"]}]`)
+		case "/images/create":
+			t.Fatalf("Unexpected pull, pulling is disabled")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ensureBridgeImage(cli)
+	assert.True(t, errors.Is(err, ErrBridgeImagePullDisabled), "unexpected error %v", err)
+}
+
+func TestIsNoSuchImage(t *testing.T) {
+	assert.True(t, isNoSuchImage(docker.ErrNoSuchImage))
+	assert.True(t, isNoSuchImage(fmt.Errorf("inspect failed: %w", docker.ErrNoSuchImage)))
+	assert.True(t, isNoSuchImage(&docker.Error{Status: http.StatusNotFound, Message: "not found"}))
+	assert.True(t, isNoSuchImage(errors.New("No such image: gliderlabs/alpine:3.2")))
+
+	assert.False(t, isNoSuchImage(nil))
+	assert.False(t, isNoSuchImage(&docker.Error{Status: http.StatusInternalServerError, Message: "server error"}))
+	assert.False(t, isNoSuchImage(errors.New("connection refused")))
+}
+
+func TestEnsureBridgeImageMissing(t *testing.T) {
+	defer func(alternatives []string) { BridgeImageAlternatives = alternatives }(BridgeImageAlternatives)
+	BridgeImageAlternatives = nil
+
+	// daemons answer with 404 and either of the messages
+	for _, message := range []string{"no such image", "No such image: gliderlabs/alpine:3.2"} {
+		pulled := false
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/images/create":
+				pulled = true
+				fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+			case pulled:
+				fmt.Fprint(w, `{"Id":"alpine"}`)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, message)
+			}
+		}))
+
+		cli, err := docker.NewClient(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		image, err := ensureBridgeImage(cli)
+		assert.Nil(t, err, message)
+		assert.Equal(t, bridgeImageName(), image)
+		assert.True(t, pulled, message)
+
+		server.Close()
+	}
+}
+
+func TestGetNetworkGatewayIPWithContainer(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/networks/custom":
+			fmt.Fprint(w, `{"Name":"custom","IPAM":{"Config":[]}}`)
+		case "/containers/managed/json":
+			fmt.Fprint(w, `{"Id":"managed","State":{"Running":true},"NetworkSettings":{"Networks":{"custom":{"Gateway":"172.20.0.1"}}}}`)
+		default:
+			t.Fatalf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := GetNetworkGatewayIPWithContainer(cli, "custom", "managed")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.20.0.1", ip)
+}
+
+func TestContainerNetworkGateway(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/containers/stopped/json":
+			fmt.Fprint(w, `{"Id":"stopped","State":{"Running":false},"NetworkSettings":{"Networks":{"custom":{"Gateway":"172.20.0.1"}}}}`)
+		case "/containers/old/json":
+			fmt.Fprint(w, `{"Id":"old","State":{"Running":true},"NetworkSettings":{"Gateway":"172.17.42.1"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := containerNetworkGateway(cli, "stopped", "custom")
+	assert.Nil(t, err)
+	assert.Equal(t, "", ip)
+
+	ip, err = containerNetworkGateway(cli, "old", "bridge")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.17.42.1", ip)
+
+	ip, err = containerNetworkGateway(cli, "old", "custom")
+	assert.Nil(t, err)
+	assert.Equal(t, "", ip)
+
+	_, err = containerNetworkGateway(cli, "missing", "custom")
+	assert.NotNil(t, err)
+}
+
+func TestPullProgressWriter(t *testing.T) {
+	type progress struct {
+		layer          string
+		current, total int64
+		status         string
+	}
+	calls := []progress{}
+
+	w := &pullProgressWriter{fn: func(layer string, current, total int64, status string) {
+		calls = append(calls, progress{layer, current, total, status})
+	}}
+
+	stream := "{\"status\":\"Pulling from library/alpine\",\"id\":\"3.2\"}\r\n" +
+		"{\"status\":\"Downloading\",\"progressDetail\":{\"current\":512,\"total\":2048},\"id\":\"8f13703509f7\"}\r\n" +
+		"{\"status\":\"Pull complete\",\"progressDetail\":{},\"id\":\"8f13703509f7\"}\r\n"
+
+	// feed the stream in small chunks, so messages are split across writes
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		n, err := w.Write([]byte(stream[i:end]))
+		assert.Nil(t, err)
+		assert.Equal(t, end-i, n)
+	}
+
+	assert.Equal(t, []progress{
+		{"3.2", 0, 0, "Pulling from library/alpine"},
+		{"8f13703509f7", 512, 2048, "Downloading"},
+		{"8f13703509f7", 0, 0, "Pull complete"},
+	}, calls)
+}
+
+func TestPullRegistries(t *testing.T) {
+	image := imagename.NewFromString("registry.example.com/app:1.0")
+
+	assert.Equal(t, []string{"registry.example.com"}, pullRegistries(image, nil))
+	assert.Equal(t,
+		[]string{"registry.example.com", "mirror.example.com", "backup.example.com"},
+		pullRegistries(image, []string{"mirror.example.com", "registry.example.com", "", "backup.example.com", "mirror.example.com"}),
+	)
+
+	// Docker Hub aliases are the same registry
+	assert.Equal(t,
+		[]string{"", "mirror.example.com"},
+		pullRegistries(imagename.NewFromString("redis:3.2"), []string{"docker.io", "mirror.example.com", "registry-1.docker.io"}),
+	)
+}
+
+func TestBridgeImageName(t *testing.T) {
+	defer os.Setenv("ROCKER_COMPOSE_BRIDGE_IMAGE", os.Getenv("ROCKER_COMPOSE_BRIDGE_IMAGE"))
+
+	os.Setenv("ROCKER_COMPOSE_BRIDGE_IMAGE", "")
+	assert.Equal(t, BridgeImageName, bridgeImageName())
+
+	os.Setenv("ROCKER_COMPOSE_BRIDGE_IMAGE", "mirror.example.com/alpine:3.2")
+	assert.Equal(t, "mirror.example.com/alpine:3.2", bridgeImageName())
+}
+
+func TestPullImagesConcurrently(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images/create" && r.URL.Query().Get("fromImage") == "test/denied":
+			fmt.Fprint(w, `{"errorDetail":{"message":"access denied"},"error":"access denied"}`)
+		case r.URL.Path == "/images/create":
+			fmt.Fprint(w, `{"status":"Downloaded newer image"}`)
+		default:
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images := []*imagename.ImageName{
+		imagename.NewFromString("test/app:1"),
+		imagename.NewFromString("test/denied:1"),
+		imagename.NewFromString("test/db:2"),
+	}
+
+	pulled, err := PullImages(context.Background(), cli, images, &docker.AuthConfigurations{}, PullOptions{}, 3)
+	assert.EqualError(t, err, "Failed to pull 1 of 3 images, errors: test/denied:1: Failed to process json stream for image: test/denied:1, error: access denied")
+	assert.Len(t, pulled, 2)
+	assert.Equal(t, "test/app:1", pulled["test/app:1"].String())
+	assert.Equal(t, "test/db:2", pulled["test/db:2"].String())
+}
+
+func TestPullDockerImageDigest(t *testing.T) {
+	streamDigest := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			if streamDigest {
+				fmt.Fprint(w, "{\"status\":\"Digest: sha256:aaa\"}\r\n")
+			}
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc","RepoDigests":["test/other@sha256:ccc","test/app@sha256:bbb"]}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:aaa", result.Digest)
+
+	// older daemons do not report the digest in the stream
+	streamDigest = false
+
+	result, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:bbb", result.Digest)
+}
+
+func TestPullDockerImageExpectedDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for redis:3.2\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc","RepoDigests":["test/other@sha256:ccc","redis@sha256:bbb"]}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pull := func(image, expected string) error {
+		_, err := PullDockerImageWithOptions(cli, imagename.NewFromString(image), &docker.AuthConfigurations{}, PullOptions{ExpectedDigest: expected})
+		return err
+	}
+
+	assert.Nil(t, pull("redis:3.2", "sha256:bbb"))
+	assert.Nil(t, pull("docker.io/library/redis:3.2", "bbb"))
+	assert.Nil(t, pull("redis:3.2", ""), "the check should be skipped")
+
+	err = pull("redis:3.2", "sha256:ccc")
+	assert.EqualError(t, err, "Digest mismatch of image redis:3.2: expected sha256:ccc, got sha256:bbb")
+	assert.IsType(t, &DigestMismatchError{}, err)
+
+	err = pull("test/app:1", "sha256:aaa")
+	assert.EqualError(t, err, "Digest mismatch of image test/app:1: expected sha256:aaa, got none")
+}
+
+func TestPullDockerImagePullError(t *testing.T) {
+	pulls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			pulls++
+			fmt.Fprint(w, "{\"status\":\"Pulling from test/app\",\"id\":\"1\"}\r\n")
+			fmt.Fprint(w, "{\"errorDetail\":{\"code\":401,\"message\":\"unauthorized: authentication required\"},\"error\":\"unauthorized: authentication required\"}\r\n")
+			return
+		}
+		t.Fatalf("Unexpected request %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{})
+
+	pullErr, ok := err.(*PullError)
+	if !ok {
+		t.Fatalf("Expected *PullError, got %#v", err)
+	}
+	assert.Equal(t, "test/app:1", pullErr.Image)
+	assert.Equal(t, 401, pullErr.Code)
+	assert.Equal(t, "unauthorized: authentication required", pullErr.Message)
+	assert.Equal(t, "unauthorized: authentication required", pullErr.Last.ErrorMessage)
+	assert.EqualError(t, err, "Failed to process json stream for image: test/app:1, error: unauthorized: authentication required")
+
+	// auth errors are not retried
+	assert.Equal(t, 1, pulls)
+}
+
+func TestPullDockerImageIfNotPresent(t *testing.T) {
+	var (
+		pulls   int
+		present bool
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			pulls++
+			present = true
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		if !present {
+			http.Error(w, "no such image", http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		result, err := PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{Policy: PullIfNotPresent})
+		assert.Nil(t, err)
+		assert.Equal(t, "abc", result.Image.ID)
+	}
+
+	assert.Equal(t, 1, pulls)
+}
+
+// fakeDockerAPI implements DockerAPI over in-memory images and networks,
+// the methods that are not overridden panic
+type fakeDockerAPI struct {
+	DockerAPI
+
+	images    map[string]*docker.Image
+	listed    []docker.APIImages
+	networks  map[string]*docker.Network
+	pulled    []string
+	pullErr   error
+	inspected []string
+	lists     int
+
+	inspectContainer func(id string) (*docker.Container, error)
+}
+
+func (f *fakeDockerAPI) InspectContainer(id string) (*docker.Container, error) {
+	return f.inspectContainer(id)
+}
+
+func (f *fakeDockerAPI) Endpoint() string {
+	return "fake"
+}
+
+func (f *fakeDockerAPI) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	f.lists++
+	return f.listed, nil
+}
+
+func (f *fakeDockerAPI) InspectImage(name string) (*docker.Image, error) {
+	f.inspected = append(f.inspected, name)
+	if img, ok := f.images[name]; ok {
+		return img, nil
+	}
+	return nil, docker.ErrNoSuchImage
+}
+
+func (f *fakeDockerAPI) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	name := opts.Repository + ":" + opts.Tag
+	f.pulled = append(f.pulled, name)
+	if f.pullErr != nil {
+		return f.pullErr
+	}
+	if f.images == nil {
+		f.images = map[string]*docker.Image{}
+	}
+	f.images[name] = &docker.Image{ID: "pulled"}
+	fmt.Fprintf(opts.OutputStream, "{\"status\":\"Status: Downloaded newer image for %s\"}\r\n", name)
+	return nil
+}
+
+func (f *fakeDockerAPI) TagImage(name string, opts docker.TagImageOptions) error {
+	for _, img := range f.images {
+		if img.ID == name {
+			f.images[opts.Repo+":"+opts.Tag] = img
+			return nil
+		}
+	}
+	return docker.ErrNoSuchImage
+}
+
+func (f *fakeDockerAPI) NetworkInfo(id string) (*docker.Network, error) {
+	if network, ok := f.networks[id]; ok {
+		return network, nil
+	}
+	return nil, &docker.NoSuchNetwork{ID: id}
+}
+
+func TestPullDockerImageConcreteTag(t *testing.T) {
+	for _, policy := range []PullPolicy{PullAlways, PullIfNotPresent} {
+		client := &fakeDockerAPI{}
+
+		result, err := PullDockerImageWithOptions(client, imagename.NewFromString("app:1.2.3"), &docker.AuthConfigurations{}, PullOptions{Policy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the exact tag is pulled right away, nothing is listed to resolve it
+		assert.Equal(t, "pulled", result.Image.ID, "policy %s", policy)
+		assert.Equal(t, []string{"app:1.2.3"}, client.pulled, "policy %s", policy)
+		assert.Equal(t, 0, client.lists, "policy %s", policy)
+	}
+}
+
+// digestPullAPI reports the digest in the pull stream the way the daemon does
+type digestPullAPI struct {
+	fakeDockerAPI
+	digest string
+}
+
+func (f *digestPullAPI) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	fmt.Fprintf(opts.OutputStream, "{\"status\":\"Digest: %s\"}\r\n", f.digest)
+	return f.fakeDockerAPI.PullImage(opts, auth)
+}
+
+func TestPullDockerImageVerify(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", "sha256:aaa")
+		fmt.Fprint(w, `{"schemaVersion":2}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	verified := []string{}
+	signed := map[string]bool{host + "/app@sha256:aaa": true}
+
+	opts := PullOptions{
+		Registry: RegistryConfig{InsecureRegistries: []string{host}},
+		Verify: func(ref, digest string) error {
+			verified = append(verified, ref+"@"+digest)
+			if !signed[ref+"@"+digest] {
+				return errors.New("no matching signatures")
+			}
+			return nil
+		},
+	}
+
+	client := &digestPullAPI{digest: "sha256:aaa"}
+	result, err := PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app:1.0"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:aaa", result.Digest)
+	assert.Equal(t, []string{host + "/app@sha256:aaa"}, verified)
+	assert.Equal(t, []string{host + "/app:1.0"}, client.pulled)
+
+	// the tag moved after the verification
+	client = &digestPullAPI{digest: "sha256:ccc"}
+	_, err = PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app:1.0"), &docker.AuthConfigurations{}, opts)
+	assert.True(t, errors.Is(err, ErrImageNotVerified), "expected verification error, got %v", err)
+
+	// digest references are verified without asking the registry
+	client = &digestPullAPI{digest: "sha256:bbb"}
+	_, err = PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app@sha256:bbb"), &docker.AuthConfigurations{}, opts)
+	assert.EqualError(t, err, "Image "+host+"/app@sha256:bbb is rejected by verification: no matching signatures: image verification failed")
+	assert.Equal(t, []string{host + "/app@sha256:aaa", host + "/app@sha256:aaa", host + "/app@sha256:bbb"}, verified)
+	assert.Nil(t, client.pulled)
+}
+
+func TestPullDockerImageKeepPrevious(t *testing.T) {
+	running := &docker.Image{ID: "old", RepoDigests: []string{"app@sha256:aaa"}}
+	opts := PullOptions{KeepPrevious: true, PreviousTag: DefaultPreviousTag}
+
+	// the running container's image is protected before the new tag is pulled
+	client := &fakeDockerAPI{images: map[string]*docker.Image{"app:1.0": running}}
+	upgrade := opts
+	upgrade.Previous = imagename.NewFromString("app:1.0")
+	result, err := PullDockerImageWithOptions(client, imagename.NewFromString("app:1.1"), &docker.AuthConfigurations{}, upgrade)
+	assert.Nil(t, err)
+	assert.Equal(t, "pulled", result.Image.ID)
+	assert.Equal(t, "app:previous", result.Kept.String())
+	assert.Equal(t, running, client.images["app:previous"])
+	assert.Equal(t, []string{"app:1.1"}, client.pulled)
+
+	// the moving tag replaces the image under the same name
+	client = &fakeDockerAPI{images: map[string]*docker.Image{"app:latest": running}}
+	result, err = PullDockerImageWithOptions(client, imagename.NewFromString("app:latest"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "app:previous", result.Kept.String())
+	assert.Equal(t, running, client.images["app:previous"])
+	assert.Equal(t, "pulled", client.images["app:latest"].ID)
+
+	// without the tag the previous image is only recorded
+	client = &fakeDockerAPI{images: map[string]*docker.Image{"app:latest": running}}
+	result, err = PullDockerImageWithOptions(client, imagename.NewFromString("app:latest"), &docker.AuthConfigurations{}, PullOptions{KeepPrevious: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "app@sha256:aaa", result.Kept.String())
+	assert.Nil(t, client.images["app:previous"])
+
+	// nothing to keep on the first deploy
+	client = &fakeDockerAPI{}
+	result, err = PullDockerImageWithOptions(client, imagename.NewFromString("app:1.1"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Nil(t, result.Kept)
+	assert.Equal(t, []string{"app:1.1"}, client.pulled)
+}
+
+func TestPullDockerImageReuseLocalDigest(t *testing.T) {
+	var digest string
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/manifests/1.0" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digest)
+		fmt.Fprint(w, `{"schemaVersion":2}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+	image := imagename.NewFromString(host + "/app:1.0")
+
+	opts := PullOptions{
+		ReuseLocalDigest: true,
+		Registry:         RegistryConfig{InsecureRegistries: []string{host}},
+	}
+
+	tests := []struct {
+		digest string
+		pulled []string
+	}{
+		{"sha256:aaa", nil},
+		{"sha256:bbb", []string{host + "/app:1.0"}},
+	}
+
+	for _, test := range tests {
+		digest = test.digest
+
+		mirrored := &docker.Image{ID: "app", RepoDigests: []string{"mirror.example.com/app@sha256:aaa"}}
+		client := &fakeDockerAPI{
+			images: map[string]*docker.Image{"mirror.example.com/app:1.0": mirrored},
+			listed: []docker.APIImages{{ID: "app", RepoDigests: mirrored.RepoDigests}},
+		}
+
+		result, err := PullDockerImageWithOptions(client, image, &docker.AuthConfigurations{}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.pulled, client.pulled, test.digest)
+
+		if test.pulled == nil {
+			assert.Equal(t, "app", result.Image.ID)
+			assert.Equal(t, "sha256:aaa", result.Digest)
+			assert.Equal(t, mirrored, client.images[host+"/app:1.0"])
+		}
+	}
+}
+
+func TestPullDockerImageRewritten(t *testing.T) {
+	blocked := errors.New("namespace blocked/ is not allowed")
+
+	defer func() { ImageRewriter = nil }()
+	ImageRewriter = func(image *imagename.ImageName) (*imagename.ImageName, error) {
+		if strings.HasPrefix(image.Name, "blocked/") {
+			return nil, blocked
+		}
+		if IsDockerHub(image) && strings.HasPrefix(image.Name, "grammarly/") {
+			return imagename.NewFromString("registry.internal/" + image.String()), nil
+		}
+		return image, nil
+	}
+
+	client := &fakeDockerAPI{}
+	auth := &docker.AuthConfigurations{}
+
+	image := imagename.NewFromString("grammarly/app:1.0")
+	result, err := PullDockerImageWithOptions(client, image, auth, PullOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"registry.internal/grammarly/app:1.0"}, client.pulled)
+	assert.Equal(t, "registry.internal/grammarly/app:1.0", result.Name.String())
+	assert.Equal(t, "grammarly/app:1.0", image.String())
+
+	// other images are not changed
+	if _, err := PullDockerImage(client, imagename.NewFromString("redis:3.2"), auth); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"registry.internal/grammarly/app:1.0", "redis:3.2"}, client.pulled)
+
+	_, err = PullDockerImage(client, imagename.NewFromString("blocked/app:1.0"), auth)
+	assert.True(t, errors.Is(err, blocked), "expected the rewriter error, got %v", err)
+	assert.Len(t, client.pulled, 2)
+}
+
+func TestPullDockerImageIfNotPresentFake(t *testing.T) {
+	tests := []struct {
+		name    string
+		image   string
+		local   map[string]*docker.Image
+		pullErr error
+		id      string
+		pulled  []string
+		err     string
+	}{
+		{
+			name:   "present",
+			image:  "test/app:1",
+			local:  map[string]*docker.Image{"test/app:1": {ID: "local"}},
+			id:     "local",
+			pulled: nil,
+		},
+		{
+			name:   "missing",
+			image:  "test/app:1",
+			id:     "pulled",
+			pulled: []string{"test/app:1"},
+		},
+		{
+			name:    "pull fails",
+			image:   "test/app:1",
+			pullErr: fmt.Errorf("connection refused"),
+			pulled:  []string{"test/app:1"},
+			err:     "connection refused",
+		},
+	}
+
+	for _, test := range tests {
+		client := &fakeDockerAPI{images: test.local, pullErr: test.pullErr}
+
+		result, err := PullDockerImageWithOptions(client, imagename.NewFromString(test.image), &docker.AuthConfigurations{}, PullOptions{Policy: PullIfNotPresent})
+		if test.err != "" {
+			if assert.NotNil(t, err, test.name) {
+				assert.Contains(t, err.Error(), test.err, test.name)
+			}
+		} else if assert.Nil(t, err, test.name) {
+			assert.Equal(t, test.id, result.Image.ID, test.name)
+		}
+		assert.Equal(t, test.pulled, client.pulled, test.name)
+	}
+}
+
+func TestPullDockerImageVersionRange(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.3.0","1.4.0","1.4.2"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+	client := &fakeDockerAPI{}
+	opts := PullOptions{Registry: RegistryConfig{InsecureRegistries: []string{host}}}
+
+	// the range is resolved over the remote tags and the resolved tag is pulled
+	result, err := PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app:~1.4"), &docker.AuthConfigurations{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{host + "/app:1.4.2"}, client.pulled)
+	assert.Equal(t, host+"/app:1.4.2", result.Name.String())
+}
+
+func TestPullDockerImageIfNotPresentVersionRange(t *testing.T) {
+	tagsListed := 0
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/app/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		tagsListed++
+		fmt.Fprint(w, `{"name":"app","tags":["1.2.3","1.2.5"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+	opts := PullOptions{Policy: PullIfNotPresent, Registry: RegistryConfig{InsecureRegistries: []string{host}}}
+
+	// the range resolves to the local tag, which is not pulled again
+	client := &fakeDockerAPI{
+		images: map[string]*docker.Image{host + "/app:1.2.3": {ID: "local"}},
+		listed: []docker.APIImages{{ID: "local", RepoTags: []string{host + "/app:1.2.3"}}},
+	}
+	result, err := PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app:1.2.*"), &docker.AuthConfigurations{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "local", result.Image.ID)
+	assert.Nil(t, client.pulled)
+	assert.Equal(t, 0, tagsListed)
+
+	// nothing matches locally, the range resolves over the remote tags and is pulled
+	client = &fakeDockerAPI{images: map[string]*docker.Image{}}
+	result, err = PullDockerImageWithOptions(client, imagename.NewFromString(host+"/app:1.2.*"), &docker.AuthConfigurations{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "pulled", result.Image.ID)
+	assert.Equal(t, []string{host + "/app:1.2.5"}, client.pulled)
+}
+
+func TestPullDockerImagePolicy(t *testing.T) {
+	local := map[string]*docker.Image{"test/app:1": {ID: "local"}}
+
+	tests := []struct {
+		policy PullPolicy
+		image  string
+		local  map[string]*docker.Image
+		id     string
+		pulled []string
+		err    error
+	}{
+		{PullAlways, "test/app:1", local, "pulled", []string{"test/app:1"}, nil},
+		{"", "test/app:1", local, "pulled", []string{"test/app:1"}, nil},
+		{PullIfNotPresent, "test/app:1", local, "local", nil, nil},
+		{PullIfNotPresent, "test/app:1", nil, "pulled", []string{"test/app:1"}, nil},
+		{PullNever, "test/app:1", local, "local", nil, nil},
+		{PullNever, "test/app:1", nil, "", nil, ErrImageNotPresent},
+		{PullNever, "test/app:1.*", local, "", nil, ErrImageNotPresent},
+	}
+
+	for _, test := range tests {
+		images := map[string]*docker.Image{}
+		for name, img := range test.local {
+			images[name] = img
+		}
+		client := &fakeDockerAPI{images: images}
+
+		result, err := PullDockerImageWithOptions(client, imagename.NewFromString(test.image), &docker.AuthConfigurations{}, PullOptions{Policy: test.policy})
+		if test.err != nil {
+			assert.True(t, errors.Is(err, test.err), "policy %q, image %s: unexpected error %v", test.policy, test.image, err)
+		} else if assert.Nil(t, err, "policy %q, image %s", test.policy, test.image) {
+			assert.Equal(t, test.id, result.Image.ID, "policy %q, image %s", test.policy, test.image)
+		}
+		assert.Equal(t, test.pulled, client.pulled, "policy %q, image %s", test.policy, test.image)
+	}
+}
+
+func TestParsePullPolicy(t *testing.T) {
+	for value, expected := range map[string]PullPolicy{
+		"":             "",
+		"Always":       PullAlways,
+		"ifnotpresent": PullIfNotPresent,
+		"missing":      PullIfNotPresent,
+		"NEVER":        PullNever,
+	} {
+		policy, err := ParsePullPolicy(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, policy, value)
+	}
+
+	_, err := ParsePullPolicy("sometimes")
+	assert.EqualError(t, err, `Invalid pull policy "sometimes", expected one of Always, IfNotPresent, Never`)
+}
+
+func TestGetNetworkGatewayIPFake(t *testing.T) {
+	defer ResetBridgeIPCache()
+
+	client := &fakeDockerAPI{
+		networks: map[string]*docker.Network{
+			"custom": {Name: "custom", IPAM: docker.IPAMOptions{Config: []docker.IPAMConfig{{Gateway: "172.18.0.1"}}}},
+		},
+	}
+
+	ip, err := GetNetworkGatewayIP(client, "custom")
+	assert.Nil(t, err)
+	assert.Equal(t, "172.18.0.1", ip)
+}
+
+func TestWaitBridgeGateway(t *testing.T) {
+	defer func(timeout, interval time.Duration) {
+		BridgeGatewayTimeout, bridgeGatewayPollInterval = timeout, interval
+	}(BridgeGatewayTimeout, bridgeGatewayPollInterval)
+	BridgeGatewayTimeout, bridgeGatewayPollInterval = 50*time.Millisecond, time.Millisecond
+
+	running := docker.State{Running: true}
+	exited := docker.State{ExitCode: 1, FinishedAt: time.Now()}
+
+	tests := []struct {
+		name     string
+		inspects []*docker.Container
+		ip       string
+		err      string
+	}{
+		{
+			name: "gateway appears",
+			inspects: []*docker.Container{
+				{State: running},
+				{State: running, NetworkSettings: &docker.NetworkSettings{}},
+				{State: running, NetworkSettings: &docker.NetworkSettings{Networks: map[string]docker.ContainerNetwork{
+					"bridge": {Gateway: "172.17.0.1"},
+				}}},
+			},
+			ip: "172.17.0.1",
+		},
+		{
+			name: "legacy gateway",
+			inspects: []*docker.Container{
+				{State: running, NetworkSettings: &docker.NetworkSettings{Gateway: "172.17.0.1"}},
+			},
+			ip: "172.17.0.1",
+		},
+		{
+			name:     "container exits",
+			inspects: []*docker.Container{{State: running}, {State: exited}},
+			err:      "Dummy network container abc exited with code 1 before the gateway of network bridge is known",
+		},
+		{
+			name:     "deadline",
+			inspects: []*docker.Container{{State: running}},
+			err:      "Gateway of network bridge is still empty in dummy network container abc after 50ms",
+		},
+	}
+
+	for _, test := range tests {
+		inspects := test.inspects
+		client := &fakeDockerAPI{
+			inspectContainer: func(id string) (*docker.Container, error) {
+				inspect := inspects[0]
+				if len(inspects) > 1 {
+					inspects = inspects[1:]
+				}
+				return inspect, nil
+			},
+		}
+
+		ip, err := waitBridgeGateway(context.Background(), client, "abc", "bridge")
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, test.name)
+		} else {
+			assert.Nil(t, err, test.name)
+		}
+		assert.Equal(t, test.ip, ip, test.name)
+	}
+}
+
+func TestGetBridgeIPTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { BridgeContainerTimeout = timeout }(BridgeContainerTimeout)
+	BridgeContainerTimeout = 50 * time.Millisecond
+
+	var (
+		mu      sync.Mutex
+		removed []string
+		aborted = make(chan struct{})
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/images/"):
+			fmt.Fprint(w, `{"Id":"busybox"}`)
+		case r.URL.Path == "/containers/json":
+			fmt.Fprint(w, `[]`)
+		case r.URL.Path == "/containers/create":
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		case r.URL.Path == "/containers/abc/start":
+			// the start never returns, the client has to abort the request
+			<-r.Context().Done()
+			close(aborted)
+		case r.Method == "DELETE" && r.URL.Path == "/containers/abc":
+			mu.Lock()
+			removed = append(removed, "abc")
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SkipServerVersionCheck = true
+
+	ip, err := getBridgeIP(client, "bridge")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "expected deadline error, got %v", err)
+	assert.EqualError(t, err, "Timeout starting dummy network container abc: context deadline exceeded")
+	assert.Equal(t, "", ip)
+
+	// the start request does not outlive the timeout
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("The start request of the dummy network container is left running")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"abc"}, removed)
+}
+
+func TestGetBridgeIPCommand(t *testing.T) {
+	defer ResetBridgeIPCache()
+	defer func(cmd []string) { BridgeGatewayCommand = cmd }(BridgeGatewayCommand)
+
+	// nothing is asked from the docker daemon
+	client := &fakeDockerAPI{}
+
+	BridgeGatewayCommand = []string{"sh", "-c", `echo "10.1.0.1 via $ROCKER_COMPOSE_NETWORK"`}
+	ip, err := GetNetworkGatewayIP(client, "mynet")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.1", ip)
+
+	BridgeGatewayCommand = []string{"sh", "-c", "echo no route"}
+	_, err = GetBridgeIP(client)
+	assert.EqualError(t, err, `Gateway command "sh -c echo no route" printed "no route", expected the gateway ip of network bridge`)
+
+	BridgeGatewayCommand = []string{"sh", "-c", "echo oops >&2; exit 1"}
+	_, err = GetBridgeIP(client)
+	assert.EqualError(t, err, `Failed to run gateway command "sh -c echo oops >&2; exit 1", error: exit status 1 oops`)
+}
+
+func TestInspectImages(t *testing.T) {
+	client := &fakeDockerAPI{
+		listed: []docker.APIImages{
+			{
+				ID:          "redis-id",
+				RepoTags:    []string{"redis:3.2.5", "redis:latest"},
+				RepoDigests: []string{"redis@sha256:aaa"},
+				Labels:      map[string]string{"maintainer": "redis"},
+			},
+			{
+				ID:       "app-id",
+				RepoTags: []string{"quay.io/org/app:1.0"},
+			},
+		},
+		images: map[string]*docker.Image{
+			"quay.io/org/app:1.0": {ID: "app-id", Architecture: "amd64"},
+		},
+	}
+
+	images := []*imagename.ImageName{
+		imagename.NewFromString("redis:3.2.5"),
+		imagename.NewFromString("docker.io/library/redis:latest"),
+		imagename.NewFromString("redis@sha256:aaa"),
+		imagename.NewFromString("quay.io/org/app:1.0"),
+		imagename.NewFromString("quay.io/org/app:2.0"),
+		imagename.NewFromString("redis:3.2.5"),
+	}
+
+	result, err := InspectImages(client, images, func(image *imagename.ImageName) bool {
+		return image.Registry == "quay.io"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, result, 5)
+	assert.Equal(t, "redis-id", result["redis:3.2.5"].ID)
+	assert.Equal(t, "redis", result["redis:3.2.5"].Config.Labels["maintainer"])
+	assert.Equal(t, "redis-id", result["docker.io/library/redis:latest"].ID)
+	assert.Equal(t, "redis-id", result["redis@sha256:aaa"].ID)
+	assert.Equal(t, "amd64", result["quay.io/org/app:1.0"].Architecture)
+	assert.Nil(t, result["quay.io/org/app:2.0"])
+
+	// only the found image that needs the details is inspected
+	assert.Equal(t, []string{"quay.io/org/app:1.0"}, client.inspected)
+}
+
+func TestPullSummaryLogger(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &log.TextFormatter{DisableTimestamp: true, DisableColors: true}
+
+	now := time.Unix(0, 0)
+	s := newPullSummaryLogger(logger, "redis:3.2", 10*time.Second)
+	s.now = func() time.Time { return now }
+	s.logged = now
+
+	s.progress("", 0, 0, "Pulling from library/redis")
+	s.progress("aaa", 0, 0, "Pulling fs layer")
+	s.progress("bbb", 0, 0, "Already exists")
+	s.progress("aaa", 512*1024, 2*1024*1024, "Downloading")
+
+	now = now.Add(11 * time.Second)
+	s.progress("aaa", 1024*1024, 2*1024*1024, "Downloading")
+	s.progress("aaa", 2*1024*1024, 2*1024*1024, "Downloading")
+
+	now = now.Add(time.Second)
+	s.progress("aaa", 0, 0, "Pull complete")
+	s.progress("", 0, 0, "Digest: sha256:aaa")
+	s.progress("", 0, 0, "Status: Downloaded newer image for redis:3.2")
+
+	assert.Equal(t, []string{
+		`level=info msg="redis:3.2: Pulling from library/redis" `,
+		`level=info msg="redis:3.2: 1 of 2 layers complete, 1.0 of 2.0 MB downloaded" `,
+		`level=info msg="redis:3.2: Digest: sha256:aaa" `,
+		`level=info msg="redis:3.2: 2 of 2 layers complete, 2.0 of 2.0 MB downloaded" `,
+		`level=info msg="redis:3.2: Status: Downloaded newer image for redis:3.2"`,
+	}, strings.Split(strings.TrimSpace(out.String()), "\n"))
+}
+
+func TestPullStatsCollector(t *testing.T) {
+	now := time.Unix(0, 0)
+	progress := []string{}
+
+	c := newPullStatsCollector(func(layerID string, current, total int64, status string) {
+		progress = append(progress, status)
+	})
+	c.now = func() time.Time { return now }
+	c.started = now
+
+	step := func(d time.Duration, layerID string, current, total int64, status string) {
+		now = now.Add(d)
+		c.progress(layerID, current, total, status)
+	}
+
+	step(0, "1.0", 0, 0, "Pulling from test/app")
+	step(0, "aaa", 0, 0, "Already exists")
+	step(0, "bbb", 0, 0, "Pulling fs layer")
+	step(0, "ccc", 0, 0, "Pulling fs layer")
+	step(0, "ddd", 0, 0, "Pulling fs layer")
+	step(time.Second, "bbb", 1024*1024, 2*1024*1024, "Downloading")
+	step(0, "ccc", 1024*1024, 2*1024*1024, "Downloading")
+	step(time.Second, "bbb", 2*1024*1024, 2*1024*1024, "Downloading")
+	step(0, "bbb", 0, 0, "Download complete")
+	step(0, "ddd", 0, 0, "Download complete")
+	step(time.Second, "ccc", 2*1024*1024, 2*1024*1024, "Downloading")
+	step(0, "ccc", 0, 0, "Download complete")
+	step(time.Second, "", 0, 0, "Status: Downloaded newer image for test/app:1.0")
+
+	stats := c.summary("test/app:1.0")
+
+	assert.Equal(t, 13, len(progress), "progress should be passed through")
+	assert.Equal(t, []LayerStats{
+		{ID: "aaa", Cached: true},
+		{ID: "bbb", Bytes: 2 * 1024 * 1024, Duration: time.Second},
+		{ID: "ccc", Bytes: 2 * 1024 * 1024, Duration: 2 * time.Second},
+		{ID: "ddd"},
+	}, stats.Layers)
+	assert.Equal(t, int64(4*1024*1024), stats.Bytes)
+	assert.Equal(t, 4*time.Second, stats.Duration)
+	assert.Equal(t, 2*time.Second, stats.DownloadDuration)
+	assert.Equal(t, 2.0, stats.MBPerSecond())
+	assert.Equal(t, 1, stats.CachedLayers())
+	assert.Equal(t, "4.0 MB in 4s, 2.00 MB/s, 1 of 4 layers cached", stats.String())
+
+	assert.Equal(t, 0.0, PullStats{Layers: []LayerStats{{ID: "aaa", Cached: true}}}.MBPerSecond())
+}
+
+func TestPullDockerImageStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			fmt.Fprint(w, "{\"status\":\"Already exists\",\"id\":\"aaa\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Downloading\",\"progressDetail\":{\"current\":512,\"total\":1024},\"id\":\"bbb\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Download complete\",\"id\":\"bbb\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stats []PullStats
+	opts := PullOptions{Stats: func(s PullStats) { stats = append(stats, s) }}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+
+	if assert.Len(t, stats, 1) {
+		assert.Equal(t, "test/app:1", stats[0].Image)
+		assert.Equal(t, int64(1024), stats[0].Bytes)
+		assert.Equal(t, 1, stats[0].CachedLayers())
+		assert.Len(t, stats[0].Layers, 2)
+	}
+}
+
+func TestIsPullStatusChange(t *testing.T) {
+	assert.True(t, isPullStatusChange("Pulling from library/alpine"))
+	assert.True(t, isPullStatusChange("Pull complete"))
+	assert.True(t, isPullStatusChange("Digest: sha256:aaa"))
+	assert.False(t, isPullStatusChange("Downloading"))
+	assert.False(t, isPullStatusChange("Extracting"))
+}
+
+func TestGetBridgeIPDryRun(t *testing.T) {
+	defer func() { BridgeIPDryRun = false }()
+	BridgeIPDryRun = true
+
+	// the client is never used, any call to it would panic
+	ip, err := GetBridgeIP(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, BridgeIPPlaceholder, ip)
+}
+
+func TestPullDockerImageTimeout(t *testing.T) {
+	var (
+		pulls   int32
+		release = make(chan struct{})
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pulls, 1)
+		// hang like a flaky proxy does
+		fmt.Fprint(w, "{\"status\":\"Pulling from test/app\",\"id\":\"1\"}\r\n")
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the timeout is not multiplied by the attempts
+	opts := PullOptions{
+		Timeout: 50 * time.Millisecond,
+		Retry:   RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.EqualError(t, err, "Timeout pulling image test/app:1, waited 50ms")
+	assert.False(t, isRetryablePullError(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pulls))
+}
+
+func TestListManagedImages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"Id":"a","RepoTags":["test/app:1.2.0","test/app:stable"]},
+			{"Id":"b","RepoTags":["test/app:1.3.0"]},
+			{"Id":"c","RepoTags":["test/db:9.4"]},
+			{"Id":"d","RepoTags":["other/thing:1.2.0"]},
+			{"Id":"e","RepoTags":["<none>:<none>"]}
+		]`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := ListManagedImages(cli, []*imagename.ImageName{
+		imagename.NewFromString("test/app:1.2.*"),
+		imagename.NewFromString("test/db:9.4"),
+	})
+	assert.Nil(t, err)
+
+	ids := []string{}
+	for _, image := range images {
+		ids = append(ids, image.ID)
+	}
+	assert.Equal(t, []string{"a", "c"}, ids)
+}
+
+func TestFindLocalImages(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `[
+			{"Id":"a","RepoTags":["test/app:1.2.0","test/app:stable"]},
+			{"Id":"b","RepoTags":["test/db:9.4"],"RepoDigests":["test/db@sha256:0123456789abcdef0123456789abcdef"]}
+		]`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	present, err := FindLocalImages(cli, []*imagename.ImageName{
+		imagename.NewFromString("test/app:1.2.*"),
+		imagename.NewFromString("test/app:1.3.*"),
+		imagename.NewFromString("test/app:stable"),
+		imagename.NewFromString("test/db:9.5"),
+		imagename.NewFromString("test/db@sha256:0123456789abcdef0123456789abcdef"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, map[string]bool{
+		"test/app:1.2.*":  true,
+		"test/app:1.3.*":  false,
+		"test/app:stable": true,
+		"test/db:9.5":     false,
+		"test/db@sha256:0123456789abcdef0123456789abcdef": true,
+	}, present)
+}
+
+func TestLocalImageIndex(t *testing.T) {
+	index := newLocalImageIndex([]docker.APIImages{
+		{ID: "a", RepoTags: []string{"test/app:1.2.0", "test/app:stable"}},
+		{ID: "b", RepoTags: []string{"registry.example.com:5000/test/app:1.3.0"}},
+		{ID: "c", RepoTags: []string{"<none>:<none>"}},
+	})
+
+	names := []string{}
+	for _, name := range index.lookup(imagename.NewFromString("test/app:1.*")) {
+		names = append(names, name.String())
+	}
+	assert.Equal(t, []string{"test/app:1.2.0", "test/app:stable"}, names)
+
+	names = []string{}
+	for _, name := range index.lookup(imagename.NewFromString("registry.example.com:5000/test/app")) {
+		names = append(names, name.String())
+	}
+	assert.Equal(t, []string{"registry.example.com:5000/test/app:1.3.0"}, names)
+
+	assert.Empty(t, index.lookup(imagename.NewFromString("test/db:9.4")))
+	assert.Empty(t, newLocalImageIndex(nil).lookup(imagename.NewFromString("test/app")))
+
+	// official images are found by any of their Docker Hub names
+	index = newLocalImageIndex([]docker.APIImages{{ID: "d", RepoTags: []string{"redis:3.2.1"}}})
+	for _, name := range []string{"redis:3.*", "library/redis:3.*", "docker.io/library/redis:3.*"} {
+		names = []string{}
+		for _, image := range index.lookup(imagename.NewFromString(name)) {
+			names = append(names, image.String())
+		}
+		assert.Equal(t, []string{"redis:3.2.1"}, names, name)
+	}
+}
+
+// benchmarkImages returns a host with many repositories of many tags each
+func benchmarkImages() []docker.APIImages {
+	images := []docker.APIImages{}
+	for i := 0; i < 200; i++ {
+		tags := []string{}
+		for j := 0; j < 20; j++ {
+			tags = append(tags, fmt.Sprintf("registry.example.com/app%d:1.%d.0", i, j))
+		}
+		images = append(images, docker.APIImages{ID: fmt.Sprintf("%d", i), RepoTags: tags})
+	}
+	return images
+}
+
+// BenchmarkLocalImagesScan is the former way of resolution: parse every local tag
+// and scan all of them for every image
+func BenchmarkLocalImagesScan(b *testing.B) {
+	all := benchmarkImages()
+	wanted := []*imagename.ImageName{}
+	for i := 0; i < 10; i++ {
+		wanted = append(wanted, imagename.NewFromString(fmt.Sprintf("registry.example.com/app%d:1.*", i)))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		local := []*imagename.ImageName{}
+		for _, image := range all {
+			for _, repoTag := range image.RepoTags {
+				local = append(local, imagename.NewFromString(repoTag))
+			}
+		}
+		for _, image := range wanted {
+			findMostRecentTag(image, local, nil, true, ResolveOptions{})
+		}
+	}
+}
+
+func BenchmarkLocalImagesIndex(b *testing.B) {
+	all := benchmarkImages()
+	wanted := []*imagename.ImageName{}
+	for i := 0; i < 10; i++ {
+		wanted = append(wanted, imagename.NewFromString(fmt.Sprintf("registry.example.com/app%d:1.*", i)))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index := newLocalImageIndex(all)
+		for _, image := range wanted {
+			findMostRecentTag(image, index.lookup(image), nil, true, ResolveOptions{})
+		}
+	}
+}
+
+func TestRemoveOrphanedBridgeContainers(t *testing.T) {
+	requests := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.URL.Path == "/containers/json" {
+			assert.Contains(t, r.URL.Query().Get("filters"), "rocker-compose-bridge-ip")
+			fmt.Fprintf(w, `[{"Id":"stale","Created":%d},{"Id":"fresh","Created":%d}]`,
+				time.Now().Add(-time.Hour).Unix(), time.Now().Unix())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := RemoveOrphanedBridgeContainers(cli, 5*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+
+	assert.Equal(t, []string{
+		"GET /containers/json",
+		"POST /containers/stale/stop",
+		"DELETE /containers/stale",
+	}, requests)
+}
+
+func TestPullDockerImageByDigest(t *testing.T) {
+	const digest = "sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11"
+
+	image := imagename.NewFromString("registry.example.com/app@" + digest)
+	assert.True(t, image.TagIsDigest())
+	assert.True(t, image.IsStrict())
+	assert.False(t, image.HasVersionRange())
+	assert.Equal(t, "registry.example.com/app@"+digest, image.String())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			assert.Equal(t, "registry.example.com/app@"+digest, r.URL.Query().Get("fromImage"))
+			assert.Equal(t, "", r.URL.Query().Get("tag"))
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for registry.example.com/app@"+digest+"\"}\r\n")
+			return
+		}
+		assert.Equal(t, "/images/registry.example.com/app@"+digest+"/json", r.URL.Path)
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := PullDockerImageWithOptions(cli, image, &docker.AuthConfigurations{}, PullOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, digest, result.Digest)
+	assert.Equal(t, "registry.example.com/app@"+digest, image.String())
+}
+
+func TestPullJitterSleep(t *testing.T) {
+	assert.Nil(t, pullJitterSleep(context.Background(), 0))
+
+	start := time.Now()
+	assert.Nil(t, pullJitterSleep(context.Background(), 20*time.Millisecond))
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, pullJitterSleep(ctx, time.Hour))
+}
+
+func TestHubMirrorImage(t *testing.T) {
+	assert.Equal(t, "mirror.example.com/library/redis:3.2", hubMirrorImage(imagename.NewFromString("redis:3.2"), "mirror.example.com").String())
+	assert.Equal(t, "mirror.example.com/grammarly/app:1", hubMirrorImage(imagename.NewFromString("grammarly/app:1"), "mirror.example.com").String())
+	assert.Equal(t, "registry.example.com/app:1", hubMirrorImage(imagename.NewFromString("registry.example.com/app:1"), "mirror.example.com").String())
+	assert.Equal(t, "redis:3.2", hubMirrorImage(imagename.NewFromString("redis:3.2"), "").String())
+}
+
+func TestPullDockerImageHubMirror(t *testing.T) {
+	requests := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/create":
+			requests = append(requests, "pull "+r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag"))
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+		case "/images/mirror.example.com/library/redis:3.2/tag":
+			requests = append(requests, "tag "+r.URL.Query().Get("repo")+":"+r.URL.Query().Get("tag"))
+			w.WriteHeader(http.StatusCreated)
+		case "/images/redis:3.2/json":
+			fmt.Fprint(w, `{"Id":"abc"}`)
+		default:
+			t.Fatalf("Unexpected request %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := imagename.NewFromString("redis:3.2")
+
+	_, err = PullDockerImageWithOptions(cli, image, &docker.AuthConfigurations{}, PullOptions{HubMirror: "mirror.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, "redis:3.2", image.String())
+	assert.Equal(t, []string{"pull mirror.example.com/library/redis:3.2", "tag redis:3.2"}, requests)
+}
+
+func TestPruneDanglingImages(t *testing.T) {
+	removed := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/images/json":
+			assert.Contains(t, r.URL.Query().Get("filters"), "dangling")
+			fmt.Fprint(w, `[
+				{"Id":"sha256:aaaaaaaaaaaaaaaa","RepoTags":["<none>:<none>"],"Size":100},
+				{"Id":"sha256:bbbbbbbbbbbbbbbb","RepoTags":["<none>:<none>"],"Size":200},
+				{"Id":"sha256:cccccccccccccccc","RepoTags":["<none>:<none>"],"Size":400}
+			]`)
+		case r.URL.Path == "/containers/json":
+			fmt.Fprint(w, `[{"Id":"c1","Image":"bbbbbbbbbbbb"}]`)
+		case strings.HasPrefix(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+			fmt.Fprint(w, `{"Id":"sha256:cccccccccccccccc"}`)
+		case r.Method == "DELETE":
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/images/"))
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `[]`)
+		default:
+			t.Fatalf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, reclaimed, err := PruneDanglingImages(cli)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(100), reclaimed)
+
+	// the image of the container and the dummy network container image are kept
+	assert.Equal(t, []string{"sha256:aaaaaaaaaaaaaaaa"}, removed)
+}
+
+func TestPullDockerImageLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	logger := log.New()
+	logger.Out = out
+	// status changes of json logs are written synchronously
+	logger.Formatter = &log.JSONFormatter{}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{Logger: logger})
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), `"image":"test/app:1"`)
+	assert.Contains(t, out.String(), "Downloaded newer image for test/app:1")
+}
+
+func TestPullDockerImageRateLimit(t *testing.T) {
+	pulls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			pulls++
+			fmt.Fprint(w, "{\"errorDetail\":{\"message\":\"toomanyrequests: You have reached your pull rate limit.\"},\"error\":\"toomanyrequests: You have reached your pull rate limit.\"}\r\n")
+			return
+		}
+		t.Fatalf("Unexpected request %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := PullOptions{Retry: RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, opts)
+	assert.EqualError(t, err, "Rate limit of registry Docker Hub exceeded (429 Too Many Requests): toomanyrequests: You have reached your pull rate limit.")
+
+	// rate limits are retried
+	assert.Equal(t, 2, pulls)
+}
+
+func TestPullDockerImageWarnings(t *testing.T) {
+	pulls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			pulls++
+			if r.URL.Query().Get("fromImage") == "test/app" {
+				fmt.Fprint(w, "{\"errorDetail\":{\"message\":\"net/http: TLS handshake timeout\"},\"error\":\"net/http: TLS handshake timeout\"}\r\n")
+				return
+			}
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for mirror.example.com/test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := PullOptions{
+		Retry:              RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		FallbackRegistries: []string{"mirror.example.com"},
+	}
+
+	// the name the image is pulled by is returned, the given one is left as is
+	image := imagename.NewFromString("test/app:1")
+	result, err := PullDockerImageWithOptions(cli, image, &docker.AuthConfigurations{}, opts)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", result.Image.ID)
+	assert.Equal(t, 3, pulls)
+	assert.Equal(t, "mirror.example.com/test/app:1", result.Name.String())
+	assert.Equal(t, "test/app:1", image.String())
+
+	codes := []string{}
+	for _, w := range result.Warnings {
+		codes = append(codes, w.Code)
+	}
+	assert.Equal(t, []string{WarningPullRetry, WarningFallbackRegistry}, codes)
+	assert.Equal(t, "fallback_registry: Image test/app:1 is pulled from the fallback registry mirror.example.com", result.Warnings[1].String())
+}
+
+func TestPullDockerImageGarbledStream(t *testing.T) {
+	failAfterGarbage := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			fmt.Fprint(w, "{\"status\":\"Pulling fs layer\",\"id\":\"a1\"}\r\n")
+			fmt.Fprint(w, "{\"status\":garbage}\r\n")
+			if failAfterGarbage {
+				fmt.Fprint(w, "{\"errorDetail\":{\"message\":\"manifest unknown\"},\"error\":\"manifest unknown\"}\r\n")
+				return
+			}
+			fmt.Fprint(w, "{\"status\":\"Digest: sha256:0123456789abcdef0123456789abcdef\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rendering glitch does not fail an otherwise successful pull
+	result, err := PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc", result.Image.ID)
+	assert.Equal(t, "sha256:0123456789abcdef0123456789abcdef", result.Digest)
+
+	// but the pull error reported later in the stream does
+	failAfterGarbage = true
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{})
+	if assert.IsType(t, &PullError{}, err) {
+		assert.Equal(t, "manifest unknown", err.(*PullError).Message)
+	}
+}
+
+func TestCheckImagePlatform(t *testing.T) {
+	image := imagename.NewFromString("test/app:1")
+	img := &docker.Image{Architecture: "amd64"}
+
+	assert.Nil(t, checkImagePlatform(img, image, ""))
+	assert.Nil(t, checkImagePlatform(img, image, "linux/amd64"))
+	assert.EqualError(t, checkImagePlatform(img, image, "linux/arm64/v8"),
+		"Image test/app:1 was pulled for architecture amd64, but platform linux/arm64/v8 is required; make sure the daemon default platform is linux/arm64/v8")
+	assert.EqualError(t, checkImagePlatform(img, image, "arm64"), `Invalid platform "arm64", expected os/arch[/variant]`)
+}
+
+func TestPullDockerImageProgressCopy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			fmt.Fprint(w, "{\"status\":\"Pulling fs layer\",\"id\":\"a1\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Downloading\",\"progressDetail\":{\"current\":1,\"total\":2},\"progress\":\"[==>   ]\",\"id\":\"a1\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Pull complete\",\"id\":\"a1\"}\r\n")
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image for test/app:1\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audit := &bytes.Buffer{}
+
+	_, err = PullDockerImageWithOptions(cli, imagename.NewFromString("test/app:1"), &docker.AuthConfigurations{}, PullOptions{ProgressCopy: audit})
+	assert.Nil(t, err)
+	assert.Equal(t, "test/app:1 a1: Pulling fs layer\n"+
+		"test/app:1 a1: Pull complete\n"+
+		"test/app:1 Status: Downloaded newer image for test/app:1\n", audit.String())
+}
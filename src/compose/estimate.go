@@ -0,0 +1,232 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultEstimatePlatform is the platform whose image is picked from multi-arch manifests
+// by EstimatePullSize if no platform is given
+const DefaultEstimatePlatform = "linux/amd64"
+
+// PullSizeEstimate is how much data pulling a set of images would download
+type PullSizeEstimate struct {
+	// Total is the number of compressed bytes of all the layers missing locally,
+	// layers shared between the images are counted once
+	Total int64
+
+	// Images is the number of bytes per image, e.g. "redis:3.0.7"; a layer shared
+	// between the images is counted for each of them
+	Images map[string]int64
+}
+
+// EstimatePullSize returns how many compressed bytes pulling the image would download,
+// without pulling it: the sizes of the layers in the registry manifest are summed up, except
+// the ones already present in the local images. The image of the platform, e.g. "linux/arm64",
+// is taken from multi-arch manifests, DefaultEstimatePlatform is used if it is empty.
+// Version ranges, e.g. app:~1.4, are resolved over the remote tags first, see ResolveImageTag.
+func EstimatePullSize(client DockerAPI, image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig, platform string) (int64, error) {
+	estimate, err := EstimatePullSizes(client, []*imagename.ImageName{image}, auth, config, platform)
+	if err != nil {
+		return 0, err
+	}
+	return estimate.Total, nil
+}
+
+// EstimatePullSizes is the same as EstimatePullSize for many images, e.g. all the images of
+// a deploy. The local images are inspected only once.
+func EstimatePullSizes(client DockerAPI, images []*imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig, platform string) (*PullSizeEstimate, error) {
+	if platform == "" {
+		platform = DefaultEstimatePlatform
+	}
+
+	present, err := localLayers(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		estimate = &PullSizeEstimate{Images: map[string]int64{}}
+		counted  = map[string]bool{}
+	)
+
+	for _, image := range images {
+		pulled := image
+		if image.HasVersionRange() && !image.IsStrict() {
+			if pulled, _, err = ResolveImageTag(client, image, true, auth, PullOptions{Registry: config}); err != nil {
+				return nil, fmt.Errorf("Failed to estimate pull size of image %s, error: %s", image, err)
+			}
+		}
+
+		layers, err := registryImageLayers(pulled, auth, config, platform)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to estimate pull size of image %s, error: %s", image, err)
+		}
+
+		size := int64(0)
+		for _, layer := range layers {
+			if present[layer.diffID] {
+				continue
+			}
+			size += layer.size
+			if !counted[layer.digest] {
+				counted[layer.digest] = true
+				estimate.Total += layer.size
+			}
+		}
+
+		log.Debugf("Pulling image %s would download %d bytes", image, size)
+		estimate.Images[image.String()] = size
+	}
+
+	return estimate, nil
+}
+
+// localLayers returns the layers of all the local images by their uncompressed digests,
+// which are the ones docker keeps in RootFS
+func localLayers(client DockerAPI) (map[string]bool, error) {
+	all, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list all images, error: %s", err)
+	}
+
+	layers := map[string]bool{}
+	for _, listed := range all {
+		img, err := client.InspectImage(listed.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to inspect image %s, error: %s", listed.ID, err)
+		}
+		if img.RootFS == nil {
+			continue
+		}
+		for _, layer := range img.RootFS.Layers {
+			layers[layer] = true
+		}
+	}
+
+	return layers, nil
+}
+
+// imageLayer is a layer of the image in the registry, digest and size are the ones of the
+// compressed blob and diffID is the uncompressed digest from the image config
+type imageLayer struct {
+	digest string
+	diffID string
+	size   int64
+}
+
+// registryImageLayers fetches the manifest of the image and its config from the registry,
+// the image of the platform is taken from multi-arch manifests. Version ranges have to be
+// resolved already.
+func registryImageLayers(image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig, platform string) ([]imageLayer, error) {
+	if image.Storage == imagename.StorageS3 || image.IsECR() {
+		return nil, fmt.Errorf("Image %s is not in a registry that supports manifests", image)
+	}
+	if image.HasVersionRange() && !image.IsStrict() {
+		return nil, fmt.Errorf("Image %s has a version range that is not resolved to a tag", image)
+	}
+
+	// the pull goes to the rewritten repository
+	image, err := rewriteImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := hubMirrorImage(image, config.HubMirror)
+	base, registry, name := config.repositoryURL(listed)
+
+	regAuth, err := getAuthForImage(config.AuthResolver, auth, listed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login`", image)
+	}
+
+	scope := "repository:" + name + ":pull"
+	getManifest := func(reference string) (manifest registryManifest, err error) {
+		_, err = config.getWithAccept(base+"/manifests/"+reference, registryManifestTypes, regAuth, scope, &manifest)
+		if e, ok := err.(*registryStatusError); ok && e.statusCode == http.StatusNotFound {
+			return manifest, &RepositoryNotFoundError{Repository: image.Name, Registry: registry}
+		}
+		return manifest, err
+	}
+
+	manifest, err := getManifest(image.GetTag())
+	if err != nil {
+		return nil, err
+	}
+
+	// a multi-arch manifest refers to the manifests of the platforms, which are images
+	if len(manifest.Manifests) > 0 {
+		reference := manifest.platformDigest(platform)
+		if reference == "" {
+			return nil, fmt.Errorf("Image %s has no manifest for platform %s", image, platform)
+		}
+		if manifest, err = getManifest(reference); err != nil {
+			return nil, err
+		}
+		if len(manifest.Manifests) > 0 {
+			return nil, fmt.Errorf("Image %s has a nested manifest list for platform %s, which is not supported", image, platform)
+		}
+	}
+
+	if manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("Image %s has a manifest without layer sizes, schema1 manifests are not supported", image)
+	}
+
+	imageConfig := struct {
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+	}{}
+	if err := config.get(base+"/blobs/"+manifest.Config.Digest, regAuth, scope, &imageConfig); err != nil {
+		return nil, fmt.Errorf("Failed to get config of image %s, error: %s", image, err)
+	}
+
+	layers := []imageLayer{}
+	for i, layer := range manifest.Layers {
+		l := imageLayer{digest: layer.Digest, size: layer.Size}
+		if i < len(imageConfig.RootFS.DiffIDs) {
+			l.diffID = imageConfig.RootFS.DiffIDs[i]
+		}
+		layers = append(layers, l)
+	}
+
+	return layers, nil
+}
+
+// platformDigest returns the digest of the manifest of the platform, e.g. "linux/arm64/v8",
+// among the ones of the multi-arch manifest. The variant is matched only if it is given.
+func (m registryManifest) platformDigest(platform string) string {
+	parts := strings.Split(platform, "/")
+	for _, entry := range m.Manifests {
+		if entry.Platform.OS != parts[0] || len(parts) < 2 || entry.Platform.Architecture != parts[1] {
+			continue
+		}
+		if len(parts) > 2 && entry.Platform.Variant != parts[2] {
+			continue
+		}
+		return entry.Digest
+	}
+	return ""
+}
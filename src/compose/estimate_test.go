@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimatePullSizes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/app/manifests/1.0":
+			fmt.Fprint(w, `{"schemaVersion":2,"manifests":[
+				{"digest":"sha256:arm","platform":{"os":"linux","architecture":"arm64","variant":"v8"}},
+				{"digest":"sha256:amd","platform":{"os":"linux","architecture":"amd64"}}]}`)
+		case "/v2/app/manifests/sha256:amd":
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"digest":"sha256:appconfig"},"layers":[
+				{"digest":"sha256:base","size":1000},{"digest":"sha256:app","size":200}]}`)
+		case "/v2/app/manifests/sha256:arm":
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"digest":"sha256:armconfig"},"layers":[
+				{"digest":"sha256:basearm","size":900}]}`)
+		case "/v2/app/blobs/sha256:appconfig":
+			fmt.Fprint(w, `{"rootfs":{"diff_ids":["sha256:basediff","sha256:appdiff"]}}`)
+		case "/v2/app/blobs/sha256:armconfig":
+			fmt.Fprint(w, `{"rootfs":{"diff_ids":["sha256:basearmdiff"]}}`)
+		case "/v2/worker/manifests/2.0":
+			fmt.Fprint(w, `{"schemaVersion":2,"config":{"digest":"sha256:workerconfig"},"layers":[
+				{"digest":"sha256:base","size":1000},{"digest":"sha256:worker","size":30}]}`)
+		case "/v2/worker/blobs/sha256:workerconfig":
+			fmt.Fprint(w, `{"rootfs":{"diff_ids":["sha256:basediff","sha256:workerdiff"]}}`)
+		case "/v2/worker/tags/list":
+			fmt.Fprint(w, `{"name":"worker","tags":["1.0","2.0"]}`)
+		case "/v2/nested/manifests/1.0":
+			fmt.Fprint(w, `{"schemaVersion":2,"manifests":[{"digest":"sha256:inner","platform":{"os":"linux","architecture":"amd64"}}]}`)
+		case "/v2/nested/manifests/sha256:inner":
+			fmt.Fprint(w, `{"schemaVersion":2,"manifests":[{"digest":"sha256:inner","platform":{"os":"linux","architecture":"amd64"}}]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	config := RegistryConfig{InsecureRegistries: []string{host}}
+
+	images := []*imagename.ImageName{
+		imagename.NewFromString(host + "/app:1.0"),
+		imagename.NewFromString(host + "/worker:2.0"),
+	}
+
+	// nothing is present locally, the base layer is downloaded once
+	estimate, err := EstimatePullSizes(&fakeDockerAPI{}, images, &docker.AuthConfigurations{}, config, "")
+	assert.Nil(t, err)
+	assert.Equal(t, &PullSizeEstimate{
+		Total:  1230,
+		Images: map[string]int64{host + "/app:1.0": 1200, host + "/worker:2.0": 1030},
+	}, estimate)
+
+	local := &fakeDockerAPI{
+		listed: []docker.APIImages{{ID: "sha256:old"}},
+		images: map[string]*docker.Image{
+			"sha256:old": {ID: "sha256:old", RootFS: &docker.RootFS{Layers: []string{"sha256:basediff"}}},
+		},
+	}
+
+	size, err := EstimatePullSize(local, images[0], &docker.AuthConfigurations{}, config, "")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(200), size)
+
+	size, err = EstimatePullSize(local, images[0], &docker.AuthConfigurations{}, config, "linux/arm64/v8")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(900), size)
+
+	_, err = EstimatePullSize(local, images[0], &docker.AuthConfigurations{}, config, "windows/amd64")
+	assert.EqualError(t, err, "Failed to estimate pull size of image "+host+"/app:1.0, error: Image "+host+"/app:1.0 has no manifest for platform windows/amd64")
+
+	// the range is resolved to the tag that would be pulled, the estimate goes by the range
+	estimate, err = EstimatePullSizes(local, []*imagename.ImageName{imagename.NewFromString(host + "/worker:2.*")}, &docker.AuthConfigurations{}, config, "")
+	assert.Nil(t, err)
+	assert.Equal(t, &PullSizeEstimate{Total: 30, Images: map[string]int64{host + "/worker:2.*": 30}}, estimate)
+
+	// the manifest list is followed once
+	_, err = EstimatePullSize(local, imagename.NewFromString(host+"/nested:1.0"), &docker.AuthConfigurations{}, config, "")
+	assert.EqualError(t, err, "Failed to estimate pull size of image "+host+"/nested:1.0, error: Image "+host+
+		"/nested:1.0 has a nested manifest list for platform linux/amd64, which is not supported")
+}
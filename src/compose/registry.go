@@ -0,0 +1,814 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// DefaultRegistryTimeout is the default timeout of a single request to the registry
+var DefaultRegistryTimeout = 30 * time.Second
+
+// DefaultRegistryMaxTags is the default limit of tags listed for a single image
+var DefaultRegistryMaxTags = 10000
+
+// DefaultRegistryUserAgent is the User-Agent of registry requests unless RegistryConfig has one
+var DefaultRegistryUserAgent = "rocker-compose"
+
+// registryManifestTypes are the manifest media types accepted when asking for the image digest,
+// the digest of a schema1 manifest the registry falls back to is not the one docker pulls
+const registryManifestTypes = "application/vnd.docker.distribution.manifest.v2+json, " +
+	"application/vnd.docker.distribution.manifest.list.v2+json, " +
+	"application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json"
+
+// registryImageConfigTypes are the config media types of runnable images, manifests with
+// any other config type are OCI artifacts, e.g. Helm charts or SBOMs
+var registryImageConfigTypes = map[string]bool{
+	"application/vnd.docker.container.image.v1+json": true,
+	"application/vnd.oci.image.config.v1+json":       true,
+}
+
+// RegistryConfig is the configuration of the http client that talks to docker registries
+// when listing image tags. The client respects HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+type RegistryConfig struct {
+	// Timeout limits a single request to the registry, DefaultRegistryTimeout is used if zero
+	Timeout time.Duration
+
+	// MaxTags limits the number of tags listed for an image, DefaultRegistryMaxTags is used if zero
+	MaxTags int
+
+	// InsecureRegistries are talked to over plain http, without certificate verification.
+	// Same as the daemon's --insecure-registry, entries are either host[:port] or CIDR
+	// subnets, e.g. 10.0.0.0/8, that match registries by their ip address.
+	InsecureRegistries []string
+
+	// AuthResolver, if given, finds credentials of the registry, the static
+	// auth configurations are used if it has none
+	AuthResolver AuthResolver
+
+	// HubMirror is the host[:port] of a pull-through mirror of Docker Hub,
+	// tags of Docker Hub images are listed from it if given
+	HubMirror string
+
+	// UserAgent is sent with every registry request, e.g. "rocker-compose/1.2", so registry
+	// proxies can route and rate-limit by it; DefaultRegistryUserAgent is used if empty
+	UserAgent string
+
+	// OnRateLimit, if given, is called for every registry response that reports the rate
+	// limit state in its headers, e.g. Docker Hub ones, so the caller may pause a whole
+	// batch of deploys before the limit is hit. It is not called if there are no headers.
+	OnRateLimit func(limit RateLimit)
+}
+
+// ErrRepositoryNotFound is matched by errors.Is for the errors of listing tags
+// of a repository that does not exist in the registry
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// RepositoryNotFoundError is returned by RegistryListTags if the registry responds
+// with 404 to the tags listing
+type RepositoryNotFoundError struct {
+	Repository string
+	Registry   string
+}
+
+// Error returns string representation of the error
+func (e *RepositoryNotFoundError) Error() string {
+	return fmt.Sprintf("Repository %s not found in registry %s", e.Repository, e.Registry)
+}
+
+// Is makes errors.Is(err, ErrRepositoryNotFound) true
+func (e *RepositoryNotFoundError) Is(target error) bool {
+	return target == ErrRepositoryNotFound
+}
+
+// RateLimit is the rate limit state the registry reports in the response headers, e.g.
+// Docker Hub sends "ratelimit-limit: 100;w=21600" and "ratelimit-remaining: 76;w=21600".
+// Limit is zero if the registry did not report it, Remaining is meaningful only if
+// Limit is set. RetryAfter is taken from the Retry-After header.
+type RateLimit struct {
+	Registry   string
+	Limit      int
+	Remaining  int
+	Window     time.Duration
+	RetryAfter time.Duration
+}
+
+// parseRateLimit reads the rate limit headers of the registry response,
+// it returns false if there are none
+func parseRateLimit(registry string, header http.Header) (RateLimit, bool) {
+	limit := RateLimit{
+		Registry:   registry,
+		RetryAfter: parseRetryAfter(header.Get("Retry-After")),
+	}
+
+	var hasLimit, hasRemaining bool
+	limit.Limit, limit.Window, hasLimit = parseRateLimitHeader(header.Get("Ratelimit-Limit"))
+	limit.Remaining, _, hasRemaining = parseRateLimitHeader(header.Get("Ratelimit-Remaining"))
+	if !hasLimit {
+		limit.Limit = 0
+	}
+
+	return limit, hasLimit || hasRemaining || limit.RetryAfter > 0
+}
+
+// parseRateLimitHeader parses the value of the ratelimit headers, e.g. "100;w=21600"
+// is 100 requests per 6 hours; the window is zero if it is not given
+func parseRateLimitHeader(value string) (count int, window time.Duration, ok bool) {
+	if value == "" {
+		return 0, 0, false
+	}
+
+	parts := strings.Split(value, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "w=") {
+			if seconds, err := strconv.Atoi(param[2:]); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return count, window, true
+}
+
+// RateLimitError is returned when the registry responds with 429 Too Many Requests,
+// e.g. when the Docker Hub pull rate limit is reached. RetryAfter is taken from
+// the Retry-After header if the registry sent it, Limit and Window from the
+// ratelimit-limit one; Limit is zero if the registry did not send it. Pulls through
+// the daemon do not see the headers, their errors have only the message.
+type RateLimitError struct {
+	Registry   string
+	RetryAfter time.Duration
+	Message    string
+
+	Limit  int
+	Window time.Duration
+}
+
+// Error returns string representation of the error
+func (e *RateLimitError) Error() string {
+	registry := e.Registry
+	if isHubRegistry(registry) {
+		registry = "Docker Hub"
+	}
+	msg := fmt.Sprintf("Rate limit of registry %s exceeded (429 Too Many Requests)", registry)
+	if e.Limit > 0 && e.Window > 0 {
+		msg += fmt.Sprintf(", limit %d per %s", e.Limit, e.Window)
+	}
+	if e.RetryAfter > 0 {
+		msg += fmt.Sprintf(", retry after %s", e.RetryAfter)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// isRateLimitMessage returns true for the TOOMANYREQUESTS errors of the registry
+// passed through by the daemon
+func isRateLimitMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "toomanyrequests") || strings.Contains(msg, "too many requests")
+}
+
+// parseRetryAfter parses the Retry-After header that is either seconds or http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(time.Now()); d > 0 {
+			return d.Round(time.Second)
+		}
+	}
+	return 0
+}
+
+// registryStatusError is returned for unexpected HTTP status codes of the registry
+type registryStatusError struct {
+	uri        string
+	statusCode int
+}
+
+// Error returns string representation of the error
+func (e *registryStatusError) Error() string {
+	return fmt.Sprintf("GET %s status code %d", e.uri, e.statusCode)
+}
+
+type registryTags struct {
+	Name string   `json:"name,omitempty"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+type registryBearer struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+// RegistryListTags returns the list of images instances obtained from all tags existing in the registry
+func RegistryListTags(image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig) (images []*imagename.ImageName, err error) {
+	// the rewritten repository is listed, but the tags keep the original name
+	rewritten, err := rewriteImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// AWS ECR does not support tags listing, dockerclient knows how to deal with it
+	if rewritten.IsECR() {
+		listed, err := dockerclient.RegistryListTags(rewritten, auth)
+		if err != nil || rewritten == image {
+			return listed, err
+		}
+		for _, t := range listed {
+			images = append(images, WithTag(image, t.GetTag()))
+		}
+		return images, nil
+	}
+
+	// Docker Hub images are listed from the mirror, but keep their names
+	listed := hubMirrorImage(rewritten, config.HubMirror)
+	base, registry, name := config.repositoryURL(listed)
+
+	var (
+		tags     = []string{}
+		maxTags  = config.MaxTags
+		uri      = base + "/tags/list?page_size=9999&page=1"
+		nextPage = uri
+	)
+
+	if maxTags <= 0 {
+		maxTags = DefaultRegistryMaxTags
+	}
+
+	// registries return big tag lists in pages linked by the Link header
+	for nextPage != "" && len(tags) < maxTags {
+		tg := registryTags{}
+		uri = nextPage
+
+		log.Debugf("Listing image tags from the remote registry %s", uri)
+
+		// credentials are resolved for every page, short-lived tokens may expire in between
+		regAuth, err := getAuthForImage(config.AuthResolver, auth, listed)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login`", image)
+		}
+
+		header, err := config.getWithHeader(uri, regAuth, "repository:"+name+":pull", &tg)
+		if e, ok := err.(*registryStatusError); ok && e.statusCode == http.StatusNotFound {
+			return nil, &RepositoryNotFoundError{Repository: image.Name, Registry: registry}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, tg.Tags...)
+		tracef("Registry listed %d tags of %s from %s", len(tg.Tags), image, redactURL(uri))
+
+		if nextPage, err = nextPageURL(uri, header.Get("Link")); err != nil {
+			return nil, err
+		}
+	}
+
+	if nextPage != "" || len(tags) > maxTags {
+		log.Warnf("Image %s has more than %d tags in the registry, the rest are ignored", image, maxTags)
+		tags = tags[:maxTags]
+	}
+
+	log.Debugf("Got %d tags from the remote registry for image %s", len(tags), image)
+
+	// the filtering is left for findMostRecentTag, it knows about pre-releases;
+	// the tags may be OCI artifacts as well, see RegistryIsImage
+	for _, t := range tags {
+		images = append(images, WithTag(image, t))
+	}
+
+	return
+}
+
+// RegistryImageDigest returns the content digest of the image manifest in the registry,
+// e.g. "sha256:...", without pulling the image. It returns an empty string for AWS ECR
+// images, which are not supported.
+func RegistryImageDigest(image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig) (string, error) {
+	if image.IsECR() {
+		return "", nil
+	}
+
+	listed := hubMirrorImage(image, config.HubMirror)
+	base, registry, name := config.repositoryURL(listed)
+
+	regAuth, err := getAuthForImage(config.AuthResolver, auth, listed)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login`", image)
+	}
+
+	manifest := registryManifest{}
+	header, err := config.getWithAccept(base+"/manifests/"+image.GetTag(), registryManifestTypes, regAuth, "repository:"+name+":pull", &manifest)
+	if e, ok := err.(*registryStatusError); ok && e.statusCode == http.StatusNotFound {
+		return "", &RepositoryNotFoundError{Repository: image.Name, Registry: registry}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return header.Get("Docker-Content-Digest"), nil
+}
+
+// registryManifest holds the fields of an image manifest or index that tell images
+// from OCI artifacts and the layers of the image
+type registryManifest struct {
+	MediaType    string `json:"mediaType"`
+	ArtifactType string `json:"artifactType"`
+	Config       struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+		Size   int64  `json:"size"`
+	} `json:"layers"`
+	Manifests []struct {
+		MediaType    string `json:"mediaType"`
+		ArtifactType string `json:"artifactType"`
+		Digest       string `json:"digest"`
+		Platform     struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+			Variant      string `json:"variant"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// isImage returns false if the manifest is an OCI artifact: it has the artifact type or
+// a config that is not an image one, or it is an index of artifacts only. Schema1
+// manifests and anything unknown are taken as images.
+func (m registryManifest) isImage() bool {
+	if m.ArtifactType != "" {
+		return false
+	}
+	if m.Config.MediaType != "" {
+		return registryImageConfigTypes[m.Config.MediaType]
+	}
+	for _, entry := range m.Manifests {
+		if entry.ArtifactType == "" {
+			return true
+		}
+	}
+	return len(m.Manifests) == 0
+}
+
+// RegistryIsImage tells whether the tag of the image refers to a runnable image rather
+// than an OCI artifact, e.g. a Helm chart or an SBOM kept in the same repository.
+// The manifest is fetched without pulling the image. AWS ECR images are always taken
+// as images, the same way RegistryImageDigest does not support them.
+func RegistryIsImage(image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig) (bool, error) {
+	if image.IsECR() {
+		return true, nil
+	}
+
+	listed := hubMirrorImage(image, config.HubMirror)
+	base, registry, name := config.repositoryURL(listed)
+
+	regAuth, err := getAuthForImage(config.AuthResolver, auth, listed)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login`", image)
+	}
+
+	manifest := registryManifest{}
+	_, err = config.getWithAccept(base+"/manifests/"+image.GetTag(), registryManifestTypes, regAuth, "repository:"+name+":pull", &manifest)
+	if e, ok := err.(*registryStatusError); ok && e.statusCode == http.StatusNotFound {
+		return false, &RepositoryNotFoundError{Repository: image.Name, Registry: registry}
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return manifest.isImage(), nil
+}
+
+// repositoryURL returns the base url of the image repository in the registry API,
+// e.g. https://registry-1.docker.io/v2/library/redis, with Docker Hub defaults applied.
+// Insecure registries are accessed over plain http.
+func (config RegistryConfig) repositoryURL(image *imagename.ImageName) (uri, registry, name string) {
+	registry, name = RegistryHost(image), image.Name
+
+	// e.g. redis, docker.io/redis and index.docker.io/library/redis are all the same
+	if IsDockerHub(image) {
+		name = hubRepositoryName(name)
+	}
+
+	scheme := "https"
+	if config.isInsecure(registry) {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf("%s://%s/v2/%s", scheme, registry, name), registry, name
+}
+
+// nextPageURL parses the Link header of the registry response, e.g.
+// Link: </v2/foo/tags/list?n=100&last=bar>; rel="next"
+// and returns the absolute url of the next page or empty string if there is none
+func nextPageURL(uri, link string) (string, error) {
+	if link == "" {
+		return "", nil
+	}
+
+	for _, part := range strings.Split(link, ",") {
+		fields := strings.Split(part, ";")
+		if len(fields) < 2 {
+			continue
+		}
+
+		isNext := false
+		for _, param := range fields[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == `rel="next"` {
+				isNext = true
+			}
+		}
+		if !isNext {
+			continue
+		}
+
+		ref := strings.Trim(strings.TrimSpace(fields[0]), "<>")
+
+		base, err := url.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		next, err := base.Parse(ref)
+		if err != nil {
+			return "", fmt.Errorf("Failed to parse the next page link %q of %s, error: %s", ref, uri, err)
+		}
+		return next.String(), nil
+	}
+
+	return "", nil
+}
+
+// RegistryListTagsWithFallback is the same as RegistryListTags but tries the fallback
+// registries in order if listing from the image's own registry fails. Returned images
+// keep the original registry of the image, so they match it during resolution.
+func RegistryListTagsWithFallback(image *imagename.ImageName, auth *docker.AuthConfigurations, config RegistryConfig, fallbacks []string) ([]*imagename.ImageName, error) {
+	var (
+		registries = pullRegistries(image, fallbacks)
+		errs       = []string{}
+		notFound   error
+		missing    = 0
+	)
+
+	for _, registry := range registries {
+		candidate := *image
+		candidate.Registry = registry
+
+		images, err := RegistryListTags(&candidate, auth, config)
+		if err != nil && len(registries) == 1 {
+			return nil, err
+		}
+		if err != nil {
+			log.Debugf("Failed to list tags of %s, error: %s", candidate.NameWithRegistry(), err)
+			errs = append(errs, fmt.Sprintf("%s: %s", candidate.NameWithRegistry(), err))
+			if errors.Is(err, ErrRepositoryNotFound) {
+				notFound = err
+				missing++
+			}
+			continue
+		}
+
+		for _, img := range images {
+			img.Registry = image.Registry
+		}
+		return images, nil
+	}
+
+	// the repository is missing everywhere, report it as is
+	if missing == len(registries) {
+		return nil, notFound
+	}
+
+	return nil, fmt.Errorf("Failed to list tags of %s in any of the registries, errors: %s", image, strings.Join(errs, "; "))
+}
+
+// httpClient makes the http client for requests to the registry, TLS certificates
+// of insecure registries are not verified
+func (config RegistryConfig) httpClient(registry string) *http.Client {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRegistryTimeout
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: config.isInsecure(registry)},
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+}
+
+// isInsecure returns true if the registry matches any of InsecureRegistries
+func (config RegistryConfig) isInsecure(registry string) bool {
+	if len(config.InsecureRegistries) == 0 {
+		return false
+	}
+
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+
+	var ips []net.IP
+
+	for _, insecure := range config.InsecureRegistries {
+		if insecure == registry || insecure == host {
+			return true
+		}
+
+		_, subnet, err := net.ParseCIDR(insecure)
+		if err != nil {
+			continue
+		}
+
+		// resolve the registry host only once and only if there are subnets to match
+		if ips == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				ips = []net.IP{ip}
+			} else if ips, err = net.LookupIP(host); err != nil {
+				log.Debugf("Failed to resolve registry host %s, error: %s", host, err)
+				ips = []net.IP{}
+			}
+		}
+
+		for _, ip := range ips {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// userAgent returns the User-Agent of registry requests
+func (config RegistryConfig) userAgent() string {
+	if config.UserAgent != "" {
+		return config.UserAgent
+	}
+	return DefaultRegistryUserAgent
+}
+
+// get executes HTTP get to a given registry. If the registry asks for authentication,
+// it obtains the registry v2 Bearer token for the given scope or uses basic auth
+// depending on the challenge.
+func (config RegistryConfig) get(uri string, auth docker.AuthConfiguration, scope string, obj interface{}) error {
+	_, err := config.getWithHeader(uri, auth, scope, obj)
+	return err
+}
+
+// getWithHeader is the same as get but also returns headers of the response
+func (config RegistryConfig) getWithHeader(uri string, auth docker.AuthConfiguration, scope string, obj interface{}) (header http.Header, err error) {
+	return config.getWithAccept(uri, "", auth, scope, obj)
+}
+
+// getWithAccept is the same as getWithHeader but asks for the given media types, if any
+func (config RegistryConfig) getWithAccept(uri, accept string, auth docker.AuthConfiguration, scope string, obj interface{}) (header http.Header, err error) {
+	var (
+		client *http.Client
+		req    *http.Request
+		res    *http.Response
+		body   []byte
+	)
+
+	if req, err = http.NewRequest("GET", uri, nil); err != nil {
+		return
+	}
+	client = config.httpClient(req.URL.Host)
+	req.Header.Set("User-Agent", config.userAgent())
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	var (
+		b       *registryBearer
+		authTry bool
+	)
+
+	for {
+		if res, err = client.Do(req); err != nil {
+			return nil, fmt.Errorf("Request to %s failed with %s", uri, err)
+		}
+		defer res.Body.Close()
+
+		tracef("Registry GET %s -> HTTP %d, authenticated: %t", redactURL(uri), res.StatusCode, authTry)
+
+		b = parseRegistryBearer(res.Header.Get("Www-Authenticate"))
+		log.Debugf("Got HTTP %d for %s; tried auth: %t; has Bearer: %t, auth username: %q", res.StatusCode, uri, authTry, b != nil, auth.Username)
+
+		if res.StatusCode == 401 && !authTry && b != nil {
+			// some registries do not tell the scope in the challenge
+			if b.Scope == "" {
+				b.Scope = scope
+			}
+
+			token, err := config.getAuthToken(client, b, auth)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to authenticate to registry %s, error: %s", uri, err)
+			}
+
+			req.Header.Add("Authorization", "Bearer "+token)
+
+			authTry = true
+			continue
+		}
+
+		isBasic := strings.HasPrefix(res.Header.Get("Www-Authenticate"), "Basic ")
+
+		if res.StatusCode == 401 && !authTry && isBasic && auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+
+			authTry = true
+			continue
+		}
+
+		break
+	}
+
+	limit, hasLimit := parseRateLimit(req.URL.Host, res.Header)
+	if hasLimit && config.OnRateLimit != nil {
+		config.OnRateLimit(limit)
+	}
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		rateErr := &RateLimitError{
+			Registry:   req.URL.Host,
+			RetryAfter: limit.RetryAfter,
+			Limit:      limit.Limit,
+			Window:     limit.Window,
+		}
+		// the body is e.g. {"errors":[{"code":"TOOMANYREQUESTS","message":"..."}]}
+		regErrs := struct {
+			Errors []struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"errors"`
+		}{}
+		if body, err := ioutil.ReadAll(res.Body); err == nil && json.Unmarshal(body, &regErrs) == nil && len(regErrs.Errors) > 0 {
+			rateErr.Message = strings.ToLower(regErrs.Errors[0].Code) + ": " + regErrs.Errors[0].Message
+		}
+		return nil, rateErr
+	}
+
+	if res.StatusCode != 200 {
+		return nil, &registryStatusError{uri: uri, statusCode: res.StatusCode}
+	}
+
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return nil, fmt.Errorf("Response from %s cannot be read due to error %s", uri, err)
+	}
+
+	if err = json.Unmarshal(body, obj); err != nil {
+		return nil, fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s",
+			uri, err, string(body))
+	}
+
+	return res.Header, nil
+}
+
+// getAuthToken obtains the Bearer token from the auth realm given by the registry,
+// the client of the registry request is used so the realm gets the same TLS settings
+func (config RegistryConfig) getAuthToken(client *http.Client, b *registryBearer, auth docker.AuthConfiguration) (token string, err error) {
+	// OAuth2 compatible token servers may respond with access_token instead of token
+	type authRespType struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+
+	var (
+		req  *http.Request
+		res  *http.Response
+		body []byte
+
+		authResp = &authRespType{}
+	)
+
+	uri, err := url.Parse(b.Realm)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse real url %s, error %s", b.Realm, err)
+	}
+
+	// Add query params to the ream uri
+	q := uri.Query()
+	q.Set("service", b.Service)
+	q.Set("scope", b.Scope)
+	uri.RawQuery = q.Encode()
+
+	if req, err = http.NewRequest("GET", uri.String(), nil); err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", config.userAgent())
+
+	if auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	log.Debugf("Getting auth token from %s", uri)
+
+	if res, err = client.Do(req); err != nil {
+		return "", fmt.Errorf("Failed to authenticate by realm url %s, error %s", uri, err)
+	}
+	defer res.Body.Close()
+
+	tracef("Registry token GET %s -> HTTP %d, with credentials: %t", redactURL(uri.String()), res.StatusCode, auth.Username != "")
+
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("GET %s status code %d", uri, res.StatusCode)
+	}
+
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return "", fmt.Errorf("Response from %s cannot be read due to error %s", uri, err)
+	}
+
+	if err := json.Unmarshal(body, authResp); err != nil {
+		return "", fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s",
+			uri, err, body)
+	}
+
+	if authResp.Token == "" {
+		return authResp.AccessToken, nil
+	}
+
+	return authResp.Token, nil
+}
+
+// parseRegistryBearer parses Www-Authenticate header, e.g.
+// Www-Authenticate: Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:me/alpine:pull"
+func parseRegistryBearer(hdr string) *registryBearer {
+	if !strings.HasPrefix(hdr, "Bearer ") {
+		return nil
+	}
+
+	b := &registryBearer{}
+	hdr = strings.TrimPrefix(hdr, "Bearer ")
+
+	for _, pair := range strings.Split(hdr, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], strings.Trim(kv[1], "\"")
+
+		switch key {
+		case "realm":
+			b.Realm = value
+		case "service":
+			b.Service = value
+		case "scope":
+			b.Scope = value
+		}
+	}
+
+	return b
+}
@@ -0,0 +1,447 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryConfigHTTPClient(t *testing.T) {
+	client := RegistryConfig{}.httpClient("registry.local")
+	assert.Equal(t, DefaultRegistryTimeout, client.Timeout)
+	assert.NotNil(t, client.Transport.(*http.Transport).Proxy)
+
+	client = RegistryConfig{Timeout: 5 * time.Second}.httpClient("registry.local")
+	assert.Equal(t, 5*time.Second, client.Timeout)
+
+	// certificates are not verified only for the insecure registries
+	config := RegistryConfig{InsecureRegistries: []string{"registry.local:5000"}}
+	assert.True(t, config.httpClient("registry.local:5000").Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	assert.False(t, config.httpClient("registry.example.com").Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+}
+
+func TestRegistryGetTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	tg := registryTags{}
+	err := RegistryConfig{Timeout: 50 * time.Millisecond}.get(server.URL+"/v2/foo/tags/list", docker.AuthConfiguration{}, "repository:foo:pull", &tg)
+	assert.Error(t, err)
+}
+
+func TestRegistryGetBearerAuth(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			assert.Equal(t, "user", user)
+			assert.Equal(t, "pass", pass)
+			assert.Equal(t, "repository:foo:pull", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token":"secret"}`)
+		case "/v2/foo/tags/list":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:foo:pull"`, server.URL))
+				w.WriteHeader(401)
+				return
+			}
+			fmt.Fprint(w, `{"name":"foo","tags":["1.0.0","1.1.0"]}`)
+		}
+	}))
+	defer server.Close()
+
+	tg := registryTags{}
+	err := RegistryConfig{}.get(server.URL+"/v2/foo/tags/list", docker.AuthConfiguration{Username: "user", Password: "pass"}, "repository:foo:pull", &tg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.0.0", "1.1.0"}, tg.Tags)
+}
+
+func TestRegistryUserAgent(t *testing.T) {
+	agents := []string{}
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.Header.Get("User-Agent"))
+		switch r.URL.Path {
+		case "/token":
+			fmt.Fprint(w, `{"token":"secret"}`)
+		case "/v2/foo/tags/list":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+				w.WriteHeader(401)
+				return
+			}
+			fmt.Fprint(w, `{"name":"foo","tags":["1.0.0"]}`)
+		}
+	}))
+	defer server.Close()
+
+	tg := registryTags{}
+	err := RegistryConfig{}.get(server.URL+"/v2/foo/tags/list", docker.AuthConfiguration{}, "repository:foo:pull", &tg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rocker-compose", "rocker-compose", "rocker-compose"}, agents)
+
+	agents = []string{}
+	err = RegistryConfig{UserAgent: "rocker-compose/1.2"}.get(server.URL+"/v2/foo/tags/list", docker.AuthConfiguration{}, "repository:foo:pull", &tg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rocker-compose/1.2", "rocker-compose/1.2", "rocker-compose/1.2"}, agents)
+}
+
+func TestParseRegistryBearer(t *testing.T) {
+	b := parseRegistryBearer(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:me/alpine:pull"`)
+	assert.Equal(t, &registryBearer{
+		Realm:   "https://auth.docker.io/token",
+		Service: "registry.docker.io",
+		Scope:   "repository:me/alpine:pull",
+	}, b)
+
+	assert.Nil(t, parseRegistryBearer(`Basic realm="foo"`))
+}
+
+func TestRegistryGetBearerAuthNoScope(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			assert.Equal(t, "repository:private/foo:pull", r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"access_token":"secret"}`)
+		case "/v2/private/foo/tags/list":
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, server.URL))
+				w.WriteHeader(401)
+				return
+			}
+			fmt.Fprint(w, `{"name":"private/foo","tags":["2.1.0"]}`)
+		}
+	}))
+	defer server.Close()
+
+	tg := registryTags{}
+	err := RegistryConfig{}.get(server.URL+"/v2/private/foo/tags/list", docker.AuthConfiguration{Username: "user", Password: "pass"}, "repository:private/foo:pull", &tg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2.1.0"}, tg.Tags)
+}
+
+func TestRegistryGetBasicAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			w.Header().Set("Www-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(401)
+			return
+		}
+		fmt.Fprint(w, `{"name":"foo","tags":["1.0.0"]}`)
+	}))
+	defer server.Close()
+
+	tg := registryTags{}
+	err := RegistryConfig{}.get(server.URL+"/v2/foo/tags/list", docker.AuthConfiguration{Username: "user", Password: "pass"}, "repository:foo:pull", &tg)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.0.0"}, tg.Tags)
+}
+
+func TestRegistryConfigIsInsecure(t *testing.T) {
+	config := RegistryConfig{InsecureRegistries: []string{"registry.local:5000", "10.0.0.0/8", "docker.internal"}}
+
+	assert.True(t, config.isInsecure("registry.local:5000"))
+	assert.False(t, config.isInsecure("registry.local:5001"))
+	assert.True(t, config.isInsecure("10.1.2.3:5000"))
+	assert.True(t, config.isInsecure("10.1.2.3"))
+	assert.False(t, config.isInsecure("192.168.1.1:5000"))
+	assert.True(t, config.isInsecure("docker.internal:443"))
+
+	assert.False(t, RegistryConfig{}.isInsecure("registry.local:5000"))
+}
+
+func TestRegistryListTagsInsecure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/app/tags/list", r.URL.Path)
+		fmt.Fprint(w, `{"name":"app","tags":["1.0","1.1"]}`)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	image := imagename.NewFromString(registry + "/app:1.*")
+	config := RegistryConfig{InsecureRegistries: []string{"127.0.0.0/8"}}
+
+	images, err := RegistryListTags(image, &docker.AuthConfigurations{}, config)
+	assert.Nil(t, err)
+	if assert.Len(t, images, 2) {
+		assert.Equal(t, registry+"/app:1.1", images[1].String())
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	next, err := nextPageURL("https://registry.example.com/v2/app/tags/list?n=2", `</v2/app/tags/list?n=2&last=b>; rel="next"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://registry.example.com/v2/app/tags/list?n=2&last=b", next)
+
+	next, err = nextPageURL("https://registry.example.com/v2/app/tags/list", `<https://other.example.com/page2>; rel="prev", <https://other.example.com/page3>; rel="next"`)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://other.example.com/page3", next)
+
+	next, err = nextPageURL("https://registry.example.com/v2/app/tags/list", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "", next)
+}
+
+func TestRegistryRepositoryURL(t *testing.T) {
+	config := RegistryConfig{}
+
+	tests := []struct {
+		image, uri, name string
+	}{
+		{"redis:3.2", "https://registry-1.docker.io/v2/library/redis", "library/redis"},
+		{"docker.io/redis:3.2", "https://registry-1.docker.io/v2/library/redis", "library/redis"},
+		{"index.docker.io/library/nginx:1.9", "https://registry-1.docker.io/v2/library/nginx", "library/nginx"},
+		{"grammarly/app:1.0", "https://registry-1.docker.io/v2/grammarly/app", "grammarly/app"},
+		{"quay.io/app:1.0", "https://quay.io/v2/app", "app"},
+	}
+
+	for _, test := range tests {
+		uri, _, name := config.repositoryURL(imagename.NewFromString(test.image))
+		assert.Equal(t, test.uri, uri, test.image)
+		assert.Equal(t, test.name, name, test.image)
+	}
+}
+
+func TestRegistryListTagsPagination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("last") {
+		case "":
+			w.Header().Set("Link", `</v2/app/tags/list?n=2&last=1.1>; rel="next"`)
+			fmt.Fprint(w, `{"name":"app","tags":["1.0","1.1"]}`)
+		case "1.1":
+			w.Header().Set("Link", `</v2/app/tags/list?n=2&last=1.3>; rel="next"`)
+			fmt.Fprint(w, `{"name":"app","tags":["1.2","1.3"]}`)
+		default:
+			fmt.Fprint(w, `{"name":"app","tags":["1.4"]}`)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	image := imagename.NewFromString(registry + "/app:1.*")
+	config := RegistryConfig{InsecureRegistries: []string{registry}}
+
+	images, err := RegistryListTags(image, &docker.AuthConfigurations{}, config)
+	assert.Nil(t, err)
+	assert.Len(t, images, 5)
+
+	config.MaxTags = 3
+
+	images, err = RegistryListTags(image, &docker.AuthConfigurations{}, config)
+	assert.Nil(t, err)
+	assert.Len(t, images, 3)
+}
+
+func TestRegistryListTagsHubMirror(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/library/redis/tags/list", r.URL.Path)
+		fmt.Fprint(w, `{"name":"library/redis","tags":["3.0","3.2"]}`)
+	}))
+	defer server.Close()
+
+	mirror := strings.TrimPrefix(server.URL, "http://")
+	config := RegistryConfig{InsecureRegistries: []string{mirror}, HubMirror: mirror}
+
+	images, err := RegistryListTags(imagename.NewFromString("redis:3.*"), &docker.AuthConfigurations{}, config)
+	assert.Nil(t, err)
+	if assert.Len(t, images, 2) {
+		// the images keep their Docker Hub names
+		assert.Equal(t, "redis:3.2", images[1].String())
+	}
+}
+
+func TestRegistryListTagsRewritten(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v2/mirror/grammarly/app/tags/list", r.URL.Path)
+		fmt.Fprint(w, `{"name":"mirror/grammarly/app","tags":["1.0","1.1"]}`)
+	}))
+	defer server.Close()
+
+	internal := strings.TrimPrefix(server.URL, "http://")
+	config := RegistryConfig{InsecureRegistries: []string{internal}}
+
+	defer func() { ImageRewriter = nil }()
+	ImageRewriter = func(image *imagename.ImageName) (*imagename.ImageName, error) {
+		if strings.HasPrefix(image.Name, "blocked/") {
+			return nil, errors.New("namespace blocked/ is not allowed")
+		}
+		if IsDockerHub(image) && strings.HasPrefix(image.Name, "grammarly/") {
+			rewritten := *image
+			rewritten.Registry = internal
+			rewritten.Name = "mirror/" + image.Name
+			return &rewritten, nil
+		}
+		return image, nil
+	}
+
+	images, err := RegistryListTags(imagename.NewFromString("grammarly/app:1.*"), &docker.AuthConfigurations{}, config)
+	assert.Nil(t, err)
+	if assert.Len(t, images, 2) {
+		// the images keep their original names
+		assert.Equal(t, "grammarly/app:1.1", images[1].String())
+	}
+
+	_, err = RegistryListTags(imagename.NewFromString("blocked/app:1.*"), &docker.AuthConfigurations{}, config)
+	assert.EqualError(t, err, "Image blocked/app:1.* is rejected: namespace blocked/ is not allowed")
+}
+
+func TestRegistryListTagsRepositoryNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	image := imagename.NewFromString(registry + "/missing:1.*")
+	config := RegistryConfig{InsecureRegistries: []string{registry}}
+
+	_, err := RegistryListTags(image, &docker.AuthConfigurations{}, config)
+	assert.True(t, errors.Is(err, ErrRepositoryNotFound))
+	assert.EqualError(t, err, "Repository missing not found in registry "+registry)
+
+	_, err = RegistryListTagsWithFallback(image, &docker.AuthConfigurations{}, config, []string{registry, "127.0.0.1:1"})
+	assert.False(t, errors.Is(err, ErrRepositoryNotFound))
+}
+
+func TestRegistryListTagsRateLimit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"errors":[{"code":"TOOMANYREQUESTS","message":"You have reached your pull rate limit"}]}`)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	image := imagename.NewFromString(registry + "/app:1.*")
+	config := RegistryConfig{InsecureRegistries: []string{registry}}
+
+	_, err := RegistryListTags(image, &docker.AuthConfigurations{}, config)
+
+	rateErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected *RateLimitError, got %#v", err)
+	}
+	assert.Equal(t, 30*time.Second, rateErr.RetryAfter)
+	assert.EqualError(t, err, "Rate limit of registry "+registry+" exceeded (429 Too Many Requests), retry after 30s: toomanyrequests: You have reached your pull rate limit")
+}
+
+func TestRegistryRateLimitHeaders(t *testing.T) {
+	remaining := "1;w=21600"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Ratelimit-Limit", "100;w=21600")
+		w.Header().Set("Ratelimit-Remaining", remaining)
+		if remaining == "0;w=21600" {
+			w.Header().Set("Retry-After", "60")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, `{"name":"app","tags":["1.0"]}`)
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	image := imagename.NewFromString(registry + "/app:1.*")
+
+	limits := []RateLimit{}
+	config := RegistryConfig{
+		InsecureRegistries: []string{registry},
+		OnRateLimit:        func(limit RateLimit) { limits = append(limits, limit) },
+	}
+
+	if _, err := RegistryListTags(image, &docker.AuthConfigurations{}, config); err != nil {
+		t.Fatal(err)
+	}
+
+	remaining = "0;w=21600"
+	_, err := RegistryListTags(image, &docker.AuthConfigurations{}, config)
+
+	rateErr, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected *RateLimitError, got %#v", err)
+	}
+	assert.Equal(t, 100, rateErr.Limit)
+	assert.Equal(t, 6*time.Hour, rateErr.Window)
+	assert.EqualError(t, err, "Rate limit of registry "+registry+" exceeded (429 Too Many Requests), limit 100 per 6h0m0s, retry after 1m0s")
+
+	assert.Equal(t, []RateLimit{
+		{Registry: registry, Limit: 100, Remaining: 1, Window: 6 * time.Hour},
+		{Registry: registry, Limit: 100, Remaining: 0, Window: 6 * time.Hour, RetryAfter: time.Minute},
+	}, limits)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	_, ok := parseRateLimit("quay.io", http.Header{})
+	assert.False(t, ok)
+
+	header := http.Header{}
+	header.Set("Ratelimit-Remaining", "5")
+	limit, ok := parseRateLimit("quay.io", header)
+	assert.True(t, ok)
+	assert.Equal(t, RateLimit{Registry: "quay.io", Remaining: 5}, limit)
+
+	header.Set("Ratelimit-Limit", "garbage")
+	limit, ok = parseRateLimit("quay.io", header)
+	assert.True(t, ok)
+	assert.Equal(t, 0, limit.Limit)
+}
+
+func TestRegistryManifestIsImage(t *testing.T) {
+	tests := []struct {
+		manifest string
+		isImage  bool
+	}{
+		{`{"schemaVersion":1}`, true},
+		{`{"schemaVersion":2,"config":{"mediaType":"application/vnd.docker.container.image.v1+json"}}`, true},
+		{`{"schemaVersion":2,"config":{"mediaType":"application/vnd.oci.image.config.v1+json"}}`, true},
+		{`{"schemaVersion":2,"config":{"mediaType":"application/vnd.cncf.helm.config.v1+json"}}`, false},
+		{`{"schemaVersion":2,"artifactType":"application/spdx+json","config":{"mediaType":"application/vnd.oci.empty.v1+json"}}`, false},
+		{`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json"}]}`, true},
+		{`{"schemaVersion":2,"manifests":[{"artifactType":"application/spdx+json"}]}`, false},
+	}
+
+	for _, test := range tests {
+		manifest := registryManifest{}
+		if err := json.Unmarshal([]byte(test.manifest), &manifest); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.isImage, manifest.isImage(), test.manifest)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)))
+	assert.True(t, parseRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)) > 59*time.Minute)
+}
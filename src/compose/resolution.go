@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// ResolutionRecorder collects what the images were resolved to across many pulls,
+// e.g. to commit the summary of a deploy back to the repository. It is passed to the
+// pulls by PullOptions.Recorder and is safe for concurrent use. A nil recorder
+// records nothing. DockerClient records the images of the containers under the specs
+// of the manifest, e.g. app:~1.2, including the ones present locally and not pulled,
+// and ResolveImageTag records every lookup that is not cached.
+type ResolutionRecorder struct {
+	mu      sync.Mutex
+	records []ResolutionRecord
+	now     func() time.Time
+}
+
+// ResolutionRecord is what a single image reference was resolved to
+type ResolutionRecord struct {
+	// Spec is the image as it was asked for, e.g. app:1.2.7 or redis
+	Spec string `json:"spec"`
+
+	// Image is the image that was actually used, its registry may differ from
+	// the one of Spec if it was pulled from a fallback registry
+	Image    string `json:"image"`
+	Tag      string `json:"tag"`
+	Digest   string `json:"digest,omitempty"`
+	Registry string `json:"registry,omitempty"`
+
+	// Source is ResolvedFromLocal if the image present locally was used
+	// or ResolvedFromRegistry if it was pulled; ResolveImageTag records
+	// where the tag was found, ResolvedFromExact if Spec had no range
+	Source ResolvedFrom `json:"source"`
+
+	Time time.Time `json:"time"`
+}
+
+// ResolutionSummary is the JSON document of the recorded resolutions
+type ResolutionSummary struct {
+	Images []ResolutionRecord `json:"images"`
+}
+
+// NewResolutionRecorder returns an empty ResolutionRecorder
+func NewResolutionRecorder() *ResolutionRecorder {
+	return &ResolutionRecorder{
+		records: []ResolutionRecord{},
+		now:     time.Now,
+	}
+}
+
+// Summary returns the records in the order of the completed pulls
+func (r *ResolutionRecorder) Summary() ResolutionSummary {
+	if r == nil {
+		return ResolutionSummary{Images: []ResolutionRecord{}}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return ResolutionSummary{Images: append([]ResolutionRecord{}, r.records...)}
+}
+
+// record adds the resolution of the image, it does nothing on a nil recorder
+func (r *ResolutionRecorder) record(spec string, image *imagename.ImageName, digest string, source ResolvedFrom) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records = append(r.records, ResolutionRecord{
+		Spec:     spec,
+		Image:    image.String(),
+		Tag:      image.GetTag(),
+		Digest:   digest,
+		Registry: image.Registry,
+		Source:   source,
+		Time:     r.now().UTC(),
+	})
+}
@@ -0,0 +1,136 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker-compose/src/compose/config"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolutionRecorder(t *testing.T) {
+	recorder := NewResolutionRecorder()
+	recorder.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	client := &fakeDockerAPI{
+		images: map[string]*docker.Image{
+			"redis:3.2": {ID: "redis", RepoDigests: []string{"redis@sha256:aaa"}},
+		},
+	}
+	auth := &docker.AuthConfigurations{}
+
+	if _, err := PullDockerImageWithOptions(client, imagename.NewFromString("quay.io/org/app:1.0"), auth, PullOptions{Recorder: recorder}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PullDockerImageWithOptions(client, imagename.NewFromString("redis:3.2"), auth, PullOptions{Policy: PullIfNotPresent, Recorder: recorder}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(recorder.Summary())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"images":[` +
+		`{"spec":"quay.io/org/app:1.0","image":"quay.io/org/app:1.0","tag":"1.0","registry":"quay.io","source":"registry","time":"2017-07-14T02:40:00Z"},` +
+		`{"spec":"redis:3.2","image":"redis:3.2","tag":"3.2","digest":"sha256:aaa","source":"local","time":"2017-07-14T02:40:00Z"}` +
+		`]}`
+	assert.Equal(t, expected, string(data))
+
+	// nothing is recorded without the recorder
+	var none *ResolutionRecorder
+	none.record("redis:3.2", imagename.NewFromString("redis:3.2"), "", ResolvedFromLocal)
+	assert.Empty(t, none.Summary().Images)
+}
+
+func TestResolutionRecorderClient(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/worker/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"name":"worker","tags":["2.0.1"]}`)
+	}))
+	defer registry.Close()
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+	pulled := false
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/images/json":
+			fmt.Fprint(w, `[{"Id":"old","RepoTags":["app:1.2.5"]}]`)
+		case "/images/app:1.2.5/json":
+			fmt.Fprint(w, `{"Id":"old","RepoDigests":["app@sha256:aaa"]}`)
+		case "/images/create":
+			pulled = true
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+		case "/images/" + host + "/worker:2.0.1/json":
+			if !pulled {
+				http.Error(w, "no such image", http.StatusNotFound)
+				return
+			}
+			fmt.Fprintf(w, `{"Id":"new","RepoDigests":["%s/worker@sha256:bbb"]}`, host)
+		default:
+			t.Fatalf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	dockerCli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := NewResolutionRecorder()
+	recorder.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+	client := &DockerClient{
+		Docker:      dockerCli,
+		Auth:        &docker.AuthConfigurations{},
+		Registry:    RegistryConfig{InsecureRegistries: []string{host}},
+		PullOptions: PullOptions{Policy: PullIfNotPresent, Recorder: recorder},
+	}
+	containers := []*Container{
+		{Name: config.NewContainerName("test", "app"), Image: imagename.NewFromString("app:~1.2")},
+		{Name: config.NewContainerName("test", "worker"), Image: imagename.NewFromString(host + "/worker:~2.0")},
+	}
+
+	if err := client.PullAll(containers, template.Vars{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ranges are recorded as asked for, the image present locally is recorded as well
+	expected := []ResolutionRecord{
+		{Spec: "app:~1.2", Image: "app:1.2.5", Tag: "1.2.5", Digest: "sha256:aaa", Source: ResolvedFromLocal},
+		{Spec: host + "/worker:~2.0", Image: host + "/worker:2.0.1", Tag: "2.0.1", Digest: "sha256:bbb", Registry: host, Source: ResolvedFromRegistry},
+	}
+	for i := range expected {
+		expected[i].Time = time.Unix(1500000000, 0).UTC()
+	}
+	assert.Equal(t, expected, recorder.Summary().Images)
+}
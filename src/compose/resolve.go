@@ -0,0 +1,639 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// imagename.ImageName is vendored from rocker, so the helpers of this file that inspect or
+// build image names, e.g. ImageMatches, RegistryHost, WithTag or IsFloating, are functions
+// taking the image rather than its methods.
+
+var (
+	prereleaseRe = regexp.MustCompile(`\d[-_][0-9A-Za-z]`)
+	dateTagRe    = regexp.MustCompile(`^\d{4}[-_.]?\d{2}[-_.]?\d{2}([-_.T]?\d+)*$`)
+	nonDigitRe   = regexp.MustCompile(`\D`)
+)
+
+// ResolveStrategy defines how tags are matched and compared when resolving wildcards
+type ResolveStrategy string
+
+const (
+	// ResolveSemver treats tags as semantic versions, this is the default
+	ResolveSemver ResolveStrategy = "semver"
+
+	// ResolveDate additionally understands timestamp tags such as 20240115-1430 or 2024-01-15:
+	// glob wildcards like 2024* match them and the newest timestamp wins. Tags that are not
+	// timestamps are still compared as semantic versions.
+	ResolveDate ResolveStrategy = "date"
+)
+
+// ResolvedFrom tells where the tag of a resolved image was found
+type ResolvedFrom string
+
+const (
+	// ResolvedFromLocal means the tag was taken from the images present on the docker host
+	ResolvedFromLocal ResolvedFrom = "local"
+
+	// ResolvedFromRegistry means the tag was found only among the remote tags of the image
+	ResolvedFromRegistry ResolvedFrom = "registry"
+
+	// ResolvedFromExact means the image was strict, e.g. redis:2.8.11, nothing was resolved
+	ResolvedFromExact ResolvedFrom = "exact"
+)
+
+// WildcardPolicy defines what the explicit wildcard tag, e.g. app:*, means for the pull.
+// Unlike a version range such as ~1.4, which stands for the newest matching tag, the
+// wildcard matches every version of the image.
+type WildcardPolicy string
+
+const (
+	// WildcardNewest resolves the wildcard to the newest tag the same way as a version range,
+	// this is the default
+	WildcardNewest WildcardPolicy = "newest"
+
+	// WildcardAll also pulls all the other tags of the image, e.g. to warm up a host that
+	// may be rolled back; containers still run the newest tag
+	WildcardAll WildcardPolicy = "all"
+)
+
+// isWildcardTag returns true if the image has the explicit wildcard tag, e.g. app:* or app:x.
+// imagename.ImageName.All is true for images without a tag as well, but those mean "latest".
+func isWildcardTag(image *imagename.ImageName) bool {
+	return image.HasTag() && image.All()
+}
+
+// ResolveOptions tunes how image version ranges are resolved to concrete tags
+type ResolveOptions struct {
+	// IncludePrerelease lets ranges with no pre-release component, e.g. ~1.4.0,
+	// match pre-release tags such as 1.4.1-rc1 or 1.4.1-beta
+	IncludePrerelease bool
+
+	// Strategy is the way tags are compared, ResolveSemver is used if empty
+	Strategy ResolveStrategy
+
+	// IgnoreLatest disables the preference of the "latest" tag: images without a tag
+	// and wildcards, e.g. app:*, resolve only to tags that are versions
+	IgnoreLatest bool
+
+	// StrictPinning fails the resolution if any image ends up referenced by a floating tag,
+	// see IsFloating; it is a policy gate for production deploys
+	StrictPinning bool
+
+	// VerifyFloatingTags makes images present locally under floating tags, e.g. "latest" or
+	// "stable", be checked against the registry when they would not be pulled otherwise:
+	// if the tag points to another digest now, the image is pulled again. Exact versions
+	// and digests are not checked, see IsFloating.
+	VerifyFloatingTags bool
+
+	// Wildcard is what the explicit wildcard tag, e.g. app:*, means for the pull,
+	// WildcardNewest is used if empty
+	Wildcard WildcardPolicy
+
+	// IncludeArtifacts lets remote tags that are OCI artifacts rather than images, e.g. Helm
+	// charts or SBOMs kept in the same repository, be resolved as well. By default the
+	// manifest of a remote candidate is checked and artifacts are skipped.
+	IncludeArtifacts bool
+
+	// IgnoreTags are the tags never chosen by version ranges, wildcards or images without
+	// a tag, e.g. moving dev tags such as "edge" or "nightly"; glob patterns like "canary-*"
+	// are accepted. The image is still used if it asks for such a tag explicitly, e.g. app:edge.
+	IgnoreTags []string
+
+	// Cache, if given, keeps the results of ResolveImageTag for its TTL, so repeated deploys
+	// of a long-running process do not hit the registry for the same range every time
+	Cache *ResolveCache
+}
+
+// findMostRecentTag finds an applicable tag for the image among the local images and
+// the tags available remotely. It works the same way as imagename.ImageName.ResolveVersion
+// but follows semver 2.0 rules for pre-releases: they have lower precedence than the release
+// of the same version and are skipped entirely unless the range itself has a pre-release
+// component or ResolveOptions.IncludePrerelease is set. With the ResolveDate strategy it
+// also resolves glob wildcards over timestamp tags. Candidates of equal versions are
+// chosen by winsTie, so the result does not depend on the order of the lists.
+func findMostRecentTag(image *imagename.ImageName, local, remote []*imagename.ImageName, strictS3Match bool, opts ResolveOptions) (result *imagename.ImageName) {
+	isLocal := map[*imagename.ImageName]bool{}
+	for _, candidate := range local {
+		isLocal[candidate] = true
+	}
+
+	list := append(append([]*imagename.ImageName{}, local...), remote...)
+
+	for _, candidate := range list {
+		// If these are different images (different names/repos)
+		if !SameRepo(image, candidate) {
+			continue
+		}
+
+		if strictS3Match && image.IsOldS3Name != candidate.IsOldS3Name {
+			continue
+		}
+
+		// If we have a strict equality
+		if image.HasTag() && candidate.HasTag() && image.Tag == candidate.Tag {
+			return candidate
+		}
+
+		if opts.isIgnoredTag(candidate.GetTag()) {
+			continue
+		}
+
+		// If image is without tag, latest will be fine
+		if !image.HasTag() && candidate.GetTag() == imagename.Latest && !opts.IgnoreLatest {
+			return candidate
+		}
+
+		// latest often points to a dev build, consider only the tags satisfying the range
+		if opts.IgnoreLatest && candidate.GetTag() == imagename.Latest {
+			continue
+		}
+
+		// versions are compared by the normalized tags, the original ones are used for the pull
+		version := versionTagged(candidate)
+
+		if !tagContains(image, version, opts) {
+			continue
+		}
+
+		if result == nil {
+			result = candidate
+			continue
+		}
+
+		resultVersion := versionTagged(result)
+
+		if isNewerTag(version, resultVersion, opts) ||
+			(!isNewerTag(resultVersion, version, opts) && winsTie(image, candidate, result, isLocal)) {
+			result = candidate
+		}
+	}
+
+	return
+}
+
+// matchingTags returns the candidates findMostRecentTag would choose from: the images of the
+// same repository whose tags satisfy the image's range, or all of them if the image has no tag.
+// The same image listed several times, e.g. locally and remotely, is returned once.
+func matchingTags(image *imagename.ImageName, list []*imagename.ImageName, opts ResolveOptions) []*imagename.ImageName {
+	seen := map[string]bool{}
+	result := []*imagename.ImageName{}
+
+	for _, candidate := range list {
+		if !SameRepo(image, candidate) || seen[candidate.String()] {
+			continue
+		}
+		if image.HasTag() && image.Tag != candidate.Tag && !tagContains(image, versionTagged(candidate), opts) {
+			continue
+		}
+		if opts.IgnoreLatest && candidate.GetTag() == imagename.Latest {
+			continue
+		}
+		if image.Tag != candidate.Tag && opts.isIgnoredTag(candidate.GetTag()) {
+			continue
+		}
+		seen[candidate.String()] = true
+		result = append(result, candidate)
+	}
+
+	return result
+}
+
+// sortTags sorts the images newest first: latest goes first, then the comparable tags by
+// version descending (a pre-release goes after the release of the same version, as semver
+// says), then the rest lexically. Equal versions, e.g. "1.2.0" and "v1.2.0", are ordered
+// lexically as well, so the result does not depend on the order of the list.
+func sortTags(images []*imagename.ImageName, opts ResolveOptions) {
+	rank := func(image *imagename.ImageName) int {
+		switch {
+		case image.GetTag() == imagename.Latest:
+			return 0
+		case versionTagged(image).HasVersion() || (opts.Strategy == ResolveDate && isDateTag(image)):
+			return 1
+		}
+		return 2
+	}
+
+	sort.SliceStable(images, func(i, j int) bool {
+		a, b := images[i], images[j]
+		if rankA, rankB := rank(a), rank(b); rankA != rankB {
+			return rankA < rankB
+		}
+		if rank(a) == 1 {
+			versionA, versionB := versionTagged(a), versionTagged(b)
+			if isNewerTag(versionA, versionB, opts) {
+				return true
+			}
+			if isNewerTag(versionB, versionA, opts) {
+				return false
+			}
+		}
+		if a.GetTag() != b.GetTag() {
+			return a.GetTag() < b.GetTag()
+		}
+		return a.String() < b.String()
+	})
+}
+
+// winsTie returns true if the candidate should replace the result of the same version,
+// e.g. "1.2.0" and "v1.2.0". The local image goes first, then the one of the image's own
+// registry, then the lexically smaller registry and at last the lexically smaller tag.
+func winsTie(image, candidate, result *imagename.ImageName, isLocal map[*imagename.ImageName]bool) bool {
+	if isLocal[candidate] != isLocal[result] {
+		return isLocal[candidate]
+	}
+	own := RegistryHost(image)
+	if ownCandidate, ownResult := RegistryHost(candidate) == own, RegistryHost(result) == own; ownCandidate != ownResult {
+		return ownCandidate
+	}
+	if RegistryHost(candidate) != RegistryHost(result) {
+		return RegistryHost(candidate) < RegistryHost(result)
+	}
+	return candidate.Tag < result.Tag
+}
+
+// isNewerTag returns true if the candidate tag is more recent than the current result
+func isNewerTag(candidate, result *imagename.ImageName, opts ResolveOptions) bool {
+	// timestamps of the same format compare correctly as strings of digits
+	if opts.Strategy == ResolveDate && isDateTag(candidate) && isDateTag(result) {
+		return nonDigitRe.ReplaceAllString(result.Tag, "") < nonDigitRe.ReplaceAllString(candidate.Tag, "")
+	}
+
+	// uncomparable candidate... skipping
+	if !candidate.HasVersion() {
+		return false
+	}
+
+	return result.HasVersion() && result.TagAsVersion().Less(candidate.TagAsVersion())
+}
+
+// isIgnoredTag returns true if the tag is one of IgnoreTags or matches one of their patterns
+func (opts ResolveOptions) isIgnoredTag(tag string) bool {
+	for _, pattern := range opts.IgnoreTags {
+		if matched, _ := path.Match(pattern, tag); matched || pattern == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// tagContains returns true if the image tag wildcard satisfies the candidate's version
+func tagContains(image, candidate *imagename.ImageName, opts ResolveOptions) bool {
+	// e.g. 2024* is not a semver range, match it as a glob
+	if opts.Strategy == ResolveDate && !image.HasVersionRange() && strings.ContainsAny(image.Tag, "*?[") {
+		matched, _ := path.Match(image.Tag, candidate.Tag)
+		return matched && SameRepo(image, candidate)
+	}
+
+	// timestamps like 20240115-1430 parse as semver pre-releases, but they are not
+	if opts.Strategy == ResolveDate && isDateTag(candidate) {
+		return ImageContains(image, candidate)
+	}
+
+	if isPrerelease(candidate) && !opts.IncludePrerelease && !prereleaseRe.MatchString(image.Tag) {
+		return false
+	}
+
+	// empty (wildcard) semver range cannot contain anything, see imagename.ImageName.Contains
+	if image.All() {
+		return SameRepo(image, candidate)
+	}
+
+	if opts.IncludePrerelease && image.HasVersionRange() && candidate.HasVersion() {
+		return SameRepo(image, candidate) && image.Version.Contains(candidate.TagAsVersion())
+	}
+
+	return ImageContains(image, candidate)
+}
+
+// ImageContains is imagename.ImageName.Contains that knows Docker Hub aliases the same way
+// as SameRepo, e.g. library/redis:3.* contains redis:3.2.1
+func ImageContains(image, candidate *imagename.ImageName) bool {
+	if !SameRepo(image, candidate) {
+		return false
+	}
+	same := *candidate
+	same.Registry, same.Name = image.Registry, image.Name
+	return image.Contains(&same)
+}
+
+// ImageMatches returns true if the image matches the glob pattern of the repository and,
+// optionally, of the tag, e.g. "myorg/*", "*/nginx", "quay.io/myorg/app:1.*" or "redis".
+// The patterns follow path.Match, so "*" and "?" do not cross "/". Like image names,
+// patterns without a registry are of Docker Hub and official images may go without
+// "library/". Tags are matched as text, see ImageContains for version ranges.
+func ImageMatches(image *imagename.ImageName, pattern string) bool {
+	repoPattern, tagPattern := splitImagePattern(pattern)
+
+	patternRegistry, patternName := "", repoPattern
+	if i := strings.Index(repoPattern, "/"); i >= 0 {
+		if first := repoPattern[:i]; strings.ContainsAny(first, ".:") || first == "localhost" {
+			patternRegistry, patternName = first, repoPattern[i+1:]
+		}
+	}
+	if isHubRegistry(patternRegistry) {
+		patternRegistry = ""
+		patternName = strings.TrimPrefix(patternName, "library/")
+	}
+
+	registry, name := normalizeRepo(image)
+
+	if matched, _ := path.Match(patternRegistry, registry); !matched {
+		return false
+	}
+	if matched, _ := path.Match(patternName, name); !matched {
+		return false
+	}
+	if tagPattern == "" {
+		return true
+	}
+	matched, _ := path.Match(tagPattern, image.GetTag())
+	return matched
+}
+
+// splitImagePattern splits the image pattern to the repository and the tag or digest ones,
+// the tag is empty if the pattern has none
+func splitImagePattern(pattern string) (repo, tag string) {
+	if i := strings.LastIndex(pattern, "@"); i >= 0 {
+		return pattern[:i], pattern[i+1:]
+	}
+	if i := strings.LastIndex(pattern, ":"); i > strings.LastIndex(pattern, "/") {
+		return pattern[:i], pattern[i+1:]
+	}
+	return pattern, ""
+}
+
+// isPrerelease returns true if the image tag is a semver pre-release, e.g. 1.4.0-rc1
+func isPrerelease(image *imagename.ImageName) bool {
+	ver := image.TagAsVersion()
+	return ver != nil && ver.IsAPreRelease()
+}
+
+// isDowngrade returns true if the resolved image has a lower version than the running one
+func isDowngrade(running, resolved *imagename.ImageName) bool {
+	return IsUpgradeFrom(running, resolved)
+}
+
+// SameRepo returns true if both images refer to the same repository regardless of their
+// tags or digests, e.g. to tell an upgrade of the image from its replacement. Unlike
+// imagename.ImageName.IsSameKind it knows Docker Hub aliases, so "redis" and
+// "docker.io/library/redis" are the same repository.
+func SameRepo(a, b *imagename.ImageName) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	registryA, nameA := normalizeRepo(a)
+	registryB, nameB := normalizeRepo(b)
+	return a.Storage == b.Storage && registryA == registryB && nameA == nameB
+}
+
+// IsUpgradeFrom returns true if the desired image is of the same repository as the other
+// one and has a greater version, e.g. app:1.3.0 is an upgrade from app:1.2.3. Tags that
+// are not versions, such as "latest", are never an upgrade since they cannot be compared.
+func IsUpgradeFrom(desired, other *imagename.ImageName) bool {
+	if !SameRepo(desired, other) {
+		return false
+	}
+	desired, other = versionTagged(desired), versionTagged(other)
+	if !desired.HasVersion() || !other.HasVersion() {
+		return false
+	}
+	return other.TagAsVersion().Less(desired.TagAsVersion())
+}
+
+// normalizeRepo returns the registry and the repository name of the image with
+// Docker Hub aliases resolved to the empty registry and the "library/" prefix dropped
+func normalizeRepo(image *imagename.ImageName) (registry, name string) {
+	registry, name = image.Registry, image.Name
+	if IsDockerHub(image) {
+		registry = ""
+		name = strings.TrimPrefix(name, "library/")
+	}
+	return registry, name
+}
+
+// DockerHubHost is the host of the Docker Hub registry API
+const DockerHubHost = "registry-1.docker.io"
+
+// RegistryHost returns the host[:port] of the registry the image is pulled from; it is
+// DockerHubHost for Docker Hub images, e.g. redis or docker.io/library/redis.
+func RegistryHost(image *imagename.ImageName) string {
+	return registryHost(image.Registry)
+}
+
+// registryHost is RegistryHost of the registry name, e.g. a fallback one
+func registryHost(registry string) string {
+	if isHubRegistry(registry) {
+		return DockerHubHost
+	}
+	return registry
+}
+
+// IsDockerHub returns true if the image is in Docker Hub, whichever alias of it is used,
+// including no registry at all
+func IsDockerHub(image *imagename.ImageName) bool {
+	return isHubRegistry(image.Registry)
+}
+
+// isHubRegistry returns true for the registry names of Docker Hub, including the empty one
+func isHubRegistry(registry string) bool {
+	switch registry {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+		return true
+	}
+	return false
+}
+
+// hubRepositoryName returns the name of the Docker Hub repository for the registry API,
+// official images live in the "library" namespace, e.g. redis is library/redis
+func hubRepositoryName(name string) string {
+	if !strings.Contains(name, "/") {
+		return "library/" + name
+	}
+	return name
+}
+
+// versionTagged returns a copy of the image with the "V" prefix of the tag lowercased,
+// e.g. V2.0.0 becomes v2.0.0; imagename.ImageName.TagAsVersion strips only the lowercase one.
+// Other images are returned as is.
+func versionTagged(image *imagename.ImageName) *imagename.ImageName {
+	if len(image.Tag) < 2 || image.Tag[0] != 'V' || image.Tag[1] < '0' || image.Tag[1] > '9' {
+		return image
+	}
+	return WithTag(image, "v"+image.Tag[1:])
+}
+
+// containsImage returns true if the list has an image of the same name and tag
+func containsImage(list []*imagename.ImageName, image *imagename.ImageName) bool {
+	for _, img := range list {
+		if img.String() == image.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutImage returns a copy of the list without the images of the same name and tag
+func withoutImage(list []*imagename.ImageName, image *imagename.ImageName) []*imagename.ImageName {
+	result := []*imagename.ImageName{}
+	for _, img := range list {
+		if img.String() != image.String() {
+			result = append(result, img)
+		}
+	}
+	return result
+}
+
+// WithTag returns a copy of the image with the given tag, the image itself is not changed
+func WithTag(image *imagename.ImageName, tag string) *imagename.ImageName {
+	result := *image
+	result.SetTag(tag)
+	return &result
+}
+
+// WithDigest returns a copy of the image pinned to the content digest, e.g. "sha256:...",
+// which String renders as name@digest; the image itself is not changed
+func WithDigest(image *imagename.ImageName, digest string) *imagename.ImageName {
+	return WithTag(image, digest)
+}
+
+// isDateTag returns true if the image tag looks like a timestamp, e.g. 20240115-1430
+func isDateTag(image *imagename.ImageName) bool {
+	return dateTagRe.MatchString(image.Tag)
+}
+
+// MutableTags are the well-known moving aliases IsFloating treats as floating even if they
+// look like exact versions; glob patterns are accepted, e.g. "*-beta*". Other names that
+// are neither versions nor timestamps are floating anyway, the list documents the common
+// ones. Add major version aliases such as "3" or "3.2" for repositories that move them.
+var MutableTags = []string{"latest", "stable", "edge", "nightly", "canary", "dev", "main", "master"}
+
+// IsFloating returns true if the image reference may point to different images over time:
+// "latest" or no tag at all, version ranges and wildcards, e.g. ~1.2 or 1.2.*, any of
+// MutableTags and names such as "stable". Digests, exact versions, e.g. 1.2.3 or v1.2.3-rc1,
+// and timestamp tags are pinned.
+func IsFloating(image *imagename.ImageName) bool {
+	if image.TagIsDigest() {
+		return false
+	}
+	if !image.IsStrict() || image.GetTag() == imagename.Latest {
+		return true
+	}
+	for _, pattern := range MutableTags {
+		if matched, _ := path.Match(pattern, image.Tag); matched || pattern == image.Tag {
+			return true
+		}
+	}
+	return !versionTagged(image).HasVersion() && !isDateTag(image)
+}
+
+// checkPinned returns an error naming every container whose image is referenced by a mutable tag
+func checkPinned(containers []*Container) error {
+	offending := []string{}
+	for _, container := range containers {
+		if container.Image != nil && IsFloating(container.Image) {
+			offending = append(offending, fmt.Sprintf("%s (container %s)", container.Image, container.Name))
+		}
+	}
+	if len(offending) > 0 {
+		return fmt.Errorf("Strict pinning is on, but images are referenced by mutable tags: %s; pin them to exact versions or digests",
+			strings.Join(offending, ", "))
+	}
+	return nil
+}
+
+// ResolveCache keeps resolved images for a limited time. It is safe for concurrent use,
+// a nil cache or the one with zero TTL caches nothing.
+type ResolveCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]resolveCacheEntry
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type resolveCacheEntry struct {
+	image    *imagename.ImageName
+	digest   string
+	resolved time.Time
+}
+
+// NewResolveCache returns a new cache of resolved images that expire after ttl
+func NewResolveCache(ttl time.Duration) *ResolveCache {
+	return &ResolveCache{
+		ttl:     ttl,
+		entries: map[string]resolveCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// Get returns a copy of the resolved image and its digest if the key is cached and not expired
+func (c *ResolveCache) Get(key string) (image *imagename.ImageName, digest string, ok bool) {
+	if c == nil || c.ttl <= 0 {
+		return nil, "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	if c.now().Sub(entry.resolved) >= c.ttl {
+		delete(c.entries, key)
+		return nil, "", false
+	}
+
+	result := *entry.image
+	return &result, entry.digest, true
+}
+
+// Set remembers the resolved image and its digest for the key, e.g. the image range
+func (c *ResolveCache) Set(key string, image *imagename.ImageName, digest string) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := *image
+	c.entries[key] = resolveCacheEntry{image: &stored, digest: digest, resolved: c.now()}
+}
+
+// Clear drops all cached entries
+func (c *ResolveCache) Clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]resolveCacheEntry{}
+}
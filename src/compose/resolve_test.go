@@ -0,0 +1,466 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker-compose/src/compose/config"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func imageList(names ...string) []*imagename.ImageName {
+	list := []*imagename.ImageName{}
+	for _, name := range names {
+		list = append(list, imagename.NewFromString(name))
+	}
+	return list
+}
+
+func TestFindMostRecentTagSkipsPrerelease(t *testing.T) {
+	list := imageList("app:1.4.0", "app:1.4.0-rc1", "app:1.4.1-rc1")
+
+	result := findMostRecentTag(imagename.NewFromString("app:~1.4.0"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "1.4.0", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:*"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "1.4.0", result.GetTag())
+}
+
+func TestFindMostRecentTagIncludePrerelease(t *testing.T) {
+	list := imageList("app:1.4.0", "app:1.4.0-rc1", "app:1.4.1-rc1")
+
+	result := findMostRecentTag(imagename.NewFromString("app:~1.4.0"), list, nil, false, ResolveOptions{IncludePrerelease: true})
+	assert.Equal(t, "1.4.1-rc1", result.GetTag())
+}
+
+func TestFindMostRecentTagPrereleaseLowerPrecedence(t *testing.T) {
+	list := imageList("app:1.4.0-rc1", "app:1.4.0")
+
+	result := findMostRecentTag(imagename.NewFromString("app:~1.4.0"), list, nil, false, ResolveOptions{IncludePrerelease: true})
+	assert.Equal(t, "1.4.0", result.GetTag())
+}
+
+func TestFindMostRecentTagExplicitPrerelease(t *testing.T) {
+	list := imageList("app:1.4.0", "app:1.4.0-rc1", "app:1.4.1-rc1")
+
+	result := findMostRecentTag(imagename.NewFromString("app:1.4.0-rc1"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "1.4.0-rc1", result.GetTag())
+}
+
+func TestFindMostRecentTagDateStrategy(t *testing.T) {
+	list := imageList("app:20231231-2359", "app:20240115-1430", "app:20240115", "app:20240116-0900", "app:1.2.3")
+	opts := ResolveOptions{Strategy: ResolveDate}
+
+	result := findMostRecentTag(imagename.NewFromString("app:2024*"), list, nil, false, opts)
+	assert.Equal(t, "20240116-0900", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:20240115*"), list, nil, false, opts)
+	assert.Equal(t, "20240115-1430", result.GetTag())
+
+	// semver tags are still resolved as usual
+	result = findMostRecentTag(imagename.NewFromString("app:~1.2.0"), list, nil, false, opts)
+	assert.Equal(t, "1.2.3", result.GetTag())
+}
+
+func TestFindMostRecentTagDateWildcardIgnoredBySemver(t *testing.T) {
+	list := imageList("app:20240115-1430", "app:20240116-0900")
+
+	result := findMostRecentTag(imagename.NewFromString("app:2024*"), list, nil, false, ResolveOptions{})
+	assert.Nil(t, result)
+}
+
+func TestFindMostRecentTagTieBreak(t *testing.T) {
+	image := imagename.NewFromString("app:~1.2.0")
+
+	// the local image wins over the remote tag of the same version
+	result := findMostRecentTag(image, imageList("app:v1.2.0"), imageList("app:1.2.0", "app:1.1.0"), false, ResolveOptions{})
+	assert.Equal(t, "v1.2.0", result.GetTag())
+
+	// equal remote versions resolve to the lexically smaller tag regardless of order
+	result = findMostRecentTag(image, nil, imageList("app:v1.2.0", "app:1.2.0"), false, ResolveOptions{})
+	assert.Equal(t, "1.2.0", result.GetTag())
+
+	result = findMostRecentTag(image, nil, imageList("app:1.2.0", "app:v1.2.0"), false, ResolveOptions{})
+	assert.Equal(t, "1.2.0", result.GetTag())
+
+	// candidates of the image's own registry go before others, then lexical registry order
+	own := imagename.NewFromString("app:1.2.0")
+	mirrorB := imagename.NewFromString("b.example.com/app:1.2.0")
+	mirrorA := imagename.NewFromString("a.example.com/app:1.2.0")
+	isLocal := map[*imagename.ImageName]bool{}
+
+	assert.True(t, winsTie(image, own, mirrorA, isLocal))
+	assert.False(t, winsTie(image, mirrorA, own, isLocal))
+	assert.True(t, winsTie(image, mirrorA, mirrorB, isLocal))
+	assert.False(t, winsTie(image, mirrorB, mirrorA, isLocal))
+}
+
+func TestIsDowngrade(t *testing.T) {
+	assert.True(t, isDowngrade(imagename.NewFromString("app:1.4.2"), imagename.NewFromString("app:1.4.1")))
+	assert.False(t, isDowngrade(imagename.NewFromString("app:1.4.1"), imagename.NewFromString("app:1.4.2")))
+	assert.False(t, isDowngrade(imagename.NewFromString("app:1.4.1"), imagename.NewFromString("app:1.4.1")))
+	assert.False(t, isDowngrade(imagename.NewFromString("other:1.4.2"), imagename.NewFromString("app:1.4.1")))
+	assert.False(t, isDowngrade(imagename.NewFromString("app:latest"), imagename.NewFromString("app:1.4.1")))
+	assert.False(t, isDowngrade(nil, imagename.NewFromString("app:1.4.1")))
+}
+
+func TestFindMostRecentTagVersionPrefix(t *testing.T) {
+	list := imageList("app:v1.2.3", "app:V2.0.0", "app:vista", "app:1.9.0")
+
+	result := findMostRecentTag(imagename.NewFromString("app:~1.2.0"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "v1.2.3", result.GetTag())
+
+	// the original tag is kept for the pull
+	result = findMostRecentTag(imagename.NewFromString("app:*"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "V2.0.0", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:^2.0.0"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "V2.0.0", result.GetTag())
+
+	assert.Nil(t, versionTagged(imagename.NewFromString("app:vista")).TagAsVersion())
+	assert.True(t, isDowngrade(imagename.NewFromString("app:V2.0.0"), imagename.NewFromString("app:v1.2.3")))
+}
+
+func TestSameRepo(t *testing.T) {
+	assert.True(t, SameRepo(imagename.NewFromString("app:1.2.3"), imagename.NewFromString("app:1.3.0")))
+	assert.True(t, SameRepo(imagename.NewFromString("redis:3.0"), imagename.NewFromString("docker.io/library/redis:latest")))
+	assert.True(t, SameRepo(imagename.NewFromString("quay.io/app:1"), imagename.NewFromString("quay.io/app@sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11")))
+	assert.False(t, SameRepo(imagename.NewFromString("quay.io/app:1"), imagename.NewFromString("app:1")))
+	assert.False(t, SameRepo(imagename.NewFromString("app:1"), imagename.NewFromString("other:1")))
+	assert.False(t, SameRepo(nil, imagename.NewFromString("app:1")))
+}
+
+func TestImageContainsOfficialImages(t *testing.T) {
+	tests := []struct {
+		image     string
+		candidate string
+		contains  bool
+	}{
+		{"redis:3.*", "redis:3.2.1", true},
+		{"redis:3.*", "library/redis:3.2.1", true},
+		{"library/redis:3.*", "redis:3.2.1", true},
+		{"docker.io/library/redis:~3.2", "redis:3.2.1", true},
+		{"index.docker.io/redis:3.*", "redis:3.2.1", true},
+		{"redis:3.*", "redis:4.0.0", false},
+		{"nginx:1.9.*", "library/nginx:1.9.3", true},
+		{"nginx:1.9.*", "quay.io/nginx:1.9.3", false},
+		{"grammarly/app:1.*", "docker.io/grammarly/app:1.2.0", true},
+		{"grammarly/app:1.*", "app:1.2.0", false},
+	}
+
+	for _, test := range tests {
+		result := ImageContains(imagename.NewFromString(test.image), imagename.NewFromString(test.candidate))
+		assert.Equal(t, test.contains, result, "%s contains %s", test.image, test.candidate)
+	}
+}
+
+func TestFindMostRecentTagOfficialImages(t *testing.T) {
+	local := imageList("redis:3.2.1", "nginx:1.9.3", "grammarly/app:1.2.0")
+	remote := imageList("library/redis:3.2.5", "docker.io/library/nginx:1.9.5")
+
+	tests := []struct {
+		image    string
+		expected string
+	}{
+		{"redis:3.2.*", "library/redis:3.2.5"},
+		{"library/redis:3.2.*", "library/redis:3.2.5"},
+		{"docker.io/nginx:1.9.*", "docker.io/library/nginx:1.9.5"},
+		{"docker.io/library/nginx:1.9.3", "nginx:1.9.3"},
+		{"grammarly/app:1.*", "grammarly/app:1.2.0"},
+	}
+
+	for _, test := range tests {
+		result := findMostRecentTag(imagename.NewFromString(test.image), local, remote, false, ResolveOptions{})
+		if assert.NotNil(t, result, test.image) {
+			assert.Equal(t, test.expected, result.String(), test.image)
+		}
+	}
+
+	// the display name is kept as written
+	redis := imagename.NewFromString("redis:3.2")
+	assert.Equal(t, "redis", redis.NameWithRegistry())
+	assert.Equal(t, "redis:3.2.5", WithTag(redis, "3.2.5").String())
+}
+
+func TestIsUpgradeFrom(t *testing.T) {
+	assert.True(t, IsUpgradeFrom(imagename.NewFromString("app:1.3.0"), imagename.NewFromString("app:1.2.3")))
+	assert.True(t, IsUpgradeFrom(imagename.NewFromString("app:V2.0.0"), imagename.NewFromString("app:v1.9.0")))
+	assert.False(t, IsUpgradeFrom(imagename.NewFromString("app:1.2.3"), imagename.NewFromString("app:1.3.0")))
+	assert.False(t, IsUpgradeFrom(imagename.NewFromString("app:1.2.3"), imagename.NewFromString("app:1.2.3")))
+	assert.False(t, IsUpgradeFrom(imagename.NewFromString("other:1.3.0"), imagename.NewFromString("app:1.2.3")))
+
+	// non-semver tags cannot be compared
+	assert.False(t, IsUpgradeFrom(imagename.NewFromString("app:latest"), imagename.NewFromString("app:1.2.3")))
+	assert.False(t, IsUpgradeFrom(imagename.NewFromString("app:1.2.3"), imagename.NewFromString("app:stable")))
+}
+
+func TestFindMostRecentTagIgnoreLatest(t *testing.T) {
+	list := imageList("app:latest", "app:2.0.1", "app:2.0.3", "app:3.0.0")
+
+	// wildcards and images without a tag prefer latest by default
+	result := findMostRecentTag(imagename.NewFromString("app"), list, nil, false, ResolveOptions{})
+	assert.Equal(t, "latest", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:~2.0"), list, nil, false, ResolveOptions{IgnoreLatest: true})
+	assert.Equal(t, "2.0.3", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:*"), list, nil, false, ResolveOptions{IgnoreLatest: true})
+	assert.Equal(t, "3.0.0", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app"), list, nil, false, ResolveOptions{IgnoreLatest: true})
+	assert.Equal(t, "3.0.0", result.GetTag())
+}
+
+func TestFindMostRecentTagIgnoreTags(t *testing.T) {
+	list := imageList("app:latest", "app:edge", "app:nightly", "app:canary-2.1.0", "app:2.0.1", "app:2.0.3")
+	opts := ResolveOptions{IgnoreTags: []string{"edge", "nightly", "canary-*", "latest"}}
+
+	for _, name := range []string{"app", "app:*", "app:~2.0", "app:2.x"} {
+		result := findMostRecentTag(imagename.NewFromString(name), list, nil, false, opts)
+		assert.Equal(t, "2.0.3", result.GetTag(), name)
+	}
+
+	// the ignored tags are used when asked for explicitly
+	result := findMostRecentTag(imagename.NewFromString("app:edge"), list, nil, false, opts)
+	assert.Equal(t, "edge", result.GetTag())
+
+	result = findMostRecentTag(imagename.NewFromString("app:*"), imageList("app:edge", "app:nightly"), nil, false, opts)
+	assert.Nil(t, result)
+
+	tags := []string{}
+	for _, image := range matchingTags(imagename.NewFromString("app:*"), list, opts) {
+		tags = append(tags, image.GetTag())
+	}
+	assert.Equal(t, []string{"2.0.1", "2.0.3"}, tags)
+
+	assert.Equal(t, imageList("app:edge"), matchingTags(imagename.NewFromString("app:edge"), list, opts))
+}
+
+func TestSortTags(t *testing.T) {
+	tags := func(list []*imagename.ImageName) []string {
+		result := []string{}
+		for _, image := range list {
+			result = append(result, image.GetTag())
+		}
+		return result
+	}
+
+	list := imageList("app:1.4.0-rc1", "app:stable", "app:1.3.9", "app:v1.4.0", "app:latest", "app:1.4.0", "app:dev", "app:1.10.0")
+	sortTags(list, ResolveOptions{})
+	assert.Equal(t, []string{"latest", "1.10.0", "1.4.0", "v1.4.0", "1.4.0-rc1", "1.3.9", "dev", "stable"}, tags(list))
+
+	// the order of the input does not matter
+	list = imageList("app:dev", "app:1.4.0", "app:v1.4.0", "app:1.10.0", "app:1.3.9", "app:latest", "app:stable", "app:1.4.0-rc1")
+	sortTags(list, ResolveOptions{})
+	assert.Equal(t, []string{"latest", "1.10.0", "1.4.0", "v1.4.0", "1.4.0-rc1", "1.3.9", "dev", "stable"}, tags(list))
+
+	// the range filters the candidates, pre-releases are skipped unless asked for
+	all := imageList("app:latest", "app:1.4.3-rc1", "app:1.4.2", "app:1.4.0", "app:1.3.9", "other:1.4.5", "app:1.4.2")
+
+	list = matchingTags(imagename.NewFromString("app:~1.4"), all, ResolveOptions{})
+	sortTags(list, ResolveOptions{})
+	assert.Equal(t, []string{"1.4.2", "1.4.0"}, tags(list))
+
+	list = matchingTags(imagename.NewFromString("app:~1.4"), all, ResolveOptions{IncludePrerelease: true})
+	sortTags(list, ResolveOptions{})
+	assert.Equal(t, []string{"1.4.3-rc1", "1.4.2", "1.4.0"}, tags(list))
+
+	list = matchingTags(imagename.NewFromString("app"), all, ResolveOptions{IgnoreLatest: true})
+	sortTags(list, ResolveOptions{})
+	assert.Equal(t, []string{"1.4.3-rc1", "1.4.2", "1.4.0", "1.3.9"}, tags(list))
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		image string
+		host  string
+		hub   bool
+	}{
+		{"redis:3.2", "registry-1.docker.io", true},
+		{"grammarly/app:1.0", "registry-1.docker.io", true},
+		{"docker.io/library/redis", "registry-1.docker.io", true},
+		{"index.docker.io/grammarly/app", "registry-1.docker.io", true},
+		{"quay.io/org/app:1.0", "quay.io", false},
+		{"registry.internal:5000/app:1.0", "registry.internal:5000", false},
+		{"localhost:5000/app", "localhost:5000", false},
+	}
+
+	for _, test := range tests {
+		image := imagename.NewFromString(test.image)
+		assert.Equal(t, test.host, RegistryHost(image), test.image)
+		assert.Equal(t, test.hub, IsDockerHub(image), test.image)
+	}
+}
+
+func TestImageMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		image   string
+		matches bool
+	}{
+		{"myorg/*", "myorg/app:1.0", true},
+		{"myorg/*", "docker.io/myorg/app", true},
+		{"myorg/*", "otherorg/app:1.0", false},
+		{"myorg/*", "myorg/team/app:1.0", false},
+		{"myorg/*", "quay.io/myorg/app:1.0", false},
+		{"*/nginx", "myorg/nginx:1.9", true},
+		{"*/nginx", "myorg/nginx-proxy:1.9", false},
+		{"*/nginx", "nginx:1.9", false},
+		{"nginx", "nginx:1.9", true},
+		{"nginx", "library/nginx:1.9", true},
+		{"docker.io/library/nginx", "nginx", true},
+		{"nginx", "quay.io/nginx:1.9", false},
+		{"nginx:1.9", "nginx:1.9", true},
+		{"nginx:1.9", "nginx:1.10", false},
+		{"nginx:1.*", "nginx:1.10", true},
+		{"nginx:latest", "nginx", true},
+		{"quay.io/myorg/*", "quay.io/myorg/app:1.0", true},
+		{"*.internal:5000/app", "registry.internal:5000/app:1.0", true},
+		{"registry.internal:5000/app:1.?", "registry.internal:5000/app:1.0", true},
+		{"redis@sha256:aaa", "redis@sha256:aaa", true},
+		{"redis@sha256:aaa", "redis@sha256:bbb", false},
+		{"[", "redis", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.matches, ImageMatches(imagename.NewFromString(test.image), test.pattern), "%s ~ %s", test.image, test.pattern)
+	}
+}
+
+func TestIsFloating(t *testing.T) {
+	floating := []string{"app", "app:latest", "app:stable", "app:nightly", "app:1.2.*", "app:~1.2", "app:*", "app:x"}
+	for _, name := range floating {
+		assert.True(t, IsFloating(imagename.NewFromString(name)), name)
+	}
+
+	pinned := []string{"app:1.2.3", "app:v1.2.3", "app:V1.2.3", "app:1.2.3-rc1", "app:20240115-1430",
+		"app@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"}
+	for _, name := range pinned {
+		assert.False(t, IsFloating(imagename.NewFromString(name)), name)
+	}
+}
+
+func TestIsFloatingMutableTags(t *testing.T) {
+	defer func(tags []string) { MutableTags = tags }(MutableTags)
+
+	assert.False(t, IsFloating(imagename.NewFromString("app:1.4.0-beta1")))
+	assert.False(t, IsFloating(imagename.NewFromString("app:3")))
+
+	// beta builds and the major version alias are moved by the repository
+	MutableTags = []string{"*-beta*", "3"}
+	assert.True(t, IsFloating(imagename.NewFromString("app:1.4.0-beta1")))
+	assert.True(t, IsFloating(imagename.NewFromString("app:3")))
+	assert.False(t, IsFloating(imagename.NewFromString("app:3.0.1")))
+
+	// latest and ranges are floating regardless of the list
+	MutableTags = nil
+	assert.True(t, IsFloating(imagename.NewFromString("app:latest")))
+	assert.True(t, IsFloating(imagename.NewFromString("app:~1.4")))
+}
+
+func TestCheckPinned(t *testing.T) {
+	containers := []*Container{
+		{Name: config.NewContainerName("test", "a"), Image: imagename.NewFromString("app:1.2.3")},
+		{Name: config.NewContainerName("test", "b"), Image: imagename.NewFromString("db:latest")},
+	}
+	assert.EqualError(t, checkPinned(containers),
+		"Strict pinning is on, but images are referenced by mutable tags: db:latest (container test.b); pin them to exact versions or digests")
+
+	assert.Nil(t, checkPinned(containers[:1]))
+}
+
+func TestWithTagAndDigest(t *testing.T) {
+	digest := "sha256:ead434cd278824865d6e3b67e5d4579ded02eb2e8367fc165efa21138b225f11"
+
+	for _, name := range []string{"app:1.2.*", "registry.example.com:5000/team/app:~1.2", "s3:bucket/app:1.2.*"} {
+		image := imagename.NewFromString(name)
+
+		tagged := WithTag(image, "1.2.7")
+		assert.Equal(t, name, image.String(), "the original should not change")
+		assert.Equal(t, image.NameWithRegistry()+":1.2.7", tagged.String())
+		assert.True(t, tagged.IsStrict())
+		assert.Equal(t, tagged, imagename.NewFromString(tagged.String()))
+
+		pinned := WithDigest(image, digest)
+		assert.Equal(t, image.NameWithRegistry()+"@"+digest, pinned.String())
+		assert.True(t, pinned.TagIsDigest())
+		assert.Equal(t, pinned, imagename.NewFromString(pinned.String()))
+	}
+}
+
+func TestResolveCache(t *testing.T) {
+	now := time.Now()
+	cache := NewResolveCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	image := imagename.NewFromString("app:1.4.2")
+	cache.Set("app:~1.4", image, "sha256:abc")
+
+	// the cached value does not change along with the original
+	image.SetTag("1.5.0")
+
+	cached, digest, ok := cache.Get("app:~1.4")
+	assert.True(t, ok)
+	assert.Equal(t, "app:1.4.2", cached.String())
+	assert.Equal(t, "sha256:abc", digest)
+
+	_, _, ok = cache.Get("app:~1.5")
+	assert.False(t, ok)
+
+	now = now.Add(time.Minute)
+	_, _, ok = cache.Get("app:~1.4")
+	assert.False(t, ok, "entry should expire after TTL")
+
+	cache.Set("app:~1.4", image, "")
+	cache.Clear()
+	_, _, ok = cache.Get("app:~1.4")
+	assert.False(t, ok, "entry should be dropped by Clear")
+}
+
+func TestResolveCacheDisabled(t *testing.T) {
+	for _, cache := range []*ResolveCache{nil, NewResolveCache(0)} {
+		cache.Set("app:~1.4", imagename.NewFromString("app:1.4.2"), "")
+		_, _, ok := cache.Get("app:~1.4")
+		assert.False(t, ok)
+		cache.Clear()
+	}
+}
+
+func TestResolveCacheConcurrent(t *testing.T) {
+	cache := NewResolveCache(time.Minute)
+	image := imagename.NewFromString("app:1.4.2")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				cache.Set("app:~1.4", image, "")
+				cache.Get("app:~1.4")
+				if j%10 == 0 {
+					cache.Clear()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,135 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// TraceCalls makes every registry request and every docker daemon call of the pull be
+// logged along with its result, e.g. to find out why a version range resolves unexpectedly.
+// It is off by default, the output is noisy. Credentials are never logged and the secrets
+// in the logged urls are redacted, see redactURL.
+var TraceCalls = false
+
+// redactedQueryParams are the url query parameters that may carry secrets,
+// matched as substrings of the lowercased name
+var redactedQueryParams = []string{"token", "password", "secret", "signature", "auth", "key"}
+
+// tracef logs the message if TraceCalls is on
+func tracef(format string, args ...interface{}) {
+	if TraceCalls {
+		log.Infof("[trace] "+format, args...)
+	}
+}
+
+// redactURL returns the url with the user info and the values of the query parameters
+// that may carry secrets replaced by "REDACTED"; unparseable urls are redacted entirely
+func redactURL(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "REDACTED"
+	}
+
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+
+	query := u.Query()
+	redacted := false
+	for name := range query {
+		lower := strings.ToLower(name)
+		for _, secret := range redactedQueryParams {
+			if strings.Contains(lower, secret) {
+				query.Set(name, "REDACTED")
+				redacted = true
+				break
+			}
+		}
+	}
+	if redacted {
+		u.RawQuery = query.Encode()
+	}
+
+	return u.String()
+}
+
+// tracedDockerAPI logs the daemon calls made during the pull, see TraceCalls
+type tracedDockerAPI struct {
+	DockerAPI
+}
+
+// traceDockerAPI wraps the client to log its calls if TraceCalls is on
+func traceDockerAPI(client DockerAPI) DockerAPI {
+	if !TraceCalls {
+		return client
+	}
+	if _, ok := client.(tracedDockerAPI); ok {
+		return client
+	}
+	return tracedDockerAPI{client}
+}
+
+// untracedDockerAPI returns the client wrapped by traceDockerAPI
+func untracedDockerAPI(client DockerAPI) DockerAPI {
+	if traced, ok := client.(tracedDockerAPI); ok {
+		return traced.DockerAPI
+	}
+	return client
+}
+
+// ListImages implements DockerAPI
+func (c tracedDockerAPI) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	started := time.Now()
+	images, err := c.DockerAPI.ListImages(opts)
+	tracef("Docker ListImages -> %d images, error: %v (%s)", len(images), err, time.Since(started))
+	return images, err
+}
+
+// InspectImage implements DockerAPI
+func (c tracedDockerAPI) InspectImage(name string) (*docker.Image, error) {
+	started := time.Now()
+	img, err := c.DockerAPI.InspectImage(name)
+	id := ""
+	if img != nil {
+		id = img.ID
+	}
+	tracef("Docker InspectImage %s -> %.19s, error: %v (%s)", name, id, err, time.Since(started))
+	return img, err
+}
+
+// PullImage implements DockerAPI
+func (c tracedDockerAPI) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	started := time.Now()
+	err := c.DockerAPI.PullImage(opts, auth)
+	tracef("Docker PullImage %s:%s (registry %q, with credentials: %t) -> error: %v (%s)",
+		opts.Repository, opts.Tag, opts.Registry, auth.Username != "", err, time.Since(started))
+	return err
+}
+
+// TagImage implements DockerAPI
+func (c tracedDockerAPI) TagImage(name string, opts docker.TagImageOptions) error {
+	started := time.Now()
+	err := c.DockerAPI.TagImage(name, opts)
+	tracef("Docker TagImage %s as %s:%s -> error: %v (%s)", name, opts.Repo, opts.Tag, err, time.Since(started))
+	return err
+}
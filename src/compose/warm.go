@@ -0,0 +1,130 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker-compose/src/compose/config"
+	"github.com/grammarly/rocker/src/imagename"
+	"golang.org/x/net/context"
+)
+
+// ParseImageList reads image references, one per line, e.g. a list of images to pre-stage
+// on a new host. Empty lines and lines starting with # are skipped, duplicates are dropped.
+// References may have version ranges, e.g. app:1.2.*, which are resolved by WarmImages.
+// Credentials given inline, e.g. user:pass@registry.internal/app:1.0, are stripped off
+// the references and added to auth, see ParseImageWithCredentials.
+func ParseImageList(r io.Reader, auth *docker.AuthConfigurations) ([]*imagename.ImageName, error) {
+	var (
+		images  = []*imagename.ImageName{}
+		seen    = map[string]struct{}{}
+		scanner = bufio.NewScanner(r)
+		lineNum = 0
+	)
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, creds, err := splitImageCredentials(line)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", lineNum, err)
+		}
+		if err := config.ValidateImageName(name); err != nil {
+			return nil, fmt.Errorf("Line %d: %s", lineNum, err)
+		}
+		if creds.Username != "" {
+			if auth == nil {
+				return nil, fmt.Errorf("Line %d: inline credentials are not accepted", lineNum)
+			}
+			if auth.Configs == nil {
+				auth.Configs = map[string]docker.AuthConfiguration{}
+			}
+			auth.Configs[creds.ServerAddress] = creds
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		images = append(images, imagename.NewFromString(name))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the list of images, error: %s", err)
+	}
+
+	return images, nil
+}
+
+// WarmImages pulls the given images to warm up the local cache, e.g. before a deploy window.
+// Version ranges are resolved over the remote tags the same way as for containers, and images
+// are pulled in parallel according to PullConcurrency. Failures of single images do not stop
+// the others, they are all reported in the returned error.
+func (client *DockerClient) WarmImages(images []*imagename.ImageName) error {
+	var (
+		resolved = []*imagename.ImageName{}
+		errs     = []string{}
+		opts     = client.PullOptions
+	)
+	opts.specs = map[string]string{}
+
+	for _, image := range images {
+		if image.IsStrict() {
+			resolved = append(resolved, image)
+			continue
+		}
+
+		candidate, _, err := client.tags().resolveImageTag(image, nil, true)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", image, err))
+			continue
+		}
+
+		log.Infof("Resolve %s --> %s", image, candidate.GetTag())
+		resolved = append(resolved, candidate)
+		opts.specs[candidate.String()] = image.String()
+	}
+
+	pulled, err := PullImages(context.Background(), client.Docker, resolved, client.Auth, opts, client.PullConcurrency)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	for _, image := range resolved {
+		if p, ok := pulled[image.String()]; ok {
+			client.pulledImages = append(client.pulledImages, p)
+		}
+	}
+
+	log.Infof("Warmed up %d of %d images", len(pulled), len(images))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to warm up %d of %d images, errors: %s", len(images)-len(pulled), len(images), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package compose
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageList(t *testing.T) {
+	list := `
+# base images
+alpine:3.2
+  test/app:1.2.*
+
+alpine:3.2
+registry.example.com:5000/team/db@sha256:0123456789abcdef0123456789abcdef
+`
+	images, err := ParseImageList(strings.NewReader(list), nil)
+	assert.Nil(t, err)
+
+	names := []string{}
+	for _, image := range images {
+		names = append(names, image.String())
+	}
+	assert.Equal(t, []string{
+		"alpine:3.2",
+		"test/app:1.2.*",
+		"registry.example.com:5000/team/db@sha256:0123456789abcdef0123456789abcdef",
+	}, names)
+
+	_, err = ParseImageList(strings.NewReader("alpine:3.2\nfoo::\n"), nil)
+	assert.EqualError(t, err, "Line 2: Invalid image reference 'foo::': empty tag")
+}
+
+func TestParseImageListCredentials(t *testing.T) {
+	list := `
+user:secret@registry.internal/app:1.0
+registry.internal/app:1.0
+`
+	auth := &docker.AuthConfigurations{}
+	images, err := ParseImageList(strings.NewReader(list), auth)
+	assert.Nil(t, err)
+
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, "registry.internal/app:1.0", images[0].String())
+	}
+	assert.Equal(t, map[string]docker.AuthConfiguration{
+		"registry.internal": {Username: "user", Password: "secret", ServerAddress: "registry.internal"},
+	}, auth.Configs)
+
+	_, err = ParseImageList(strings.NewReader(list), nil)
+	assert.EqualError(t, err, "Line 2: inline credentials are not accepted")
+}
+
+func TestWarmImages(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/app/tags/list" {
+			fmt.Fprint(w, `{"name":"app","tags":["1.2.0","1.2.7","1.3.0"]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer registry.Close()
+
+	var (
+		mu     sync.Mutex
+		pulled = []string{}
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/images/create" {
+			image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+			mu.Lock()
+			pulled = append(pulled, image)
+			mu.Unlock()
+			if strings.HasSuffix(image, "broken:1") {
+				fmt.Fprint(w, "{\"errorDetail\":{\"message\":\"manifest unknown\"},\"error\":\"manifest unknown\"}\r\n")
+				return
+			}
+			fmt.Fprint(w, "{\"status\":\"Status: Downloaded newer image\"}\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc"}`)
+	}))
+	defer server.Close()
+
+	cli, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := strings.TrimPrefix(registry.URL, "http://")
+
+	client := &DockerClient{
+		Docker:          cli,
+		Auth:            &docker.AuthConfigurations{},
+		Registry:        RegistryConfig{InsecureRegistries: []string{host}},
+		PullConcurrency: 2,
+	}
+
+	err = client.WarmImages([]*imagename.ImageName{
+		imagename.NewFromString(host + "/app:1.2.*"),
+		imagename.NewFromString(host + "/missing:1.*"),
+		imagename.NewFromString("test/broken:1"),
+		imagename.NewFromString("alpine:3.2"),
+	})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Failed to warm up 2 of 4 images")
+		assert.Contains(t, err.Error(), host+"/missing:1.*: Failed to list tags")
+		assert.Contains(t, err.Error(), "test/broken:1: ")
+	}
+
+	sort.Strings(pulled)
+	assert.Equal(t, []string{host + "/app:1.2.7", "alpine:3.2", "test/broken:1"}, pulled)
+
+	warmed := []string{}
+	for _, image := range client.GetPulledImages() {
+		warmed = append(warmed, image.String())
+	}
+	sort.Strings(warmed)
+	assert.Equal(t, []string{host + "/app:1.2.7", "alpine:3.2"}, warmed)
+}